@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/icexin/eggos/app"
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+func freemain(ctx *app.Context) error {
+	st := mm.Stats()
+	fmt.Fprintf(ctx.Stdout, "%12s %12s %12s\n", "total", "used", "free")
+	fmt.Fprintf(ctx.Stdout, "%12d %12d %12d\n", st.Total>>10, st.Used>>10, st.Free>>10)
+	return nil
+}
+
+func meminfomain(ctx *app.Context) error {
+	st := mm.Stats()
+	fmt.Fprintf(ctx.Stdout, "MemTotal: %10d kB\n", st.Total>>10)
+	fmt.Fprintf(ctx.Stdout, "MemUsed:  %10d kB\n", st.Used>>10)
+	fmt.Fprintf(ctx.Stdout, "MemFree:  %10d kB\n", st.Free>>10)
+	fmt.Fprintf(ctx.Stdout, "HugePages:%10d\n", st.HugePages)
+	for _, z := range st.Zones {
+		if z.Managed == 0 {
+			continue
+		}
+		fmt.Fprintf(ctx.Stdout, "\nZone %s [%#x-%#x)\n", z.Name, z.Start, z.End)
+		fmt.Fprintf(ctx.Stdout, "  managed %d pages, free %d pages\n", z.Managed, z.Free)
+		fmt.Fprintf(ctx.Stdout, "  free blocks by order:")
+		for _, n := range z.FreeBlocks {
+			fmt.Fprintf(ctx.Stdout, " %d", n)
+		}
+		fmt.Fprintf(ctx.Stdout, "\n")
+	}
+	return nil
+}
+
+func init() {
+	app.Register("free", freemain)
+	app.Register("meminfo", meminfomain)
+}
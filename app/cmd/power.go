@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"syscall"
+
+	"github.com/icexin/eggos/app"
+)
+
+func rebootmain(ctx *app.Context) error {
+	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
+}
+
+func poweroffmain(ctx *app.Context) error {
+	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+}
+
+func init() {
+	app.Register("reboot", rebootmain)
+	app.Register("poweroff", poweroffmain)
+}
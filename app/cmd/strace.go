@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/icexin/eggos/app"
+	"github.com/icexin/eggos/drivers/kbd"
+	"github.com/icexin/eggos/kernel"
+	"github.com/icexin/eggos/kernel/strace"
+)
+
+func printRecord(ctx *app.Context, r *strace.Record) {
+	// the trailing zero arguments are omitted
+	nargs := len(r.Args)
+	for nargs > 1 && r.Args[nargs-1] == 0 {
+		nargs--
+	}
+	args := make([]string, nargs)
+	for i := range args {
+		args[i] = fmt.Sprintf("%#x", r.Args[i])
+	}
+	var ret string
+	if errno := r.Errno(); errno != 0 {
+		ret = fmt.Sprintf("-1 (%s)", errno)
+	} else {
+		ret = fmt.Sprintf("%#x", r.Ret)
+	}
+	var forward string
+	if r.Forwarded {
+		forward = "*"
+	}
+	fmt.Fprintf(ctx.Stdout, "[%12.6f] %3d %s%s(%s) = %s <%.6f>\n",
+		float64(r.Start)/1e9, r.Tid, forward, kernel.SyscallName(int(r.No)),
+		strings.Join(args, ", "), ret, float64(r.Latency)/1e9)
+}
+
+func stracemain(ctx *app.Context) error {
+	var (
+		flagset = ctx.Flag()
+		calls   = flagset.String("e", "", "trace only the comma separated syscalls, eg. read,write")
+		fd      = flagset.Int("fd", -1, "trace only the syscalls operating on fd")
+		dump    = flagset.Bool("d", false, "dump the syscalls recorded before and exit")
+	)
+	err := flagset.Parse(ctx.Args[1:])
+	if err != nil {
+		return err
+	}
+
+	buf := make([]strace.Record, 0, 256)
+	var seq uint64
+	// the filters apply to the syscalls recorded later
+	if !*dump {
+		var nos []uintptr
+		if *calls != "" {
+			for _, name := range strings.Split(*calls, ",") {
+				no := kernel.SyscallNumber(name)
+				if no < 0 {
+					return fmt.Errorf("unknown syscall %s", name)
+				}
+				nos = append(nos, uintptr(no))
+			}
+		}
+		err = strace.SetSyscallFilter(nos)
+		if err != nil {
+			return err
+		}
+		strace.SetFdFilter(*fd)
+		seq = strace.Head()
+		strace.Enable()
+		defer strace.Disable()
+		fmt.Fprintf(ctx.Stdout, "tracing syscalls, press q to quit, * marks forwarded syscalls\n")
+	}
+	for {
+		var recs []strace.Record
+		var lost uint64
+		recs, seq, lost = strace.Read(seq, buf[:0])
+		if lost != 0 {
+			fmt.Fprintf(ctx.Stdout, "... %d records lost\n", lost)
+		}
+		for i := range recs {
+			printRecord(ctx, &recs[i])
+		}
+		if *dump {
+			if len(recs) == 0 {
+				return nil
+			}
+			continue
+		}
+		if kbd.Pressed('q') {
+			return nil
+		}
+		if len(recs) == 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func init() {
+	app.Register("strace", stracemain)
+}
@@ -11,13 +11,18 @@ import (
 )
 
 func printstat(ctx *app.Context) {
-	var stat1, stat2 [20]int64
-	kernel.ThreadStat(&stat1)
+	stat1 := kernel.ThreadStat(nil)
 	time.Sleep(time.Second)
-	kernel.ThreadStat(&stat2)
+	stat2 := kernel.ThreadStat(nil)
+	// threads created in the interval are ignored
+	stat2 = stat2[:len(stat1)]
 
 	var sum int64
 	for i := range stat1 {
+		// slot reused by a new thread
+		if stat2[i] < stat1[i] {
+			stat1[i] = 0
+		}
 		sum += stat2[i] - stat1[i]
 	}
 	var tids []string
@@ -31,7 +36,15 @@ func printstat(ctx *app.Context) {
 		percents = append(percents, fmt.Sprintf("%3d", percent))
 	}
 	fmt.Fprintf(ctx.Stdout, "%s\n", strings.Join(tids, " "))
-	fmt.Fprintf(ctx.Stdout, "%s\n\n", strings.Join(percents, " "))
+	fmt.Fprintf(ctx.Stdout, "%s\n", strings.Join(percents, " "))
+
+	fwd := kernel.ForwardStats()
+	var avg time.Duration
+	if fwd.Calls != 0 {
+		avg = time.Duration(fwd.TotalLatency / int64(fwd.Calls))
+	}
+	fmt.Fprintf(ctx.Stdout, "forward: calls %d depth %d max %d full %d latency avg %s max %s\n\n",
+		fwd.Calls, fwd.Depth, fwd.MaxDepth, fwd.QueueFull, avg, time.Duration(fwd.MaxLatency))
 }
 
 func topmain(ctx *app.Context) error {
@@ -8,16 +8,14 @@ import (
 	"github.com/icexin/eggos/kernel/isyscall"
 )
 
-var handler isyscall.Handler
-
-func handleUname(req *isyscall.Request) {
+func handleUname(req *isyscall.Request, next isyscall.Handler) {
 	fmt.Println("syscall `uname` called")
-	handler(req)
+	next(req)
 }
 
 func main() {
-	handler = isyscall.GetHandler(syscall.SYS_UNAME)
-	isyscall.Register(syscall.SYS_UNAME, handleUname)
+	unwrap := isyscall.Wrap(syscall.SYS_UNAME, handleUname)
+	defer unwrap()
 	_, err := os.Hostname()
 	if err != nil {
 		panic(err)
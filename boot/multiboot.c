@@ -14,13 +14,22 @@ typedef unsigned long long uint64;
 
 #include "elf.h"
 #include "multiboot.h"
+#include "multiboot2.h"
+
+// the kernel runs on the boot page table which maps the low 1GB only,
+// and the multiboot2 info may be anywhere below 4GB on UEFI machines,
+// so it's moved here before entering the kernel.
+#define MBI2_MAX_SIZE (64 << 10)
 
 extern char _binary_boot64_elf_start[];
 
+char mbi2_copy[MBI2_MAX_SIZE] __attribute__((aligned(MULTIBOOT2_TAG_ALIGN)));
+
 void memcpy(char *dst, char *src, int count);
 void memset(char *addr, char data, int cnt);
 uint64 loadelf(char *image);
 uint64 loadKernelElf(multiboot_info_t *info);
+uint64 loadKernelElf2(struct multiboot2_info *info);
 typedef void (*boot64_entry_t)(uint32, uint32, uint32);
 
 void multibootmain(unsigned long magic, multiboot_info_t *mbi)
@@ -35,7 +44,15 @@ void multibootmain(unsigned long magic, multiboot_info_t *mbi)
     }
     boot64_entry = (boot64_entry_t)((uint32)entry_addr);
 
-    entry_addr = loadKernelElf(mbi);
+    if (magic == MULTIBOOT2_BOOTLOADER_MAGIC)
+    {
+        entry_addr = loadKernelElf2((struct multiboot2_info *)mbi);
+        mbi = (multiboot_info_t *)mbi2_copy;
+    }
+    else
+    {
+        entry_addr = loadKernelElf(mbi);
+    }
     if (entry_addr == 0)
     {
         return;
@@ -82,6 +99,33 @@ uint64 loadKernelElf(multiboot_info_t *info)
     return loadelf(new_addr);
 }
 
+uint64 loadKernelElf2(struct multiboot2_info *info)
+{
+    struct multiboot2_tag *tag;
+    struct multiboot2_tag_module *mod;
+    char *new_addr = (char *)(100 << 20); // 100 MB
+
+    if (info->total_size > MBI2_MAX_SIZE)
+    {
+        return 0;
+    }
+    memcpy(mbi2_copy, (char *)info, info->total_size);
+
+    // the kernel is the first module
+    tag = (struct multiboot2_tag *)(info + 1);
+    while (tag->type != MULTIBOOT2_TAG_TYPE_END)
+    {
+        if (tag->type == MULTIBOOT2_TAG_TYPE_MODULE)
+        {
+            mod = (struct multiboot2_tag_module *)tag;
+            memcpy(new_addr, (char *)(mod->mod_start), mod->mod_end - mod->mod_start + 1);
+            return loadelf(new_addr);
+        }
+        tag = (struct multiboot2_tag *)((char *)tag + ((tag->size + MULTIBOOT2_TAG_ALIGN - 1) & ~(MULTIBOOT2_TAG_ALIGN - 1)));
+    }
+    return 0;
+}
+
 void memcpy(char *dst, char *src, int count)
 {
     int i = 0;
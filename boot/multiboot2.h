@@ -0,0 +1,56 @@
+/* multiboot2.h - the subset of Multiboot2 used by the loader. */
+/* See https://www.gnu.org/software/grub/manual/multiboot2/multiboot.html */
+
+#ifndef MULTIBOOT2_HEADER
+#define MULTIBOOT2_HEADER 1
+
+/* How many bytes from the start of the file we search for the header. */
+#define MULTIBOOT2_SEARCH 32768
+#define MULTIBOOT2_HEADER_ALIGN 8
+
+/* The magic field should contain this. */
+#define MULTIBOOT2_HEADER_MAGIC 0xe85250d6
+
+/* This should be in %eax. */
+#define MULTIBOOT2_BOOTLOADER_MAGIC 0x36d76289
+
+/* The architecture field of header, 32-bit protected mode of i386. */
+#define MULTIBOOT2_ARCHITECTURE_I386 0
+
+/* The header tags. */
+#define MULTIBOOT2_HEADER_TAG_END 0
+#define MULTIBOOT2_HEADER_TAG_FRAMEBUFFER 5
+#define MULTIBOOT2_HEADER_TAG_OPTIONAL 1
+
+/* The information tags. */
+#define MULTIBOOT2_TAG_ALIGN 8
+#define MULTIBOOT2_TAG_TYPE_END 0
+#define MULTIBOOT2_TAG_TYPE_MODULE 3
+
+#ifndef ASM_FILE
+
+struct multiboot2_info
+{
+    uint32 total_size;
+    uint32 reserved;
+};
+
+struct multiboot2_tag
+{
+    uint32 type;
+    uint32 size;
+};
+
+struct multiboot2_tag_module
+{
+    uint32 type;
+    uint32 size;
+    /* the memory used goes from bytes 'mod_start' to 'mod_end-1' inclusive */
+    uint32 mod_start;
+    uint32 mod_end;
+    char cmdline[0];
+};
+
+#endif /* ! ASM_FILE */
+
+#endif /* ! MULTIBOOT2_HEADER */
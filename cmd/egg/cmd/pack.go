@@ -32,8 +32,27 @@ import (
 
 const (
 	grubDockerImage = "fanbingxin/grub:0.2.0"
+
+	// the minimal size of EFI system partition image, FAT32 needs at least 32M
+	minEFIImageSize = 64 << 20
 )
 
+// efiGrubConfig is the grub.cfg embedded in the EFI application,
+// the kernel is booted by multiboot2 on UEFI machines.
+const efiGrubConfig = `set timeout=1
+
+insmod all_video
+
+menuentry "eggos" {
+	set loader='/boot/multiboot.elf'
+	set kernel='/boot/kernel.elf'
+	echo "Loading ${kernel}..."
+	multiboot2 ${loader}
+	module2 ${kernel}
+	boot
+}
+`
+
 var (
 	packFormat     string
 	packOutFile    string
@@ -66,21 +85,43 @@ func runPackage() error {
 		log.Println(base)
 	}
 
-	isoBase := filepath.Join(base, "iso")
-
-	err = os.MkdirAll(isoBase, 0755)
+	kfile, err := getKernelFile(base)
 	if err != nil {
 		return err
 	}
 
-	err = extractBootDir(isoBase)
+	var tmpOutFile string
+	switch packFormat {
+	case "iso":
+		tmpOutFile, err = packISO(base, kfile)
+		if packOutFile == "" {
+			packOutFile = "eggos.iso"
+		}
+	case "efi":
+		tmpOutFile, err = packEFI(base, kfile)
+		if packOutFile == "" {
+			packOutFile = "eggos.img"
+		}
+	default:
+		return fmt.Errorf("unsupported package format %s", packFormat)
+	}
 	if err != nil {
 		return err
 	}
+	return copyfile(packOutFile, tmpOutFile)
+}
 
-	kfile, err := getKernelFile(base)
+func packISO(base, kfile string) (string, error) {
+	isoBase := filepath.Join(base, "iso")
+
+	err := os.MkdirAll(isoBase, 0755)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	err = extractBootDir(isoBase)
+	if err != nil {
+		return "", err
 	}
 
 	err = copyfile(
@@ -88,19 +129,80 @@ func runPackage() error {
 		kfile,
 	)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	tmpOutFile := filepath.Join(base, "eggos.iso")
-	err = mkiso(tmpOutFile, isoBase, base)
+	outFile := filepath.Join(base, "eggos.iso")
+	err = mkiso(outFile, isoBase, base)
+	return outFile, err
+}
+
+// packEFI builds a grub EFI application with the kernel in its memdisk,
+// and puts it in a FAT image as the removable media boot file.
+func packEFI(base, kfile string) (string, error) {
+	efiBase := filepath.Join(base, "efi")
+	err := os.MkdirAll(efiBase, 0755)
 	if err != nil {
-		return err
+		return "", err
+	}
+	err = extractBootDir(efiBase)
+	if err != nil {
+		return "", err
+	}
+	// the kernel file must be in base to be accessed by docker
+	kernelFile := filepath.Join(efiBase, "boot", "kernel.elf")
+	err = copyfile(kernelFile, kfile)
+	if err != nil {
+		return "", err
+	}
+	cfgFile := filepath.Join(efiBase, "boot", "grub", "grub.cfg")
+	err = os.WriteFile(cfgFile, []byte(efiGrubConfig), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	efiFile := filepath.Join(base, "BOOTX64.EFI")
+	err = runGrubTool(base,
+		"grub-mkstandalone", "-O", "x86_64-efi", "-o", efiFile,
+		"--modules=part_gpt part_msdos fat multiboot2 all_video",
+		"/boot/grub/grub.cfg="+cfgFile,
+		"/boot/multiboot.elf="+filepath.Join(efiBase, "boot", "multiboot.elf"),
+		"/boot/kernel.elf="+kernelFile,
+	)
+	if err != nil {
+		return "", err
 	}
 
-	if packOutFile == "" {
-		packOutFile = "eggos.iso"
+	info, err := os.Stat(efiFile)
+	if err != nil {
+		return "", err
 	}
-	return copyfile(packOutFile, tmpOutFile)
+	size := (info.Size() + 16<<20) &^ (1<<20 - 1)
+	if size < minEFIImageSize {
+		size = minEFIImageSize
+	}
+	outFile := filepath.Join(base, "eggos.img")
+	err = os.WriteFile(outFile, nil, 0644)
+	if err != nil {
+		return "", err
+	}
+	err = os.Truncate(outFile, size)
+	if err != nil {
+		return "", err
+	}
+
+	cmds := [][]string{
+		{"mformat", "-i", outFile, "-F", "-T", fmt.Sprint(size / 512), "-h", "64", "-s", "32", "::"},
+		{"mmd", "-i", outFile, "::/EFI", "::/EFI/BOOT"},
+		{"mcopy", "-i", outFile, efiFile, "::/EFI/BOOT/BOOTX64.EFI"},
+	}
+	for _, cmd := range cmds {
+		err = runGrubTool(base, cmd...)
+		if err != nil {
+			return "", err
+		}
+	}
+	return outFile, nil
 }
 
 func dockerImageExists(imageName string) error {
@@ -127,9 +229,15 @@ func dockerPullImage(imageName string) error {
 }
 
 func mkiso(outfile, isobase, moutbase string) error {
+	return runGrubTool(moutbase, "grub-mkrescue", "-o", outfile, isobase)
+}
+
+// runGrubTool runs the grub or mtools command, in docker unless withoutDocker is set,
+// moutbase is the directory of all the files accessed by the command.
+func runGrubTool(moutbase string, args ...string) error {
 	var stderr bytes.Buffer
 	if withoutDocker {
-		cmd := exec.Command("grub-mkrescue", "-o", outfile, isobase)
+		cmd := exec.Command(args[0], args[1:]...)
 		cmd.Stderr = &stderr
 		err := cmd.Run()
 		if err != nil {
@@ -148,13 +256,13 @@ func mkiso(outfile, isobase, moutbase string) error {
 		}
 	}
 
-	cmd := exec.Command(
-		"docker", "run", "--rm",
-		"-v", moutbase+":"+moutbase,
+	dockerArgs := []string{
+		"run", "--rm",
+		"-v", moutbase + ":" + moutbase,
 		"-w", moutbase,
 		grubDockerImage,
-		"grub-mkrescue", "-o", outfile, isobase,
-	)
+	}
+	cmd := exec.Command("docker", append(dockerArgs, args...)...)
 	cmd.Stderr = &stderr
 	err = cmd.Run()
 	if err != nil {
@@ -222,9 +330,9 @@ func copyfile(dst, src string) error {
 func init() {
 	rootCmd.AddCommand(packCmd)
 
-	packCmd.Flags().StringVarP(&packFormat, "format", "f", "iso", "package format, values `iso`")
+	packCmd.Flags().StringVarP(&packFormat, "format", "f", "iso", "package format, values `iso` or `efi`")
 	packCmd.Flags().StringVarP(&packKernelFile, "kernel", "k", "", "the kernel file, if empty current package will be built as kernel")
-	packCmd.Flags().StringVarP(&packOutFile, "output", "o", "eggos.iso", "file name of output")
+	packCmd.Flags().StringVarP(&packOutFile, "output", "o", "", "file name of output, default eggos.iso or eggos.img by format")
 	packCmd.Flags().BoolVar(&keepTmpdir, "keep-tmp", false, "keep temp dir, for debugging")
 	packCmd.Flags().BoolVarP(&withoutDocker, "without-docker", "d", false, "using docker for grub tools")
 }
@@ -32,10 +32,16 @@ import (
 
 const (
 	qemu64 = "qemu-system-x86_64"
+
+	// the UEFI firmware installed by the ovmf package of debian and ubuntu
+	defaultOVMF = "/usr/share/ovmf/OVMF.fd"
 )
 
 var (
-	ports []string
+	ports   []string
+	memory  string
+	initrds []string
+	bios    string
 )
 
 // runCmd represents the run command
@@ -86,9 +92,18 @@ func runKernel(args []string) error {
 		loaderFile := filepath.Join(base, "loader.elf")
 		mustLoaderFile(loaderFile)
 		runArgs = append(runArgs, "-kernel", loaderFile)
-		runArgs = append(runArgs, "-initrd", kernelFile)
+		// the loader boots the first module, the others are initrd archives
+		modules := append([]string{kernelFile}, initrds...)
+		runArgs = append(runArgs, "-initrd", strings.Join(modules, ","))
 	case ".iso":
 		runArgs = append(runArgs, "-cdrom", kernelFile)
+	case ".img":
+		// the image packed by `egg pack --format efi`
+		if bios == "" {
+			bios = defaultOVMF
+		}
+		runArgs = append(runArgs, "-bios", bios)
+		runArgs = append(runArgs, "-drive", "format=raw,file="+kernelFile)
 	}
 
 	var qemuArgs []string
@@ -96,7 +111,7 @@ func runKernel(args []string) error {
 		return fmt.Errorf("error parsing QEMU_OPTS: %s", err)
 	}
 
-	runArgs = append(runArgs, "-m", "256M", "-no-reboot", "-serial", "mon:stdio")
+	runArgs = append(runArgs, "-m", memory, "-no-reboot", "-serial", "mon:stdio")
 	runArgs = append(runArgs, "-netdev", "user,id=eth0"+portMapingArgs())
 	runArgs = append(runArgs, "-device", "e1000,netdev=eth0")
 	runArgs = append(runArgs, "-device", "isa-debug-exit")
@@ -158,4 +173,7 @@ func portMapingArgs() string {
 func init() {
 	rootCmd.AddCommand(runCmd)
 	runCmd.Flags().StringSliceVarP(&ports, "port", "p", nil, "port mapping from host to kernel, format $host_port:$kernel_port")
+	runCmd.Flags().StringVarP(&memory, "memory", "m", "256M", "memory size of the virtual machine, eg. 8G")
+	runCmd.Flags().StringVar(&bios, "bios", "", "UEFI firmware to boot .img file, default "+defaultOVMF)
+	runCmd.Flags().StringSliceVar(&initrds, "initrd", nil, "tar or cpio archives mounted as the initial filesystem")
 }
@@ -0,0 +1,189 @@
+// Package acpi finds and parses the ACPI tables provided by the firmware.
+//
+// Init runs before the go runtime, so everything here is nosplit
+// and stores the result in static variables.
+package acpi
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/multiboot"
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+const (
+	// bios read-only memory area to search for RSDP
+	biosAreaStart = 0xe0000
+	biosAreaEnd   = 0x100000
+	// the real mode segment of EBDA stored at bios data area
+	ebdaSegPtr = 0x40e
+
+	maxTables = 64
+)
+
+// rsdp is the Root System Description Pointer
+type rsdp struct {
+	Signature [8]byte
+	Checksum  uint8
+	OEMID     [6]byte
+	Revision  uint8
+	RsdtAddr  uint32
+
+	// acpi 2.0+
+	Length      uint32
+	XsdtAddr    uint64
+	ExtChecksum uint8
+	Reserved    [3]byte
+}
+
+// Header is the common header of all the system description tables.
+type Header struct {
+	Signature       [4]byte
+	Length          uint32
+	Revision        uint8
+	Checksum        uint8
+	OEMID           [6]byte
+	OEMTableID      [8]byte
+	OEMRevision     uint32
+	CreatorID       uint32
+	CreatorRevision uint32
+}
+
+var (
+	enabled bool
+
+	rsdpAddr uintptr
+	tables   [maxTables]*Header
+	ntables  int
+)
+
+// Enabled reports whether the ACPI tables are found.
+//go:nosplit
+func Enabled() bool {
+	return enabled
+}
+
+// RSDP returns the physical address of RSDP, zero if not found.
+//go:nosplit
+func RSDP() uintptr {
+	return rsdpAddr
+}
+
+//go:nosplit
+func checksum(addr, n uintptr) bool {
+	var sum uint8
+	for i := uintptr(0); i < n; i++ {
+		sum += *(*uint8)(unsafe.Pointer(addr + i))
+	}
+	return sum == 0
+}
+
+//go:nosplit
+func sigEqual(addr uintptr, sig string) bool {
+	for i := 0; i < len(sig); i++ {
+		if *(*byte)(unsafe.Pointer(addr + uintptr(i))) != sig[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//go:nosplit
+func scanRSDP(start, end uintptr) uintptr {
+	for p := start; p < end; p += 16 {
+		if sigEqual(p, "RSD PTR ") && checksum(p, 20) {
+			return p
+		}
+	}
+	return 0
+}
+
+//go:nosplit
+func findRSDP() uintptr {
+	// there is no bios area on UEFI machines, use the one passed by multiboot2
+	if p := multiboot.RSDP(); p != 0 && sigEqual(p, "RSD PTR ") {
+		return p
+	}
+	ebda := uintptr(*(*uint16)(unsafe.Pointer(uintptr(ebdaSegPtr)))) << 4
+	if ebda != 0 {
+		if p := scanRSDP(ebda, ebda+1024); p != 0 {
+			return p
+		}
+	}
+	return scanRSDP(biosAreaStart, biosAreaEnd)
+}
+
+// mapTable maps the table at addr and returns it
+//go:nosplit
+func mapTable(addr uintptr) *Header {
+	mm.Physmap(addr, unsafe.Sizeof(Header{}))
+	h := (*Header)(unsafe.Pointer(addr))
+	mm.Physmap(addr, uintptr(h.Length))
+	if !checksum(addr, uintptr(h.Length)) {
+		return nil
+	}
+	return h
+}
+
+//go:nosplit
+func addTable(addr uintptr) {
+	if addr == 0 || ntables >= maxTables {
+		return
+	}
+	h := mapTable(addr)
+	if h == nil {
+		return
+	}
+	tables[ntables] = h
+	ntables++
+}
+
+// FindTable returns the table with the given signature, eg "APIC", "FACP".
+//go:nosplit
+func FindTable(sig string) *Header {
+	for i := 0; i < ntables; i++ {
+		h := tables[i]
+		if sigEqual(uintptr(unsafe.Pointer(&h.Signature[0])), sig) {
+			return h
+		}
+	}
+	return nil
+}
+
+// Init finds RSDP and all the tables listed in RSDT or XSDT,
+// and parses the interrupt controllers and power management registers.
+// It must be called after mm.Init.
+//go:nosplit
+func Init() {
+	rsdpAddr = findRSDP()
+	if rsdpAddr == 0 {
+		return
+	}
+	r := (*rsdp)(unsafe.Pointer(rsdpAddr))
+
+	const hsize = unsafe.Sizeof(Header{})
+	if r.Revision >= 2 && r.XsdtAddr != 0 {
+		xsdt := mapTable(uintptr(r.XsdtAddr))
+		if xsdt != nil {
+			base := uintptr(unsafe.Pointer(xsdt)) + hsize
+			n := (uintptr(xsdt.Length) - hsize) / 8
+			for i := uintptr(0); i < n; i++ {
+				addTable(uintptr(*(*uint64)(unsafe.Pointer(base + i*8))))
+			}
+		}
+	}
+	if ntables == 0 {
+		rsdt := mapTable(uintptr(r.RsdtAddr))
+		if rsdt == nil {
+			return
+		}
+		base := uintptr(unsafe.Pointer(rsdt)) + hsize
+		n := (uintptr(rsdt.Length) - hsize) / 4
+		for i := uintptr(0); i < n; i++ {
+			addTable(uintptr(*(*uint32)(unsafe.Pointer(base + i*4))))
+		}
+	}
+	enabled = true
+	parseMADT()
+	parseFADT()
+}
@@ -0,0 +1,249 @@
+package acpi
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+// the offsets of FADT fields, some of them are not aligned
+const (
+	fadtDSDT        = 40
+	fadtSMICmd      = 48
+	fadtACPIEnable  = 52
+	fadtPM1aCntBlk  = 64
+	fadtPM1bCntBlk  = 68
+	fadtFlags       = 112
+	fadtResetReg    = 116
+	fadtResetValue  = 128
+	fadtXDSDT       = 140
+	fadtXDSDTEnd    = 148
+	fadtResetRegEnd = 129
+	// the generic address structures of PM1 control blocks, acpi 2.0+
+	fadtXPM1aCntBlk    = 172
+	fadtXPM1bCntBlk    = 184
+	fadtXPM1bCntBlkEnd = 196
+
+	// the reset register is supported
+	fadtFlagResetReg = 1 << 10
+)
+
+// the address spaces of generic address structure
+const (
+	gasSystemMemory = 0
+	gasSystemIO     = 1
+	gasPCIConfig    = 2
+)
+
+const (
+	pm1SCIEnable   = 1 << 0
+	pm1SleepType   = 7 << 10
+	pm1SleepEnable = 1 << 13
+
+	amlNameOp    = 0x08
+	amlPackageOp = 0x12
+	amlZeroOp    = 0x00
+	amlOneOp     = 0x01
+	amlByteOp    = 0x0a
+	amlWordOp    = 0x0b
+	amlRootChar  = '\\'
+
+	pciConfigAddr = 0xcf8
+	pciConfigData = 0xcfc
+)
+
+// powerInfo holds the registers to power off and reset the machine
+type powerInfo struct {
+	smiCmd     uint16
+	acpiEnable uint8
+
+	pm1aCnt, pm1bCnt uint16
+	// the SLP_TYP values of S5 state, found in DSDT
+	slpTypA, slpTypB uint16
+	s5               bool
+
+	resetSpace uint8
+	resetAddr  uintptr
+	resetValue uint8
+	reset      bool
+}
+
+var power powerInfo
+
+//go:nosplit
+func u8at(p uintptr) uint8 {
+	return *(*uint8)(unsafe.Pointer(p))
+}
+
+//go:nosplit
+func u16at(p uintptr) uint16 {
+	return *(*uint16)(unsafe.Pointer(p))
+}
+
+//go:nosplit
+func u32at(p uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(p))
+}
+
+//go:nosplit
+func u64at(p uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(p))
+}
+
+//go:nosplit
+func parseFADT() {
+	h := FindTable("FACP")
+	if h == nil {
+		return
+	}
+	f := uintptr(unsafe.Pointer(h))
+	power.smiCmd = uint16(u32at(f + fadtSMICmd))
+	power.acpiEnable = u8at(f + fadtACPIEnable)
+	power.pm1aCnt = uint16(u32at(f + fadtPM1aCntBlk))
+	power.pm1bCnt = uint16(u32at(f + fadtPM1bCntBlk))
+	if h.Length >= fadtXPM1bCntBlkEnd {
+		power.pm1aCnt = gasPort(f+fadtXPM1aCntBlk, power.pm1aCnt)
+		power.pm1bCnt = gasPort(f+fadtXPM1bCntBlk, power.pm1bCnt)
+	}
+
+	if h.Length >= fadtResetRegEnd && u32at(f+fadtFlags)&fadtFlagResetReg != 0 {
+		power.resetSpace = u8at(f + fadtResetReg)
+		power.resetAddr = uintptr(u64at(f + fadtResetReg + 4))
+		power.resetValue = u8at(f + fadtResetValue)
+		power.reset = power.resetAddr != 0
+		if power.reset && power.resetSpace == gasSystemMemory {
+			mm.Physmap(power.resetAddr, 1)
+		}
+	}
+
+	dsdt := uintptr(u32at(f + fadtDSDT))
+	if h.Length >= fadtXDSDTEnd && u64at(f+fadtXDSDT) != 0 {
+		dsdt = uintptr(u64at(f + fadtXDSDT))
+	}
+	if dsdt != 0 {
+		if t := mapTable(dsdt); t != nil {
+			parseS5(t)
+		}
+	}
+}
+
+// gasPort returns the I/O port of generic address structure at p,
+// or the legacy port if the address is zero or not in I/O space.
+//go:nosplit
+func gasPort(p uintptr, legacy uint16) uint16 {
+	addr := u64at(p + 4)
+	if addr == 0 || u8at(p) != gasSystemIO {
+		return legacy
+	}
+	return uint16(addr)
+}
+
+// parseS5 finds the SLP_TYP values in the \_S5 object of DSDT,
+// which is defined as Name(_S5, Package(){SLP_TYPa, SLP_TYPb, ...})
+//go:nosplit
+func parseS5(dsdt *Header) {
+	start := uintptr(unsafe.Pointer(dsdt)) + unsafe.Sizeof(Header{})
+	end := uintptr(unsafe.Pointer(dsdt)) + uintptr(dsdt.Length)
+	for p := start + 2; p+8 < end; p++ {
+		if !sigEqual(p, "_S5_") {
+			continue
+		}
+		if u8at(p-1) != amlNameOp && !(u8at(p-2) == amlNameOp && u8at(p-1) == amlRootChar) {
+			continue
+		}
+		q := p + 4
+		if u8at(q) != amlPackageOp {
+			continue
+		}
+		// the top two bits of PkgLength are the number of following bytes
+		q++
+		q += 1 + uintptr(u8at(q)>>6)
+		// skip NumElements
+		q++
+		power.slpTypA, q = amlInteger(q)
+		power.slpTypB, _ = amlInteger(q)
+		power.s5 = true
+		return
+	}
+}
+
+// amlInteger decodes the integer at p, returns the value and the next position
+//go:nosplit
+func amlInteger(p uintptr) (uint16, uintptr) {
+	switch u8at(p) {
+	case amlZeroOp:
+		return 0, p + 1
+	case amlOneOp:
+		return 1, p + 1
+	case amlByteOp:
+		return uint16(u8at(p + 1)), p + 2
+	case amlWordOp:
+		return u16at(p + 1), p + 3
+	default:
+		return uint16(u8at(p)), p + 1
+	}
+}
+
+// enableACPI switches the machine to ACPI mode if it's in legacy mode
+//go:nosplit
+func enableACPI() {
+	if sys.Inw(power.pm1aCnt)&pm1SCIEnable != 0 {
+		return
+	}
+	if power.smiCmd == 0 || power.acpiEnable == 0 {
+		return
+	}
+	sys.Outb(power.smiCmd, power.acpiEnable)
+	for i := 0; i < 1000000 && sys.Inw(power.pm1aCnt)&pm1SCIEnable == 0; i++ {
+		sys.Pause()
+	}
+}
+
+//go:nosplit
+func enterSleep(port, typ uint16) {
+	v := sys.Inw(port) &^ (pm1SleepType | pm1SleepEnable)
+	sys.Outw(port, v|typ<<10|pm1SleepEnable)
+}
+
+// Poweroff enters the S5 sleep state, it returns if ACPI or \_S5 is not available.
+//go:nosplit
+func Poweroff() {
+	if !power.s5 || power.pm1aCnt == 0 {
+		return
+	}
+	enableACPI()
+	enterSleep(power.pm1aCnt, power.slpTypA)
+	if power.pm1bCnt != 0 {
+		enterSleep(power.pm1bCnt, power.slpTypB)
+	}
+	// wait the power off to take effect
+	for i := 0; i < 1000000; i++ {
+		sys.Pause()
+	}
+}
+
+// Reset resets the machine by the reset register of FADT,
+// it returns if the register is not supported.
+//go:nosplit
+func Reset() {
+	if !power.reset {
+		return
+	}
+	switch power.resetSpace {
+	case gasSystemIO:
+		sys.Outb(uint16(power.resetAddr), power.resetValue)
+	case gasSystemMemory:
+		*(*uint8)(unsafe.Pointer(power.resetAddr)) = power.resetValue
+	case gasPCIConfig:
+		// the address is device<<32 | function<<16 | offset on bus 0
+		dev := uint32(power.resetAddr>>32) & 0x1f
+		fn := uint32(power.resetAddr>>16) & 0x7
+		off := uint32(power.resetAddr) & 0xff
+		sys.Outl(pciConfigAddr, 1<<31|dev<<11|fn<<8|off&^3)
+		sys.Outb(pciConfigData+uint16(off&3), power.resetValue)
+	}
+	for i := 0; i < 1000000; i++ {
+		sys.Pause()
+	}
+}
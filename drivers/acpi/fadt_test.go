@@ -0,0 +1,73 @@
+package acpi
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestAmlInteger(t *testing.T) {
+	cases := []struct {
+		aml  string
+		val  uint16
+		next uintptr
+	}{
+		{"\x00", 0, 1},
+		{"\x01", 1, 1},
+		{"\x0a\x05", 5, 2},
+		{"\x0b\x34\x12", 0x1234, 3},
+		// the raw byte of some old firmwares
+		{"\x07", 7, 1},
+	}
+	for _, c := range cases {
+		b := []byte(c.aml + "\x00\x00\x00")
+		p := uintptr(unsafe.Pointer(&b[0]))
+		val, next := amlInteger(p)
+		if val != c.val || next-p != c.next {
+			t.Fatalf("%q: expect %d at %d, got %d at %d", c.aml, c.val, c.next, val, next-p)
+		}
+	}
+}
+
+// mkDSDT returns the DSDT with aml as its body
+func mkDSDT(aml string) *Header {
+	hdr := int(unsafe.Sizeof(Header{}))
+	buf := make([]uint64, (hdr+len(aml)+7)/8)
+	b := (*[1 << 16]byte)(unsafe.Pointer(&buf[0]))[: hdr+len(aml) : hdr+len(aml)]
+	copy(b[hdr:], aml)
+	h := (*Header)(unsafe.Pointer(&buf[0]))
+	h.Signature = [4]byte{'D', 'S', 'D', 'T'}
+	h.Length = uint32(len(b))
+	return h
+}
+
+func TestParseS5(t *testing.T) {
+	// the aml is padded since parseS5 stops 8 bytes before the end of table
+	const pad = "\x00\x00\x00\x00\x00\x00\x00\x00"
+	cases := []struct {
+		name       string
+		aml        string
+		s5         bool
+		typA, typB uint16
+	}{
+		// Name (_S5, Package (0x04) {0x05, 0x05, Zero, Zero})
+		{"byte", "\x10\x00\x08_S5_\x12\x0a\x04\x0a\x05\x0a\x05\x00\x00" + pad, true, 5, 5},
+		// Name (\_S5, Package (0x02) {Zero, One})
+		{"root", "\x10\x00\x08\\_S5_\x12\x05\x02\x00\x01" + pad, true, 0, 1},
+		// the PkgLength is encoded in two bytes
+		{"pkglen", "\x10\x00\x08_S5_\x12\x46\x00\x02\x0b\x00\x1c\x07" + pad, true, 0x1c00, 7},
+		// the raw bytes of some old firmwares
+		{"raw", "\x10\x00\x08_S5_\x12\x06\x04\x07\x07\x00\x00" + pad, true, 7, 7},
+		// the references of _S5_ are skipped
+		{"ref", "\x10\x00\x70_S5_\x60\x08_S5_\x12\x06\x04\x0a\x03\x0a\x04" + pad, true, 3, 4},
+		{"notpkg", "\x10\x00\x08_S5_\x0a\x05" + pad, false, 0, 0},
+		{"none", "\x10\x00\x08_S4_\x12\x06\x04\x0a\x05\x0a\x05" + pad, false, 0, 0},
+	}
+	for _, c := range cases {
+		power = powerInfo{}
+		parseS5(mkDSDT(c.aml))
+		if power.s5 != c.s5 || power.slpTypA != c.typA || power.slpTypB != c.typB {
+			t.Fatalf("%s: expect %v %d %d, got %v %d %d", c.name,
+				c.s5, c.typA, c.typB, power.s5, power.slpTypA, power.slpTypB)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package acpi
+
+import "unsafe"
+
+type hpetTable struct {
+	Header
+	EventTimerBlockID uint32
+	// generic address structure of the base address
+	AddressSpace uint8
+	BitWidth     uint8
+	BitOffset    uint8
+	AccessSize   uint8
+	Address      uint64
+}
+
+// HPETAddr returns the base address of the first HPET, zero if not found.
+//go:nosplit
+func HPETAddr() uintptr {
+	h := FindTable("HPET")
+	if h == nil {
+		return 0
+	}
+	t := (*hpetTable)(unsafe.Pointer(h))
+	// only system memory space is supported
+	if t.AddressSpace != 0 {
+		return 0
+	}
+	return uintptr(t.Address)
+}
@@ -0,0 +1,112 @@
+package acpi
+
+import "unsafe"
+
+const (
+	// MaxCPU is the max number of processors we record from MADT
+	MaxCPU = 16
+
+	maxIOAPIC   = 4
+	maxOverride = 16
+
+	madtLocalAPIC        = 0
+	madtIOAPIC           = 1
+	madtOverride         = 2
+	madtLocalAPICAddress = 5
+
+	lapicEnabled         = 1 << 0
+	lapicOnlineCapable   = 1 << 1
+	defaultLocalAPICAddr = 0xfee00000
+)
+
+// IOAPIC describes an I/O APIC found in MADT
+type IOAPIC struct {
+	ID      uint8
+	Addr    uintptr
+	GSIBase uint32
+}
+
+// Override describes how an ISA irq is mapped to a global system interrupt
+type Override struct {
+	Source uint8
+	GSI    uint32
+	Flags  uint16
+}
+
+type madt struct {
+	Header
+	LocalAPICAddr uint32
+	Flags         uint32
+}
+
+// MADTInfo holds the interrupt controller information of the machine
+type MADTInfo struct {
+	LocalAPICAddr uintptr
+
+	// local apic id of processors
+	CPUs [MaxCPU]uint8
+	NCPU int
+
+	IOAPICs [maxIOAPIC]IOAPIC
+	NIOAPIC int
+
+	Overrides [maxOverride]Override
+	NOverride int
+}
+
+var (
+	// MADT stores the parsed result of the Multiple APIC Description Table
+	MADT = MADTInfo{
+		LocalAPICAddr: defaultLocalAPICAddr,
+	}
+)
+
+//go:nosplit
+func parseMADT() {
+	h := FindTable("APIC")
+	if h == nil {
+		return
+	}
+	m := (*madt)(unsafe.Pointer(h))
+	MADT.LocalAPICAddr = uintptr(m.LocalAPICAddr)
+
+	p := uintptr(unsafe.Pointer(m)) + unsafe.Sizeof(madt{})
+	end := uintptr(unsafe.Pointer(m)) + uintptr(m.Length)
+	for p+2 <= end {
+		typ := *(*uint8)(unsafe.Pointer(p))
+		length := uintptr(*(*uint8)(unsafe.Pointer(p + 1)))
+		if length < 2 {
+			break
+		}
+		switch typ {
+		case madtLocalAPIC:
+			flags := *(*uint32)(unsafe.Pointer(p + 4))
+			if flags&(lapicEnabled|lapicOnlineCapable) == 0 {
+				break
+			}
+			if MADT.NCPU < MaxCPU {
+				MADT.CPUs[MADT.NCPU] = *(*uint8)(unsafe.Pointer(p + 3))
+				MADT.NCPU++
+			}
+		case madtIOAPIC:
+			if MADT.NIOAPIC < maxIOAPIC {
+				io := &MADT.IOAPICs[MADT.NIOAPIC]
+				io.ID = *(*uint8)(unsafe.Pointer(p + 2))
+				io.Addr = uintptr(*(*uint32)(unsafe.Pointer(p + 4)))
+				io.GSIBase = *(*uint32)(unsafe.Pointer(p + 8))
+				MADT.NIOAPIC++
+			}
+		case madtOverride:
+			if MADT.NOverride < maxOverride {
+				o := &MADT.Overrides[MADT.NOverride]
+				o.Source = *(*uint8)(unsafe.Pointer(p + 3))
+				o.GSI = *(*uint32)(unsafe.Pointer(p + 4))
+				o.Flags = *(*uint16)(unsafe.Pointer(p + 8))
+				MADT.NOverride++
+			}
+		case madtLocalAPICAddress:
+			MADT.LocalAPICAddr = uintptr(*(*uint64)(unsafe.Pointer(p + 4)))
+		}
+		p += length
+	}
+}
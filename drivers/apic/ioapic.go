@@ -0,0 +1,191 @@
+package apic
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/acpi"
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+const (
+	ioregsel = 0x00
+	iowin    = 0x10
+
+	ioapicVersion = 0x01
+	ioapicRedtbl  = 0x10
+
+	redNMI         = 4 << 8
+	redMasked      = 1 << 16
+	redLevel       = 1 << 15
+	redActiveLow   = 1 << 13
+	maxIOAPICCount = 4
+)
+
+// Polarity and trigger mode of an interrupt source
+const (
+	TriggerEdge  = 0
+	TriggerLevel = 1
+
+	PolarityHigh = 0
+	PolarityLow  = 1
+)
+
+type ioapic struct {
+	base    uintptr
+	gsiBase uint32
+	// number of redirection entries
+	count uint32
+}
+
+var (
+	ioapics  [maxIOAPICCount]ioapic
+	nioapics int
+)
+
+//go:nosplit
+func (io *ioapic) read(reg uint32) uint32 {
+	*(*uint32)(unsafe.Pointer(io.base + ioregsel)) = reg
+	return *(*uint32)(unsafe.Pointer(io.base + iowin))
+}
+
+//go:nosplit
+func (io *ioapic) write(reg, val uint32) {
+	*(*uint32)(unsafe.Pointer(io.base + ioregsel)) = reg
+	*(*uint32)(unsafe.Pointer(io.base + iowin)) = val
+}
+
+//go:nosplit
+func findIOAPIC(gsi uint32) *ioapic {
+	for i := 0; i < nioapics; i++ {
+		io := &ioapics[i]
+		if gsi >= io.gsiBase && gsi < io.gsiBase+io.count {
+			return io
+		}
+	}
+	return nil
+}
+
+// IOAPICInit maps all the I/O APICs found in MADT and masks all their entries,
+// returns false if no I/O APIC found.
+//go:nosplit
+func IOAPICInit() bool {
+	for i := 0; i < acpi.MADT.NIOAPIC && nioapics < maxIOAPICCount; i++ {
+		info := &acpi.MADT.IOAPICs[i]
+		mm.Physmap(info.Addr, mm.PGSIZE)
+		io := &ioapics[nioapics]
+		io.base = info.Addr
+		io.gsiBase = info.GSIBase
+		io.count = (io.read(ioapicVersion)>>16)&0xff + 1
+		for j := uint32(0); j < io.count; j++ {
+			io.write(ioapicRedtbl+2*j, redMasked)
+			io.write(ioapicRedtbl+2*j+1, 0)
+		}
+		nioapics++
+	}
+	return nioapics != 0
+}
+
+// ISAIRQ translates the isa irq line to global system interrupt,
+// according to the interrupt source overrides of MADT.
+//go:nosplit
+func ISAIRQ(line uint8) (gsi uint32, trigger, polarity int) {
+	return overrideIRQ(line, TriggerEdge, PolarityHigh)
+}
+
+// PCIIRQ translates the legacy pci irq line to global system interrupt.
+// The line is the isa irq that the chipset routes INTx to in PIC mode,
+// so the overrides of MADT apply, the default is level triggered and active low.
+//go:nosplit
+func PCIIRQ(line uint8) (gsi uint32, trigger, polarity int) {
+	return overrideIRQ(line, TriggerLevel, PolarityLow)
+}
+
+// overrideIRQ applies the interrupt source override of line, the trigger mode
+// and polarity conforming to the bus are left as given.
+//go:nosplit
+func overrideIRQ(line uint8, trigger0, polarity0 int) (gsi uint32, trigger, polarity int) {
+	gsi, trigger, polarity = uint32(line), trigger0, polarity0
+	for i := 0; i < acpi.MADT.NOverride; i++ {
+		o := &acpi.MADT.Overrides[i]
+		if o.Source != line {
+			continue
+		}
+		gsi = o.GSI
+		switch o.Flags & 0x3 {
+		case 0x1:
+			polarity = PolarityHigh
+		case 0x3:
+			polarity = PolarityLow
+		}
+		switch (o.Flags >> 2) & 0x3 {
+		case 0x1:
+			trigger = TriggerEdge
+		case 0x3:
+			trigger = TriggerLevel
+		}
+		break
+	}
+	return
+}
+
+// IOAPICRoute routes the global system interrupt to vector on the processor of dest,
+// the entry is left masked.
+//go:nosplit
+func IOAPICRoute(gsi uint32, vector uint8, dest uint8, trigger, polarity int) bool {
+	lo := uint32(vector)
+	if trigger == TriggerLevel {
+		lo |= redLevel
+	}
+	return ioapicRoute(gsi, lo, dest, polarity)
+}
+
+// IOAPICRouteNMI routes the global system interrupt to the NMI of the processor of dest,
+// which is always edge triggered, the entry is left masked.
+//go:nosplit
+func IOAPICRouteNMI(gsi uint32, dest uint8, polarity int) bool {
+	return ioapicRoute(gsi, redNMI, dest, polarity)
+}
+
+//go:nosplit
+func ioapicRoute(gsi uint32, lo uint32, dest uint8, polarity int) bool {
+	io := findIOAPIC(gsi)
+	if io == nil {
+		return false
+	}
+	idx := gsi - io.gsiBase
+	lo |= redMasked
+	if polarity == PolarityLow {
+		lo |= redActiveLow
+	}
+	io.write(ioapicRedtbl+2*idx+1, uint32(dest)<<24)
+	io.write(ioapicRedtbl+2*idx, lo)
+	return true
+}
+
+//go:nosplit
+func ioapicSetMask(gsi uint32, masked bool) {
+	io := findIOAPIC(gsi)
+	if io == nil {
+		return
+	}
+	reg := ioapicRedtbl + 2*(gsi-io.gsiBase)
+	lo := io.read(reg)
+	if masked {
+		lo |= redMasked
+	} else {
+		lo &^= redMasked
+	}
+	io.write(reg, lo)
+}
+
+// IOAPICMask masks the global system interrupt
+//go:nosplit
+func IOAPICMask(gsi uint32) {
+	ioapicSetMask(gsi, true)
+}
+
+// IOAPICUnmask unmasks the global system interrupt
+//go:nosplit
+func IOAPICUnmask(gsi uint32) {
+	ioapicSetMask(gsi, false)
+}
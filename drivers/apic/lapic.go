@@ -0,0 +1,200 @@
+// Package apic drives the local APIC of each processor.
+package apic
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+const (
+	// vectors handled by local apic, above all the external irqs
+	VECTOR_TIMER    = 0xf0
+	VECTOR_RESCHED  = 0xf1
+	VECTOR_TLB      = 0xf2
+	VECTOR_SPURIOUS = 0xff
+)
+
+const (
+	regID       = 0x020
+	regVersion  = 0x030
+	regTPR      = 0x080
+	regEOI      = 0x0b0
+	regSVR      = 0x0f0
+	regESR      = 0x280
+	regICRLow   = 0x300
+	regICRHigh  = 0x310
+	regTimer    = 0x320
+	regLINT0    = 0x350
+	regLINT1    = 0x360
+	regError    = 0x370
+	regInitCnt  = 0x380
+	regCurCnt   = 0x390
+	regTimerDiv = 0x3e0
+
+	svrEnable = 0x100
+
+	lvtMasked   = 1 << 16
+	lvtPeriodic = 1 << 17
+	lvtDeadline = 2 << 17
+	lvtExtINT   = 0x700
+	lvtNMI      = 0x400
+
+	icrNMI        = 0x400
+	icrInit       = 0x500
+	icrStartup    = 0x600
+	icrDelivs     = 1 << 12
+	icrAssert     = 1 << 14
+	icrLevel      = 1 << 15
+	icrAllButSelf = 3 << 18
+
+	// divide by 16
+	timerDiv16 = 0x3
+)
+
+var (
+	base uintptr
+)
+
+//go:nosplit
+func read(reg uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(base + reg))
+}
+
+//go:nosplit
+func write(reg uintptr, val uint32) {
+	*(*uint32)(unsafe.Pointer(base + reg)) = val
+	// wait for write to finish, by reading
+	read(regID)
+}
+
+// Enabled reports whether the local apic is initialized
+//go:nosplit
+func Enabled() bool {
+	return base != 0
+}
+
+// Init maps the local apic registers at addr and enables the apic of the current cpu.
+// The bootstrap processor keeps LINT0 as ExtINT to receive 8259 interrupts,
+// others mask it.
+//go:nosplit
+func Init(addr uintptr, bsp bool) {
+	if base == 0 {
+		mm.Physmap(addr, mm.PGSIZE)
+		base = addr
+	}
+	write(regSVR, svrEnable|VECTOR_SPURIOUS)
+
+	write(regTimer, lvtMasked)
+	if bsp {
+		write(regLINT0, lvtExtINT)
+	} else {
+		write(regLINT0, lvtMasked)
+	}
+	write(regLINT1, lvtNMI)
+	write(regError, lvtMasked)
+
+	// clear error status register, requires back-to-back writes
+	write(regESR, 0)
+	write(regESR, 0)
+
+	EOI()
+	// accept all interrupts
+	write(regTPR, 0)
+}
+
+// DisableExtINT masks LINT0 of current cpu, used when
+// the 8259 PIC is replaced by I/O APIC.
+//go:nosplit
+func DisableExtINT() {
+	write(regLINT0, lvtMasked)
+}
+
+// ID returns the local apic id of current cpu
+//go:nosplit
+func ID() uint8 {
+	return uint8(read(regID) >> 24)
+}
+
+// EOI signals end of interrupt to local apic
+//go:nosplit
+func EOI() {
+	write(regEOI, 0)
+}
+
+//go:nosplit
+func waitICR() {
+	for read(regICRLow)&icrDelivs != 0 {
+	}
+}
+
+//go:nosplit
+func sendICR(apicid uint8, cmd uint32) {
+	write(regICRHigh, uint32(apicid)<<24)
+	write(regICRLow, cmd)
+	waitICR()
+}
+
+// SendInit sends INIT IPI to the processor, must be called with interrupt disabled.
+//go:nosplit
+func SendInit(apicid uint8) {
+	sendICR(apicid, icrInit|icrLevel|icrAssert)
+	sendICR(apicid, icrInit|icrLevel)
+}
+
+// SendStartup sends STARTUP IPI to the processor, the processor
+// will begin to execute at real mode address addr, which must be page aligned below 1M.
+// Must be called with interrupt disabled.
+//go:nosplit
+func SendStartup(apicid uint8, addr uintptr) {
+	sendICR(apicid, icrStartup|uint32(addr>>12))
+}
+
+// SendIPI sends a fixed interrupt to the processor, must be called with interrupt disabled.
+//go:nosplit
+func SendIPI(apicid uint8, vector uint8) {
+	sendICR(apicid, uint32(vector))
+}
+
+// SendNMI sends a non maskable interrupt to the processor, it can be called in NMI handler,
+// the destination of the IPI being sent by the interrupted code is kept.
+//go:nosplit
+func SendNMI(apicid uint8) {
+	hi := read(regICRHigh)
+	waitICR()
+	sendICR(apicid, icrNMI)
+	write(regICRHigh, hi)
+}
+
+// TimerStart starts the local apic timer with divider 16
+// periodic or one shot, count is in the unit of timer ticks.
+//go:nosplit
+func TimerStart(vector uint8, count uint32, periodic bool) {
+	write(regTimerDiv, timerDiv16)
+	lvt := uint32(vector)
+	if periodic {
+		lvt |= lvtPeriodic
+	}
+	write(regTimer, lvt)
+	write(regInitCnt, count)
+}
+
+// TimerDeadlineMode switches the local apic timer to TSC-deadline mode,
+// the timer is armed by writing the IA32_TSC_DEADLINE msr.
+//go:nosplit
+func TimerDeadlineMode(vector uint8) {
+	write(regTimer, uint32(vector)|lvtDeadline)
+}
+
+// TimerStop masks the local apic timer
+//go:nosplit
+func TimerStop() {
+	write(regInitCnt, 0)
+	write(regTimer, lvtMasked)
+}
+
+// TimerCurrent returns the current count of local apic timer
+//go:nosplit
+func TimerCurrent() uint32 {
+	return read(regCurCnt)
+}
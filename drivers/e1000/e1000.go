@@ -6,8 +6,8 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/drivers/pci"
-	"github.com/icexin/eggos/drivers/pic"
 	"github.com/icexin/eggos/inet"
 	"github.com/icexin/eggos/kernel/mm"
 	"github.com/icexin/eggos/kernel/sys"
@@ -176,15 +176,15 @@ func (d *driver) Init(dev *pci.Device) error {
 	// Initialize RX queue.
 	for i := 0; i < NUM_RX_DESCS; i++ {
 		desc := &d.rxdescs[i]
-		desc.paddr = uint64(mm.Alloc())
+		desc.paddr = uint64(mm.V2P(mm.Alloc()))
 	}
 
-	rxDescAddr := uintptr(unsafe.Pointer(&d.rxdescs[0]))
-	if rxDescAddr&0xfffffff0 != rxDescAddr {
+	rxDescAddr := mm.V2P(uintptr(unsafe.Pointer(&d.rxdescs[0])))
+	if rxDescAddr&^0xf != rxDescAddr {
 		panic("addr of rx desc must be 16 byte align")
 	}
-	d.writecmd(REG_RDBAL, uint32(rxDescAddr&0xfffffff0))
-	d.writecmd(REG_RDBAH, 0)
+	d.writecmd(REG_RDBAL, uint32(rxDescAddr))
+	d.writecmd(REG_RDBAH, uint32(rxDescAddr>>32))
 	d.writecmd(REG_RDLEN, uint32(unsafe.Sizeof(*d.rxdescs)))
 	d.writecmd(REG_RDH, 0)
 	d.writecmd(REG_RDT, NUM_RX_DESCS-1)
@@ -193,15 +193,15 @@ func (d *driver) Init(dev *pci.Device) error {
 	// Initialize TX queue.
 	for i := 0; i < NUM_TX_DESCS; i++ {
 		desc := &d.txdescs[i]
-		desc.paddr = uint64(mm.Alloc())
+		desc.paddr = uint64(mm.V2P(mm.Alloc()))
 		desc.status = 1
 	}
-	txDescAddr := uintptr(unsafe.Pointer(&d.txdescs[0]))
-	if txDescAddr&0xfffffff0 != txDescAddr {
+	txDescAddr := mm.V2P(uintptr(unsafe.Pointer(&d.txdescs[0])))
+	if txDescAddr&^0xf != txDescAddr {
 		panic("addr of tx desc must be 16 byte align")
 	}
-	d.writecmd(REG_TDBAL, uint32(txDescAddr&0xffffffff))
-	d.writecmd(REG_TDBAH, 0)
+	d.writecmd(REG_TDBAL, uint32(txDescAddr))
+	d.writecmd(REG_TDBAH, uint32(txDescAddr>>32))
 	d.writecmd(REG_TDLEN, uint32(unsafe.Sizeof(*d.txdescs)))
 	d.writecmd(REG_TDH, 0)
 	d.writecmd(REG_TDT, 0)
@@ -226,7 +226,7 @@ func (d *driver) Transmit(pkt *stack.PacketBuffer) error {
 		return errors.New("tx queue full")
 	}
 
-	txbuf := sys.UnsafeBuffer(uintptr(desc.paddr), mm.PGSIZE)
+	txbuf := sys.UnsafeBuffer(mm.P2V(uintptr(desc.paddr)), mm.PGSIZE)
 
 	r := buffer.NewVectorisedView(pkt.Size(), pkt.Views())
 	pktlen, _ := r.Read(txbuf)
@@ -249,8 +249,7 @@ func (d *driver) Transmit(pkt *stack.PacketBuffer) error {
 }
 
 func (d *driver) Intr() {
-	defer pic.EnableIRQ(uint16(d.dev.IRQLine))
-	defer pic.EOI(uintptr(d.dev.IRQNO))
+	defer irq.EOI(uintptr(d.dev.IRQNO))
 	cause := d.readcmd(REG_ICR)
 	// log.Infof("[e1000] cause %x", cause)
 	// clear ICR register
@@ -290,7 +289,7 @@ func (d *driver) readpkt() bool {
 		return false
 	}
 
-	buf := sys.UnsafeBuffer(uintptr(desc.paddr), int(desc.len))
+	buf := sys.UnsafeBuffer(mm.P2V(uintptr(desc.paddr)), int(desc.len))
 	// log.Infof("[e1000] read %d bytes", desc.len)
 	if d.rxfunc != nil {
 		d.rxfunc(buf)
@@ -0,0 +1,74 @@
+// Package hpet drives the main counter of High Precision Event Timer.
+package hpet
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/acpi"
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+const (
+	regCap     = 0x000
+	regConfig  = 0x010
+	regCounter = 0x0f0
+
+	capCounter64 = 1 << 13
+	cfgEnable    = 1 << 0
+
+	femtosecond = 1000000000000000
+)
+
+var (
+	base uintptr
+	freq uint64
+)
+
+//go:nosplit
+func read(reg uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(base + reg))
+}
+
+//go:nosplit
+func write(reg uintptr, val uint64) {
+	*(*uint64)(unsafe.Pointer(base + reg)) = val
+}
+
+// Init enables the main counter of HPET found in ACPI tables,
+// only 64 bits counter is supported, returns false if not found.
+//go:nosplit
+func Init() bool {
+	addr := acpi.HPETAddr()
+	if addr == 0 {
+		return false
+	}
+	mm.Physmap(addr, mm.PGSIZE)
+	base = addr
+	caps := read(regCap)
+	period := caps >> 32
+	if caps&capCounter64 == 0 || period == 0 {
+		base = 0
+		return false
+	}
+	freq = femtosecond / period
+	write(regConfig, read(regConfig)|cfgEnable)
+	return true
+}
+
+// Enabled reports whether the HPET is initialized
+//go:nosplit
+func Enabled() bool {
+	return base != 0
+}
+
+// Counter returns the main counter
+//go:nosplit
+func Counter() uint64 {
+	return read(regCounter)
+}
+
+// Freq returns the frequency of main counter in HZ
+//go:nosplit
+func Freq() uint64 {
+	return freq
+}
@@ -0,0 +1,205 @@
+// Package irq is the interrupt controller layer used by drivers.
+//
+// External interrupts are delivered by the I/O APIC and the local APIC,
+// or the legacy 8259 PIC when no I/O APIC is found.
+// Device interrupts are handled asynchronously by the trap thread, so the kernel
+// acknowledges them by Ack on arrival, and the driver calls EOI when the handler is done.
+package irq
+
+import (
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/drivers/pic"
+)
+
+const (
+	// IRQ_BASE is the vector of the first isa irq line
+	IRQ_BASE = pic.IRQ_BASE
+
+	LINE_TIMER = pic.LINE_TIMER
+	LINE_KBD   = pic.LINE_KBD
+	LINE_COM1  = pic.LINE_COM1
+	LINE_COM2  = pic.LINE_COM2
+	LINE_MOUSE = pic.LINE_MOUSE
+
+	// vectors of isa irq lines are IRQ_BASE+line
+	isaLines = 16
+	// vectors allocated for MSI, the trap thread records pending irqs
+	// in a word bitmap, so all the device vectors must be below IRQ_BASE+64.
+	vectorDynBase = IRQ_BASE + isaLines
+	vectorEnd     = IRQ_BASE + 64
+)
+
+type source struct {
+	gsi   uint32
+	level bool
+	// routed by I/O APIC
+	ioapic bool
+}
+
+var (
+	useAPIC bool
+	// the local apic id of the processor receiving all the device irqs
+	dest uint8
+
+	sources [vectorEnd]source
+	// the allocated MSI vectors, bit i is vector IRQ_BASE+i
+	msiVecs uint64
+)
+
+// Init disables the 8259 PIC and switches to I/O APIC if present.
+// It must be called after the local apic of bootstrap processor is enabled.
+//go:nosplit
+func Init() {
+	pic.Init()
+	if !apic.Enabled() || !apic.IOAPICInit() {
+		return
+	}
+	pic.Disable()
+	apic.DisableExtINT()
+	dest = apic.ID()
+	useAPIC = true
+}
+
+// APICEnabled reports whether the irqs are delivered by I/O APIC
+//go:nosplit
+func APICEnabled() bool {
+	return useAPIC
+}
+
+// IsDevice reports whether the vector belongs to a device irq
+// other than the timer.
+//go:nosplit
+func IsDevice(vector uintptr) bool {
+	return vector > IRQ_BASE+LINE_TIMER && vector < vectorEnd
+}
+
+//go:nosplit
+func enable(line uint16, gsi uint32, trigger, polarity int) {
+	vector := IRQ_BASE + uintptr(line)
+	s := &sources[vector]
+	s.gsi = gsi
+	s.level = trigger == apic.TriggerLevel
+	if !useAPIC {
+		pic.EnableIRQ(line)
+		return
+	}
+	s.ioapic = apic.IOAPICRoute(gsi, uint8(vector), dest, trigger, polarity)
+	if s.ioapic {
+		apic.IOAPICUnmask(gsi)
+	}
+}
+
+// EnableIRQ enables the isa irq line, which is delivered to vector IRQ_BASE+line
+//go:nosplit
+func EnableIRQ(line uint16) {
+	gsi, trigger, polarity := apic.ISAIRQ(uint8(line))
+	enable(line, gsi, trigger, polarity)
+}
+
+// EnableNMI routes the isa irq line to the NMI of the processor receiving device irqs,
+// it returns false if the irqs are not delivered by I/O APIC.
+//go:nosplit
+func EnableNMI(line uint16) bool {
+	if !useAPIC {
+		return false
+	}
+	gsi, _, polarity := apic.ISAIRQ(uint8(line))
+	if !apic.IOAPICRouteNMI(gsi, dest, polarity) {
+		return false
+	}
+	apic.IOAPICUnmask(gsi)
+	return true
+}
+
+// EnablePCIIRQ enables the legacy INTx irq of pci device, delivered to vector IRQ_BASE+line.
+// The line is routed through the overrides of MADT like isa irqs, the _PRT of ACPI is not
+// evaluated, which is right if the firmware routes INTx to the same line in APIC mode,
+// eg. qemu and most chipsets with PIRQ routers.
+//go:nosplit
+func EnablePCIIRQ(line uint16) {
+	gsi, trigger, polarity := apic.PCIIRQ(uint8(line))
+	enable(line, gsi, trigger, polarity)
+}
+
+// DisableIRQ disables the irq line
+//go:nosplit
+func DisableIRQ(line uint16) {
+	s := &sources[IRQ_BASE+uintptr(line)]
+	if !useAPIC {
+		pic.DisableIRQ(line)
+		return
+	}
+	if s.ioapic {
+		apic.IOAPICMask(s.gsi)
+	}
+}
+
+// AllocVector allocates a vector for message signaled interrupt,
+// returns 0 if the vectors are used up or the local apic is not enabled.
+// It's called by pci drivers sequentially when initializing.
+func AllocVector() uint8 {
+	if !useAPIC {
+		return 0
+	}
+	for v := uintptr(vectorDynBase); v < vectorEnd; v++ {
+		bit := uint64(1) << (v - IRQ_BASE)
+		if msiVecs&bit == 0 {
+			msiVecs |= bit
+			return uint8(v)
+		}
+	}
+	return 0
+}
+
+// FreeVector releases the vector allocated by AllocVector,
+// eg. the device falls back to INTx.
+func FreeVector(v uint8) {
+	if uintptr(v) < vectorDynBase || uintptr(v) >= vectorEnd {
+		return
+	}
+	msiVecs &^= uint64(1) << (uintptr(v) - IRQ_BASE)
+}
+
+// Dest returns the local apic id that MSI should be delivered to
+func Dest() uint8 {
+	return dest
+}
+
+// Ack acknowledges the device irq when it arrives.
+// The level triggered source is masked until EOI, or it will fire again
+// before the trap thread handling it.
+//go:nosplit
+func Ack(vector uintptr) {
+	s := &sources[vector]
+	if !useAPIC {
+		if s.level {
+			pic.DisableIRQ(uint16(vector - IRQ_BASE))
+		}
+		return
+	}
+	if s.level && s.ioapic {
+		apic.IOAPICMask(s.gsi)
+	}
+	apic.EOI()
+}
+
+// EOI signals the end of interrupt of the vector.
+//go:nosplit
+func EOI(vector uintptr) {
+	if !useAPIC {
+		pic.EOI(vector)
+		if vector < vectorEnd && sources[vector].level {
+			pic.EnableIRQ(uint16(vector - IRQ_BASE))
+		}
+		return
+	}
+	if !IsDevice(vector) {
+		apic.EOI()
+		return
+	}
+	// device irqs have been acknowledged by Ack
+	s := &sources[vector]
+	if s.level && s.ioapic {
+		apic.IOAPICUnmask(s.gsi)
+	}
+}
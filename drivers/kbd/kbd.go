@@ -1,13 +1,13 @@
 package kbd
 
 import (
-	"github.com/icexin/eggos/drivers/pic"
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/kernel/trap"
 )
 
 const (
-	_IRQ_KBD = pic.IRQ_BASE + pic.LINE_KBD
+	_IRQ_KBD = irq.IRQ_BASE + irq.LINE_KBD
 )
 
 const (
@@ -219,7 +219,7 @@ func intr() {
 			}
 		}
 	}
-	pic.EOI(_IRQ_KBD)
+	irq.EOI(_IRQ_KBD)
 }
 
 func OnInput(callback func(byte)) {
@@ -232,5 +232,5 @@ func Pressed(key byte) bool {
 
 func Init() {
 	trap.Register(_IRQ_KBD, intr)
-	pic.EnableIRQ(pic.LINE_KBD)
+	irq.EnableIRQ(irq.LINE_KBD)
 }
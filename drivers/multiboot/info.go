@@ -9,7 +9,7 @@ const (
 )
 
 const (
-	MemoryAvailable = 1 << iota
+	MemoryAvailable = iota + 1
 	MemoryReserved
 	MemoryACPIReclaimable
 	MemoryNVS
@@ -77,14 +77,89 @@ type Info struct {
 	ColorInfo         [6]byte
 }
 
+// MmapEntries returns the memory map decoded by Init
 func (i *Info) MmapEntries() []MmapEntry {
-	n := i.MmapLength / uint32(unsafe.Sizeof(MmapEntry{}))
-	return (*[128]MmapEntry)(unsafe.Pointer(uintptr(i.MmapAddr)))[:n]
+	return mmapEntries[:nmmap]
 }
 
+// Modules returns the modules loaded by bootloader, at most MaxModules
+func (i *Info) Modules() []Module {
+	return modules[:nmodules]
+}
+
+// DroppedModules returns the number of modules beyond MaxModules,
+// which are not returned by Modules, their memory is used as free memory.
+func (i *Info) DroppedModules() int {
+	return nmodsDropped
+}
+
+// Module is a boot module, the content is in physical memory [Start, End)
+type Module struct {
+	Start   uint32
+	End     uint32
+	Cmdline uint32
+	_       uint32
+}
+
+// MmapEntry is a physical memory range of Type
 type MmapEntry struct {
-	Size uint32
 	Addr uint64
 	Len  uint64
 	Type uint32
 }
+
+// MaxModules is the max number of boot modules kept
+const MaxModules = 64
+
+const (
+	maxMmapEntries = 128
+)
+
+var (
+	mmapEntries [maxMmapEntries]MmapEntry
+	nmmap       int
+
+	modules      [MaxModules]Module
+	nmodules     int
+	nmodsDropped int
+)
+
+//go:nosplit
+func addMmapEntry(addr, len uint64, typ uint32) {
+	if nmmap >= maxMmapEntries {
+		return
+	}
+	mmapEntries[nmmap] = MmapEntry{Addr: addr, Len: len, Type: typ}
+	nmmap++
+}
+
+//go:nosplit
+func addModule(m Module) {
+	if nmodules >= MaxModules {
+		nmodsDropped++
+		return
+	}
+	modules[nmodules] = m
+	nmodules++
+}
+
+// parseInfo decodes the mmap entries and modules of multiboot v1 info,
+// the mmap entries are packed and prefixed by the size of entry.
+//go:nosplit
+func parseInfo(info *Info) {
+	if info.Flags&FlagInfoMemMap != 0 {
+		p := uintptr(info.MmapAddr)
+		end := p + uintptr(info.MmapLength)
+		for p < end {
+			addMmapEntry(u64(p+4), u64(p+12), u32(p+20))
+			p += uintptr(u32(p)) + 4
+		}
+	}
+	if info.Flags&FlagInfoMods != 0 {
+		p := uintptr(info.ModsAddr)
+		for i := uint32(0); i < info.ModsCount; i++ {
+			addModule(*(*Module)(unsafe.Pointer(p)))
+			p += unsafe.Sizeof(Module{})
+		}
+	}
+}
@@ -11,11 +11,21 @@ func Enabled() bool {
 	return enabled
 }
 
+// Init parses the boot information of multiboot v1 or v2 bootloader,
+// the v2 one is converted to BootInfo.
+//go:nosplit
 func Init(magic uintptr, mbiptr uintptr) {
-	if magic != bootloaderMagic {
+	switch magic {
+	case bootloaderMagic:
+		mbi := (*Info)(unsafe.Pointer(mbiptr))
+		BootInfo = *mbi
+		parseInfo(&BootInfo)
+		version = 1
+	case bootloaderMagic2:
+		parseInfo2(mbiptr)
+		version = 2
+	default:
 		return
 	}
 	enabled = true
-	mbi := (*Info)(unsafe.Pointer(mbiptr))
-	BootInfo = *mbi
 }
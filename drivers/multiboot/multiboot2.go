@@ -0,0 +1,186 @@
+package multiboot
+
+import "unsafe"
+
+const (
+	bootloaderMagic2 = 0x36d76289
+
+	tagAlign = 8
+)
+
+// the tag types of multiboot2 info
+const (
+	tagEnd = iota
+	tagCmdline
+	tagBootLoaderName
+	tagModule
+	tagBasicMeminfo
+	tagBootDev
+	tagMmap
+	tagVBE
+	tagFramebuffer
+	tagElfSections
+	tagAPM
+	tagEFI32
+	tagEFI64
+	tagSMBIOS
+	tagACPIOld
+	tagACPINew
+	tagNetwork
+	tagEFIMmap
+	tagEFIBootServices
+	tagEFI32ImageHandle
+	tagEFI64ImageHandle
+	tagLoadBaseAddr
+)
+
+// the memory types of EFI memory descriptor
+const (
+	efiReservedMemory = iota
+	efiLoaderCode
+	efiLoaderData
+	efiBootServicesCode
+	efiBootServicesData
+	efiRuntimeServicesCode
+	efiRuntimeServicesData
+	efiConventionalMemory
+	efiUnusableMemory
+	efiACPIReclaimMemory
+	efiACPIMemoryNVS
+)
+
+// EFIInfo is the UEFI information passed by multiboot2 bootloader
+type EFIInfo struct {
+	// the physical address of EFI system table, zero if not booted by UEFI
+	SystemTable uintptr
+	// the EFI image handle of kernel, set only if the boot services are not exited
+	ImageHandle uintptr
+	// BootServices reports whether the boot services are not exited by bootloader
+	BootServices bool
+}
+
+var (
+	version int
+	rsdp    uintptr
+
+	// EFI is valid if the kernel is booted by multiboot2 on UEFI machine
+	EFI EFIInfo
+)
+
+// Version returns the multiboot version of bootloader, 1 or 2,
+// zero if the kernel is not booted by multiboot.
+//go:nosplit
+func Version() int {
+	return version
+}
+
+// RSDP returns the address of ACPI RSDP copied by multiboot2 bootloader,
+// zero if not provided.
+//go:nosplit
+func RSDP() uintptr {
+	return rsdp
+}
+
+//go:nosplit
+func u32(p uintptr) uint32 {
+	return *(*uint32)(unsafe.Pointer(p))
+}
+
+//go:nosplit
+func u64(p uintptr) uint64 {
+	return *(*uint64)(unsafe.Pointer(p))
+}
+
+// parseInfo2 converts the tags of multiboot2 info to BootInfo,
+// the strings and RSDP are referenced in place.
+//go:nosplit
+func parseInfo2(mbi uintptr) {
+	info := &BootInfo
+	var (
+		efiMmap, efiMmapEnd uintptr
+		efiDescSize         uintptr
+	)
+	end := mbi + uintptr(u32(mbi))
+tags:
+	for p := mbi + 8; p+8 <= end; p += (uintptr(u32(p+4)) + tagAlign - 1) &^ (tagAlign - 1) {
+		typ, size := u32(p), uintptr(u32(p+4))
+		data := p + 8
+		switch typ {
+		case tagEnd:
+			break tags
+		case tagCmdline:
+			info.Flags |= FlagInfoCmdline
+			info.Cmdline = uint32(data)
+		case tagBootLoaderName:
+			info.Flags |= FlagInfoBootLoaderName
+			info.BootLoaderName = uint32(data)
+		case tagModule:
+			info.Flags |= FlagInfoMods
+			info.ModsCount++
+			addModule(Module{Start: u32(data), End: u32(data + 4), Cmdline: uint32(data + 8)})
+		case tagBasicMeminfo:
+			info.Flags |= FlagInfoMemory
+			info.MemLower = u32(data)
+			info.MemUpper = u32(data + 4)
+		case tagMmap:
+			info.Flags |= FlagInfoMemMap
+			entrySize := uintptr(u32(data))
+			for e := data + 8; entrySize != 0 && e+entrySize <= p+size; e += entrySize {
+				addMmapEntry(u64(e), u64(e+8), u32(e+16))
+			}
+		case tagFramebuffer:
+			info.Flags |= FlagInfoFrameBuffer
+			info.FramebufferAddr = u64(data)
+			info.FramebufferPitch = u32(data + 8)
+			info.FramebufferWidth = u32(data + 12)
+			info.FramebufferHeight = u32(data + 16)
+			info.FramebufferBPP = *(*byte)(unsafe.Pointer(data + 20))
+			info.FramebufferType = *(*byte)(unsafe.Pointer(data + 21))
+		case tagEFI32:
+			EFI.SystemTable = uintptr(u32(data))
+		case tagEFI64:
+			EFI.SystemTable = uintptr(u64(data))
+		case tagACPIOld:
+			// prefer the RSDP of acpi 2.0+
+			if rsdp == 0 {
+				rsdp = data
+			}
+		case tagACPINew:
+			rsdp = data
+		case tagEFIMmap:
+			efiDescSize = uintptr(u32(data))
+			efiMmap, efiMmapEnd = data+8, p+size
+		case tagEFIBootServices:
+			EFI.BootServices = true
+		case tagEFI32ImageHandle:
+			EFI.ImageHandle = uintptr(u32(data))
+		case tagEFI64ImageHandle:
+			EFI.ImageHandle = uintptr(u64(data))
+		}
+	}
+
+	// the bootloader may pass only the EFI memory map
+	if info.Flags&FlagInfoMemMap == 0 && efiDescSize != 0 {
+		info.Flags |= FlagInfoMemMap
+		for e := efiMmap; e+efiDescSize <= efiMmapEnd; e += efiDescSize {
+			addMmapEntry(u64(e+8), u64(e+24)<<12, efiMemoryType(u32(e)))
+		}
+	}
+}
+
+// efiMemoryType converts the type of EFI memory descriptor to the multiboot one
+//go:nosplit
+func efiMemoryType(typ uint32) uint32 {
+	switch typ {
+	case efiLoaderCode, efiLoaderData, efiBootServicesCode, efiBootServicesData, efiConventionalMemory:
+		return MemoryAvailable
+	case efiACPIReclaimMemory:
+		return MemoryACPIReclaimable
+	case efiACPIMemoryNVS:
+		return MemoryNVS
+	case efiUnusableMemory:
+		return MemoryBadRAM
+	default:
+		return MemoryReserved
+	}
+}
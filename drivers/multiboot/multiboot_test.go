@@ -0,0 +1,240 @@
+package multiboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// the boot info is placed in the data segment of test binary,
+// which is below 4G as the addresses of multiboot v1 are 32 bits.
+var mbiBuf [512]uint64
+
+func reset() {
+	enabled = false
+	version = 0
+	rsdp = 0
+	BootInfo = Info{}
+	EFI = EFIInfo{}
+	nmmap = 0
+	nmodules = 0
+	nmodsDropped = 0
+}
+
+// load copies b to mbiBuf and returns its address
+func load(t *testing.T, b []byte) uintptr {
+	buf := (*[len(mbiBuf) * 8]byte)(unsafe.Pointer(&mbiBuf))
+	if len(b) > len(buf) {
+		t.Fatalf("boot info too large: %d", len(b))
+	}
+	copy(buf[:], b)
+	p := uintptr(unsafe.Pointer(buf))
+	if p+uintptr(len(buf)) > 1<<32 {
+		t.Skipf("boot info at %#x is above 4G", p)
+	}
+	return p
+}
+
+type mbi2 struct {
+	bytes.Buffer
+}
+
+func (m *mbi2) put(v ...interface{}) {
+	for _, x := range v {
+		binary.Write(&m.Buffer, binary.LittleEndian, x)
+	}
+}
+
+func (m *mbi2) tag(typ uint32, data ...interface{}) {
+	var d bytes.Buffer
+	for _, x := range data {
+		binary.Write(&d, binary.LittleEndian, x)
+	}
+	m.put(typ, uint32(8+d.Len()))
+	m.Write(d.Bytes())
+	for m.Len()%tagAlign != 0 {
+		m.WriteByte(0)
+	}
+}
+
+func (m *mbi2) bytes() []byte {
+	b := m.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+func TestInit2(t *testing.T) {
+	reset()
+	var m mbi2
+	m.put(uint32(0), uint32(0))
+	m.tag(tagModule, uint32(0x200000), uint32(0x201000), []byte("initrd\x00"))
+	m.tag(tagModule, uint32(0x300000), uint32(0x380000), []byte("\x00"))
+	m.tag(tagMmap, uint32(24), uint32(0),
+		uint64(0), uint64(0x9fc00), uint32(MemoryAvailable), uint32(0),
+		uint64(0x100000), uint64(0x7ee0000), uint32(MemoryAvailable), uint32(0),
+		uint64(0x7fe0000), uint64(0x20000), uint32(MemoryACPIReclaimable), uint32(0),
+		uint64(0xfffc0000), uint64(0x40000), uint32(MemoryReserved), uint32(0),
+	)
+	m.tag(tagACPINew, []byte("RSD PTR \x00"))
+	m.tag(tagACPIOld, []byte("RSD PTR \x00"))
+	m.tag(tagEnd)
+	// the tags after end are ignored
+	m.tag(tagModule, uint32(0x400000), uint32(0x401000), []byte("\x00"))
+	b := m.bytes()
+	mbi := load(t, b)
+
+	Init(bootloaderMagic2, mbi)
+	if !Enabled() || Version() != 2 {
+		t.Fatalf("expect enabled version 2, got %v %d", Enabled(), Version())
+	}
+
+	mods := BootInfo.Modules()
+	expectMods := [][2]uint32{{0x200000, 0x201000}, {0x300000, 0x380000}}
+	if len(mods) != len(expectMods) || BootInfo.ModsCount != uint32(len(expectMods)) {
+		t.Fatalf("expect %d modules, got %d %d", len(expectMods), len(mods), BootInfo.ModsCount)
+	}
+	for i, m := range mods {
+		if m.Start != expectMods[i][0] || m.End != expectMods[i][1] {
+			t.Fatalf("module %d: expect %x, got [%x, %x)", i, expectMods[i], m.Start, m.End)
+		}
+	}
+	// the first module tag starts at offset 8, its cmdline at 8+16
+	if mods[0].Cmdline != uint32(mbi+24) {
+		t.Fatalf("expect cmdline at %x, got %x", mbi+24, mods[0].Cmdline)
+	}
+
+	expectMmap := []MmapEntry{
+		{0, 0x9fc00, MemoryAvailable},
+		{0x100000, 0x7ee0000, MemoryAvailable},
+		{0x7fe0000, 0x20000, MemoryACPIReclaimable},
+		{0xfffc0000, 0x40000, MemoryReserved},
+	}
+	if got := BootInfo.MmapEntries(); !reflect.DeepEqual(got, expectMmap) {
+		t.Fatalf("expect mmap %v, got %v", expectMmap, got)
+	}
+
+	p := RSDP()
+	if p < mbi || p >= mbi+uintptr(len(b)) {
+		t.Fatalf("RSDP %x out of boot info", p)
+	}
+	// the RSDP of acpi 2.0+ is preferred even if the old one comes later
+	if u32(p-8) != tagACPINew || string(b[p-mbi:p-mbi+8]) != "RSD PTR " {
+		t.Fatalf("expect RSDP of tag %d, got tag %d", tagACPINew, u32(p-8))
+	}
+}
+
+func TestInit2ManyModules(t *testing.T) {
+	reset()
+	var m mbi2
+	m.put(uint32(0), uint32(0))
+	const n = MaxModules + 2
+	for i := 0; i < n; i++ {
+		m.tag(tagModule, uint32(i<<12), uint32(i+1)<<12, []byte("\x00"))
+	}
+	m.tag(tagEnd)
+	Init(bootloaderMagic2, load(t, m.bytes()))
+
+	mods := BootInfo.Modules()
+	if len(mods) != MaxModules || BootInfo.DroppedModules() != n-MaxModules {
+		t.Fatalf("expect %d modules and %d dropped, got %d %d",
+			MaxModules, n-MaxModules, len(mods), BootInfo.DroppedModules())
+	}
+	if last := mods[MaxModules-1]; last.Start != (MaxModules-1)<<12 {
+		t.Fatalf("expect last module at %x, got %x", (MaxModules-1)<<12, last.Start)
+	}
+}
+
+func TestInit2EFIMmap(t *testing.T) {
+	reset()
+	var m mbi2
+	m.put(uint32(0), uint32(0))
+	desc := func(typ uint32, addr, npages uint64) []interface{} {
+		// type, pad, physical start, virtual start, number of pages, attribute
+		return []interface{}{typ, uint32(0), addr, uint64(0), npages, uint64(0)}
+	}
+	var data []interface{}
+	data = append(data, uint32(40), uint32(1))
+	data = append(data, desc(efiConventionalMemory, 0x100000, 16)...)
+	data = append(data, desc(efiACPIReclaimMemory, 0x200000, 1)...)
+	data = append(data, desc(efiACPIMemoryNVS, 0x300000, 2)...)
+	data = append(data, desc(efiUnusableMemory, 0x400000, 1)...)
+	data = append(data, desc(efiRuntimeServicesData, 0x500000, 1)...)
+	m.tag(tagEFIMmap, data...)
+	m.tag(tagEFI64, uint64(0x7f000000))
+	m.tag(tagEnd)
+	Init(bootloaderMagic2, load(t, m.bytes()))
+
+	expect := []MmapEntry{
+		{0x100000, 16 << 12, MemoryAvailable},
+		{0x200000, 1 << 12, MemoryACPIReclaimable},
+		{0x300000, 2 << 12, MemoryNVS},
+		{0x400000, 1 << 12, MemoryBadRAM},
+		{0x500000, 1 << 12, MemoryReserved},
+	}
+	if got := BootInfo.MmapEntries(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect mmap %v, got %v", expect, got)
+	}
+	if EFI.SystemTable != 0x7f000000 {
+		t.Fatalf("expect EFI system table 0x7f000000, got %x", EFI.SystemTable)
+	}
+}
+
+func TestInit1(t *testing.T) {
+	// the memory types of multiboot spec
+	types := []int{MemoryAvailable, MemoryReserved, MemoryACPIReclaimable, MemoryNVS, MemoryBadRAM}
+	for i, typ := range types {
+		if typ != i+1 {
+			t.Fatalf("memory type %d: expect %d, got %d", i, i+1, typ)
+		}
+	}
+
+	reset()
+	expect := []MmapEntry{
+		{0, 0x9fc00, MemoryAvailable},
+		{0x9fc00, 0x400, MemoryReserved},
+		{0x100000, 0x7ee0000, MemoryAvailable},
+		{0x7fe0000, 0x10000, MemoryACPIReclaimable},
+		{0x7ff0000, 0x10000, MemoryNVS},
+		{0x8000000, 0x1000, MemoryBadRAM},
+	}
+	const (
+		mmapOff = 512
+		modsOff = 1024
+	)
+	b := make([]byte, 2048)
+	// the mmap entries are prefixed by size, which excludes the size field itself
+	var mmap bytes.Buffer
+	for _, e := range expect {
+		binary.Write(&mmap, binary.LittleEndian, uint32(20))
+		binary.Write(&mmap, binary.LittleEndian, e)
+	}
+	copy(b[mmapOff:], mmap.Bytes())
+	mods := []Module{{Start: 0x200000, End: 0x280000, Cmdline: 0x1000}}
+	var modsBuf bytes.Buffer
+	binary.Write(&modsBuf, binary.LittleEndian, mods)
+	copy(b[modsOff:], modsBuf.Bytes())
+	mbi := load(t, b)
+	*(*Info)(unsafe.Pointer(mbi)) = Info{
+		Flags:      FlagInfoMemMap | FlagInfoMods,
+		MmapLength: uint32(mmap.Len()),
+		MmapAddr:   uint32(mbi + mmapOff),
+		ModsCount:  uint32(len(mods)),
+		ModsAddr:   uint32(mbi + modsOff),
+	}
+
+	Init(bootloaderMagic, mbi)
+	if !Enabled() || Version() != 1 {
+		t.Fatalf("expect enabled version 1, got %v %d", Enabled(), Version())
+	}
+	if got := BootInfo.MmapEntries(); !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect mmap %v, got %v", expect, got)
+	}
+	if got := BootInfo.Modules(); !reflect.DeepEqual(got, mods) {
+		t.Fatalf("expect modules %v, got %v", mods, got)
+	}
+	if RSDP() != 0 {
+		t.Fatalf("expect no RSDP, got %x", RSDP())
+	}
+}
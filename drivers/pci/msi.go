@@ -0,0 +1,112 @@
+package pci
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+const (
+	capMSI  = 0x05
+	capMSIX = 0x11
+
+	statusCapList = 1 << 4
+
+	msiEnable   = 1 << 0
+	msi64Bit    = 1 << 7
+	msiMMEMask  = 0x7 << 4
+	msixEnable  = 1 << 15
+	msixFuncMsk = 1 << 14
+	msixBIRMask = 0x7
+
+	// all messages are sent to the local apic address space
+	msiAddrBase = 0xfee00000
+
+	cmdIntxDisable = 1 << 10
+)
+
+// FindCap returns the config space offset of the capability id, 0 if not found.
+func (a Address) FindCap(id uint8) uint8 {
+	if a.ReadStatus()&statusCapList == 0 {
+		return 0
+	}
+	// guard against malformed looping list
+	off := a.ReadCapOffset()
+	for i := 0; off != 0 && i < 48; i++ {
+		reg := a.ReadPCIRegister(off)
+		if uint8(reg) == id {
+			return off
+		}
+		off = uint8(reg>>8) &^ 0x3
+	}
+	return 0
+}
+
+func msiMessage(vector, dest uint8) (addr, data uint32) {
+	// fixed delivery, edge triggered, physical destination mode
+	return msiAddrBase | uint32(dest)<<12, uint32(vector)
+}
+
+func (a Address) disableIntx() {
+	a.WritePCIRegister(0x04, a.ReadPCIRegister(0x04)|cmdIntxDisable)
+}
+
+// EnableMSI configures the device to send vector to the processor of dest
+// using MSI, returns false if the device has no MSI capability.
+func (a Address) EnableMSI(vector, dest uint8) bool {
+	off := a.FindCap(capMSI)
+	if off == 0 {
+		return false
+	}
+	addr, data := msiMessage(vector, dest)
+	ctrl := a.ReadPCIRegister(off) >> 16
+	a.WritePCIRegister(off+4, addr)
+	if ctrl&msi64Bit != 0 {
+		a.WritePCIRegister(off+8, 0)
+		a.WritePCIRegister(off+12, data)
+	} else {
+		a.WritePCIRegister(off+8, data)
+	}
+	// single message
+	ctrl = ctrl&^msiMMEMask | msiEnable
+	a.WritePCIRegister(off, a.ReadPCIRegister(off)&0xffff|ctrl<<16)
+	a.disableIntx()
+	return true
+}
+
+// EnableMSIX configures all the entries of MSI-X table to send vector
+// to the processor of dest, returns false if the device has no MSI-X capability
+// or the table can not be mapped.
+func (a Address) EnableMSIX(vector, dest uint8) bool {
+	off := a.FindCap(capMSIX)
+	if off == 0 {
+		return false
+	}
+	ctrl := a.ReadPCIRegister(off) >> 16
+	size := uintptr(ctrl&0x7ff) + 1
+	table := a.ReadPCIRegister(off + 4)
+	bar, _, _, isMem := a.ReadBAR(uint8(table & msixBIRMask))
+	if !isMem || bar == 0 {
+		return false
+	}
+	base := uintptr(bar) + uintptr(table&^msixBIRMask)
+	mm.SysFixedMmap(base, base, size*16)
+
+	// mask all the vectors before enabling
+	ctrl |= msixEnable | msixFuncMsk
+	a.WritePCIRegister(off, a.ReadPCIRegister(off)&0xffff|ctrl<<16)
+
+	addr, data := msiMessage(vector, dest)
+	for i := uintptr(0); i < size; i++ {
+		entry := (*[4]uint32)(unsafe.Pointer(base + i*16))
+		entry[0] = addr
+		entry[1] = 0
+		entry[2] = data
+		// unmask
+		entry[3] = 0
+	}
+	ctrl &^= msixFuncMsk
+	a.WritePCIRegister(off, a.ReadPCIRegister(off)&0xffff|ctrl<<16)
+	a.disableIntx()
+	return true
+}
@@ -1,7 +1,7 @@
 package pci
 
 import (
-	"github.com/icexin/eggos/drivers/pic"
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/kernel/trap"
 	"github.com/icexin/eggos/log"
 )
@@ -18,7 +18,10 @@ type Device struct {
 	Class, SubClass uint8
 
 	IRQLine uint8
-	IRQNO   uint8
+	// the interrupt vector of device, IRQ_BASE+IRQLine for legacy INTx
+	IRQNO uint8
+	// MSI or MSI-X is used
+	MSI bool
 }
 
 var devices []*Device
@@ -49,7 +52,7 @@ func Scan() []*Device {
 					Class:    uint8((class >> 8) & 0xff),
 					SubClass: uint8(class & 0xff),
 					IRQLine:  irqline,
-					IRQNO:    pic.IRQ_BASE + irqline,
+					IRQNO:    irq.IRQ_BASE + irqline,
 				}
 				devices = append(devices, device)
 			}
@@ -77,9 +80,25 @@ func Init() {
 			log.Infof("[pci] no pci device found for %v\n", driver.Name())
 			continue
 		}
-		log.Infof("[pci] found %x:%x for %s, irq:%d\n", dev.Ident.Vendor, dev.Ident.Device, driver.Name(), dev.IRQNO)
 		driver.Init(dev)
-		pic.EnableIRQ(uint16(dev.IRQLine))
-		trap.Register(int(dev.IRQNO), driver.Intr)
+		enableIntr(dev, driver.Intr)
+		log.Infof("[pci] found %x:%x for %s, irq:%d msi:%v\n", dev.Ident.Vendor, dev.Ident.Device, driver.Name(), dev.IRQNO, dev.MSI)
 	}
 }
+
+// enableIntr prefers MSI-X and MSI to the level triggered INTx,
+// each of them gets an edge triggered vector of its own.
+func enableIntr(dev *Device, handler func()) {
+	if vec := irq.AllocVector(); vec != 0 {
+		trap.Register(int(vec), handler)
+		if dev.Addr.EnableMSIX(vec, irq.Dest()) || dev.Addr.EnableMSI(vec, irq.Dest()) {
+			dev.IRQNO = vec
+			dev.MSI = true
+			return
+		}
+		trap.Register(int(vec), nil)
+		irq.FreeVector(vec)
+	}
+	trap.Register(int(dev.IRQNO), handler)
+	irq.EnablePCIIRQ(uint16(dev.IRQLine))
+}
@@ -47,6 +47,13 @@ func Init() {
 	EnableIRQ(0x02)
 }
 
+// Disable masks all the irq lines, the chips are not used any more.
+//go:nosplit
+func Disable() {
+	sys.Outb(PIC1_DATA, 0xff)
+	sys.Outb(PIC2_DATA, 0xff)
+}
+
 //go:nosplit
 func EnableIRQ(line uint16) {
 	var port uint16 = PIC1_DATA
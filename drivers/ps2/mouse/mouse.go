@@ -1,13 +1,13 @@
 package mouse
 
 import (
-	"github.com/icexin/eggos/drivers/pic"
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/drivers/ps2"
 	"github.com/icexin/eggos/kernel/trap"
 )
 
 const (
-	_IRQ_MOUSE = pic.IRQ_BASE + pic.LINE_MOUSE
+	_IRQ_MOUSE = irq.IRQ_BASE + irq.LINE_MOUSE
 )
 
 var (
@@ -38,7 +38,7 @@ func RightClick() bool {
 }
 
 func intr() {
-	pic.EOI(_IRQ_MOUSE)
+	irq.EOI(_IRQ_MOUSE)
 	for {
 		st := ps2.ReadCmd()
 		// log.Infof("status:%08b", st)
@@ -130,7 +130,7 @@ func Init() {
 	ps2.WriteMouseData(0xF4)
 
 	trap.Register(_IRQ_MOUSE, intr)
-	pic.EnableIRQ(pic.LINE_MOUSE)
+	irq.EnableIRQ(irq.LINE_MOUSE)
 
 	eventch = make(chan Packet, 10)
 }
@@ -31,6 +31,14 @@ func waitCanRead() {
 	}
 }
 
+// ResetCPU pulses the reset line of cpu by the controller, used to reboot the machine
+//go:nosplit
+func ResetCPU() {
+	for i := 0; i < 1000 && sys.Inb(_CMD_PORT)&0x02 != 0; i++ {
+	}
+	sys.Outb(_CMD_PORT, 0xFE)
+}
+
 func ReadDataNoWait() byte {
 	return sys.Inb(_DATA_PORT)
 }
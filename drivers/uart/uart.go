@@ -1,14 +1,14 @@
 package uart
 
 import (
-	"github.com/icexin/eggos/drivers/pic"
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/kernel/trap"
 )
 
 const (
 	com1      = uint16(0x3f8)
-	_IRQ_COM1 = pic.IRQ_BASE + pic.LINE_COM1
+	_IRQ_COM1 = irq.IRQ_BASE + irq.LINE_COM1
 )
 
 var (
@@ -63,7 +63,7 @@ func intr() {
 		}
 		inputCallback(byte(ch))
 	}
-	pic.EOI(_IRQ_COM1)
+	irq.EOI(_IRQ_COM1)
 }
 
 //go:nosplit
@@ -87,5 +87,5 @@ func OnInput(callback func(byte)) {
 
 func Init() {
 	trap.Register(_IRQ_COM1, intr)
-	pic.EnableIRQ(pic.LINE_COM1)
+	irq.EnableIRQ(irq.LINE_COM1)
 }
@@ -71,7 +71,8 @@ func IsEnable() bool {
 // multiboot.
 func Init() {
 	bootInfo := &multiboot.BootInfo
-	if bootInfo.Flags&multiboot.FlagInfoVideoInfo == 0 {
+	// multiboot2 passes only the framebuffer info
+	if bootInfo.Flags&(multiboot.FlagInfoVideoInfo|multiboot.FlagInfoFrameBuffer) == 0 {
 		uart.WriteString("[video] can't find video info from bootloader, video disabled\n")
 		return
 	}
@@ -19,7 +19,11 @@ import (
 func kernelInit() {
 	// trap and syscall threads use two Ps,
 	// and the remainings are for other goroutines
-	runtime.GOMAXPROCS(6)
+	procs := runtime.NumCPU()
+	if procs < 4 {
+		procs = 4
+	}
+	runtime.GOMAXPROCS(procs + 2)
 
 	kernel.Init()
 	uart.Init()
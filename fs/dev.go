@@ -1,6 +1,17 @@
 package fs
 
-import "math/rand"
+import (
+	"io"
+
+	"github.com/icexin/eggos/kernel/entropy"
+)
+
+// devices are the character devices opened by path
+var devices = map[string]func() io.ReadWriteCloser{
+	"/dev/zero":    func() io.ReadWriteCloser { return NewFile(zero{}, nil, nil) },
+	"/dev/random":  func() io.ReadWriteCloser { return NewFile(random{}, nil, nil) },
+	"/dev/urandom": func() io.ReadWriteCloser { return NewFile(random{}, nil, nil) },
+}
 
 type zero struct{}
 
@@ -11,8 +22,9 @@ func (z zero) Read(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// random reads from the kernel DRBG, /dev/random and /dev/urandom are the same
 type random struct{}
 
 func (r random) Read(b []byte) (int, error) {
-	return rand.Read(b)
+	return entropy.Read(b), nil
 }
@@ -0,0 +1,23 @@
+package fs
+
+import (
+	"syscall"
+	_ "unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+//go:linkname epollCreate github.com/icexin/eggos/kernel.lockedEpollCreate
+func epollCreate(epfd int) syscall.Errno
+
+// func epoll_create1(flags int)
+func sysEpollCreate1(call *isyscall.Request) {
+	fd, ni := allocKernelNode()
+	errno := epollCreate(fd)
+	if errno != 0 {
+		ni.Release()
+		call.SetErrorNO(errno)
+		return
+	}
+	call.SetRet(uintptr(fd))
+}
@@ -1,6 +1,10 @@
 package fs
 
-import "github.com/spf13/afero"
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
 
 var builtinFiles = map[string]string{
 	"/etc/resolv.conf":          `nameserver 114.114.114.114`,
@@ -9,7 +13,15 @@ var builtinFiles = map[string]string{
 
 func etcInit() {
 	for name, content := range builtinFiles {
-		err := afero.WriteFile(Root, name, []byte(content), 0644)
+		// the files shipped by initrd take precedence
+		if ok, _ := afero.Exists(Root, name); ok {
+			continue
+		}
+		err := Root.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			panic(err)
+		}
+		err = afero.WriteFile(Root, name, []byte(content), 0644)
 		if err != nil {
 			panic(err)
 		}
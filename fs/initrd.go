@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"github.com/icexin/eggos/drivers/multiboot"
+	"github.com/icexin/eggos/fs/initrd"
+	"github.com/icexin/eggos/fs/mount"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+	"github.com/icexin/eggos/log"
+
+	"github.com/spf13/afero"
+)
+
+// initrdInit unpacks the archives in boot modules and mounts them read only
+// at the path of EGGOS_INITRD, which defaults to /.
+// The modules in other formats, such as the kernel image loaded by egg, are skipped.
+func initrdInit() {
+	if !multiboot.Enabled() {
+		return
+	}
+	var (
+		files = afero.NewMemMapFs()
+		found bool
+	)
+	if n := multiboot.BootInfo.DroppedModules(); n != 0 {
+		log.Warnf("[initrd] %d modules beyond %d are ignored", n, multiboot.MaxModules)
+	}
+	for i, m := range multiboot.BootInfo.Modules() {
+		data := sys.UnsafeBuffer(mm.P2V(uintptr(m.Start)), int(m.End-m.Start))
+		err := initrd.Unpack(files, bytes.NewReader(data))
+		if errors.Is(err, initrd.ErrFormat) {
+			continue
+		}
+		if err != nil {
+			log.Errorf("[initrd] module %d: %s", i, err)
+			continue
+		}
+		log.Infof("[initrd] module %d unpacked, %d bytes", i, len(data))
+		found = true
+		// the files are copied to memory fs
+		mm.FreeModule(i)
+	}
+	if !found {
+		return
+	}
+
+	target := os.Getenv("EGGOS_INITRD")
+	if target == "" || target == "/" {
+		// the files of initrd are never changed, writes go to the memory fs above
+		Root = mount.NewMountableFs(overlayFs{
+			afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(files), afero.NewMemMapFs()),
+		})
+		return
+	}
+	err := Mount(target, afero.NewReadOnlyFs(files))
+	if err != nil {
+		log.Errorf("[initrd] mount %s: %s", target, err)
+	}
+}
+
+// overlayFs opens the read only files by Open, which merges the directories
+// of both layers, afero.CopyOnWriteFs.OpenFile only reads the upper one.
+type overlayFs struct {
+	afero.Fs
+}
+
+func (o overlayFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		return o.Fs.Open(name)
+	}
+	return o.Fs.OpenFile(name, flag, perm)
+}
@@ -0,0 +1,169 @@
+// Package initrd unpacks the tar or cpio archives, optionally gzipped,
+// which are loaded by bootloader as the initial filesystem.
+package initrd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/spf13/afero"
+)
+
+var (
+	// ErrFormat is returned by Unpack if the data is not a tar or cpio archive
+	ErrFormat = errors.New("initrd: unknown format")
+)
+
+const (
+	cpioHeaderSize = 110
+	cpioTrailer    = "TRAILER!!!"
+	// the max length of name including the trailing NUL, same as PATH_MAX
+	cpioMaxName = 4096
+
+	// the type bits of cpio mode
+	cpioTypeMask = 0170000
+	cpioTypeDir  = 0040000
+	cpioTypeReg  = 0100000
+)
+
+// Unpack extracts the files in archive r to fs, it returns
+// ErrFormat if r is neither a tar nor a newc cpio archive.
+func Unpack(fs afero.Fs, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 512)
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReaderSize(zr, 512)
+	}
+
+	// the tar magic is at offset 257 of the first header
+	head, _ := br.Peek(512)
+	switch {
+	case isCpioMagic(head):
+		return unpackCpio(fs, br)
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return unpackTar(fs, br)
+	default:
+		return ErrFormat
+	}
+}
+
+func unpackTar(fs afero.Fs, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = fs.MkdirAll(clean(hdr.Name), mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(fs, clean(hdr.Name), tr, mode)
+		default:
+			// links and devices are not supported by the memory fs
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func unpackCpio(fs afero.Fs, r io.Reader) error {
+	var hdr [cpioHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return fmt.Errorf("initrd: read cpio header: %w", err)
+		}
+		if !isCpioMagic(hdr[:]) {
+			return fmt.Errorf("initrd: bad cpio magic %q", hdr[:6])
+		}
+		// the fields after magic are 8 hex digits each, see cpio(5)
+		field := func(i int) (int64, error) {
+			off := 6 + i*8
+			return strconv.ParseInt(string(hdr[off:off+8]), 16, 64)
+		}
+		mode, err1 := field(1)
+		size, err2 := field(6)
+		namesize, err3 := field(11)
+		if err1 != nil || err2 != nil || err3 != nil || namesize < 1 || namesize > cpioMaxName {
+			return errors.New("initrd: bad cpio header")
+		}
+
+		// the name and data are padded to 4 bytes
+		name := make([]byte, pad4(cpioHeaderSize+namesize)-cpioHeaderSize)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return fmt.Errorf("initrd: read cpio name: %w", err)
+		}
+		fname := string(name[:namesize-1])
+		if fname == cpioTrailer {
+			return nil
+		}
+
+		data := &io.LimitedReader{R: r, N: size}
+		perm := os.FileMode(mode).Perm()
+		var err error
+		switch mode & cpioTypeMask {
+		case cpioTypeDir:
+			err = fs.MkdirAll(clean(fname), perm)
+		case cpioTypeReg:
+			err = writeFile(fs, clean(fname), data, perm)
+		}
+		if err != nil {
+			return err
+		}
+		if data.N != 0 && mode&cpioTypeMask == cpioTypeReg {
+			return fmt.Errorf("initrd: cpio data of %s truncated", fname)
+		}
+		// skip the unread data and padding
+		if _, err := io.CopyN(ioutil.Discard, r, pad4(size)-size+data.N); err != nil {
+			return fmt.Errorf("initrd: read cpio data: %w", err)
+		}
+	}
+}
+
+// isCpioMagic reports whether b starts with the magic of newc cpio, with or without checksum
+func isCpioMagic(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("070701")) || bytes.HasPrefix(b, []byte("070702"))
+}
+
+func writeFile(fs afero.Fs, name string, r io.Reader, perm os.FileMode) error {
+	if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// clean turns the relative names in archive, eg. ./etc/app.conf, to absolute path
+func clean(name string) string {
+	return path.Join("/", name)
+}
+
+func pad4(n int64) int64 {
+	return (n + 3) &^ 3
+}
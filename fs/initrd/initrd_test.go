@@ -0,0 +1,118 @@
+package initrd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+var testFiles = map[string]string{
+	"etc/app.conf":   "debug=1\n",
+	"js/main.js":     "console.log('hello')\n",
+	"js/lib/util.js": "",
+}
+
+func mkTar(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{Name: "js/", Typeflag: tar.TypeDir, Mode: 0755})
+	w.WriteHeader(&tar.Header{Name: "js/link.js", Typeflag: tar.TypeSymlink, Linkname: "main.js"})
+	for name, content := range testFiles {
+		w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		w.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func mkCpio() []byte {
+	var buf bytes.Buffer
+	add := func(name string, mode int, content string) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			0, mode, 0, 0, 1, 0, len(content), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name + "\x00")
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(content)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	add(".", 0040755, "")
+	add("js", 0040755, "")
+	for name, content := range testFiles {
+		add(name, 0100644, content)
+	}
+	add(cpioTrailer, 0, "")
+	return buf.Bytes()
+}
+
+func gz(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestUnpack(t *testing.T) {
+	tarball := mkTar(t)
+	cpio := mkCpio()
+	cases := map[string][]byte{
+		"tar":      tarball,
+		"tar.gz":   gz(tarball),
+		"cpio":     cpio,
+		"cpio.gz":  gz(cpio),
+		"cpio.pad": append(cpio, make([]byte, 512)...),
+	}
+	for name, data := range cases {
+		fs := afero.NewMemMapFs()
+		if err := Unpack(fs, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		for fname, content := range testFiles {
+			b, err := afero.ReadFile(fs, "/"+fname)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			if string(b) != content {
+				t.Fatalf("%s: %s expect %q, got %q", name, fname, content, b)
+			}
+		}
+	}
+}
+
+func TestUnpackUnknown(t *testing.T) {
+	for _, data := range []string{"", "\x7fELF", strings.Repeat("x", 1024)} {
+		err := Unpack(afero.NewMemMapFs(), strings.NewReader(data))
+		if err != ErrFormat {
+			t.Fatalf("%q: expect ErrFormat, got %v", data, err)
+		}
+	}
+}
+
+func TestUnpackBadCpio(t *testing.T) {
+	hdr := func(magic string, mode, size, namesize int) string {
+		return fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			magic, 0, mode, 0, 0, 1, 0, size, 0, 0, 0, 0, namesize, 0)
+	}
+	cases := map[string]string{
+		"magic":    hdr("070701", 0040755, 0, 2) + "a\x00" + hdr("070707", 0040755, 0, 2) + "b\x00",
+		"namesize": hdr("070701", 0100644, 0, 0x7fffffff) + "a\x00",
+		"size":     hdr("070701", 0100644, 1<<20, 2) + "a\x00" + "short",
+	}
+	for name, data := range cases {
+		err := Unpack(afero.NewMemMapFs(), strings.NewReader(data))
+		if err == nil || err == ErrFormat {
+			t.Fatalf("%s: expect cpio error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package fs
+
+import (
+	"syscall"
+	_ "unsafe"
+)
+
+//go:linkname fdClose github.com/icexin/eggos/kernel.lockedFdClose
+func fdClose(fd int)
+
+// kernelFile is the inode of the file managed by kernel, eg. pipe and epoll.
+// Read and write are handled by kernel, never reach here.
+type kernelFile struct{}
+
+func (k kernelFile) Read(b []byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+func (k kernelFile) Write(b []byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+// Close does nothing, the kernel state is released by fdClose
+func (k kernelFile) Close() error {
+	return nil
+}
+
+func allocKernelNode() (int, *Inode) {
+	return AllocFileNode(kernelFile{})
+}
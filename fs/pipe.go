@@ -0,0 +1,28 @@
+package fs
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+)
+
+//go:linkname pipeCreate github.com/icexin/eggos/kernel.lockedPipeCreate
+func pipeCreate(rfd, wfd int, flags uintptr) syscall.Errno
+
+// func pipe2(fds *[2]int32, flags int)
+func sysPipe2(call *isyscall.Request) {
+	rfd, rnode := allocKernelNode()
+	wfd, wnode := allocKernelNode()
+	errno := pipeCreate(rfd, wfd, call.Arg(1))
+	if errno != 0 {
+		rnode.Release()
+		wnode.Release()
+		call.SetErrorNO(errno)
+		return
+	}
+	fds := (*[2]int32)(unsafe.Pointer(call.Arg(0)))
+	fds[0] = int32(rfd)
+	fds[1] = int32(wfd)
+	call.SetRet(0)
+}
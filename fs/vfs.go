@@ -2,7 +2,6 @@ package fs
 
 import (
 	"io"
-	"math/rand"
 	"os"
 	"sync"
 	"syscall"
@@ -10,6 +9,7 @@ import (
 
 	"github.com/icexin/eggos/console"
 	"github.com/icexin/eggos/fs/mount"
+	"github.com/icexin/eggos/kernel/entropy"
 	"github.com/icexin/eggos/kernel/isyscall"
 	"github.com/icexin/eggos/kernel/sys"
 
@@ -136,6 +136,10 @@ func fscall(fn int) isyscall.Handler {
 
 func sysOpen(dirfd, name, flags, perm uintptr) (int, error) {
 	path := cstring(name)
+	if dev, ok := devices[path]; ok {
+		fd, _ := AllocFileNode(dev())
+		return fd, nil
+	}
 	f, err := Root.OpenFile(path, int(flags), os.FileMode(perm))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -150,6 +154,7 @@ func sysOpen(dirfd, name, flags, perm uintptr) (int, error) {
 
 func sysClose(ni *Inode) error {
 	err := ni.File.Close()
+	fdClose(ni.Fd)
 	ni.Release()
 	return err
 }
@@ -264,8 +269,7 @@ func sysLseek(c *isyscall.Request) {
 func sysRandom(call *isyscall.Request) {
 	p, n := call.Arg(0), call.Arg(1)
 	buf := sys.UnsafeBuffer(p, int(n))
-	rand.Read(buf)
-	call.SetRet(n)
+	call.SetRet(uintptr(entropy.Read(buf)))
 }
 
 func cstring(ptr uintptr) string {
@@ -336,28 +340,31 @@ func vfsInit() {
 	AllocFileNode(NewFile(nil, c, nil))
 	// stderr
 	AllocFileNode(NewFile(nil, c, nil))
-	// epoll fd
-	AllocFileNode(NewFile(nil, nil, nil))
-	// pipe read fd
-	AllocFileNode(NewFile(nil, nil, nil))
-	// pipe write fd
-	AllocFileNode(NewFile(nil, nil, nil))
-
+	// epoll fd of go runtime
+	allocKernelNode()
+	// pipe read fd of go runtime
+	allocKernelNode()
+	// pipe write fd of go runtime
+	allocKernelNode()
+
+	initrdInit()
 	etcInit()
 }
 
 func sysInit() {
-	isyscall.Register(syscall.SYS_OPENAT, fscall(syscall.SYS_OPENAT))
-	isyscall.Register(syscall.SYS_WRITE, fscall(syscall.SYS_WRITE))
-	isyscall.Register(syscall.SYS_READ, fscall(syscall.SYS_READ))
-	isyscall.Register(syscall.SYS_CLOSE, fscall(syscall.SYS_CLOSE))
-	isyscall.Register(syscall.SYS_FSTAT, fscall(syscall.SYS_FSTAT))
-	isyscall.Register(syscall.SYS_IOCTL, fscall(syscall.SYS_IOCTL))
-	isyscall.Register(syscall.SYS_FCNTL, sysFcntl)
-	isyscall.Register(syscall.SYS_NEWFSTATAT, sysFstatat64)
-	isyscall.Register(syscall.SYS_LSEEK, sysLseek)
-	isyscall.Register(syscall.SYS_UNAME, sysUname)
-	isyscall.Register(355, sysRandom)
+	isyscall.MustRegister(syscall.SYS_OPENAT, fscall(syscall.SYS_OPENAT))
+	isyscall.MustRegister(syscall.SYS_WRITE, fscall(syscall.SYS_WRITE))
+	isyscall.MustRegister(syscall.SYS_READ, fscall(syscall.SYS_READ))
+	isyscall.MustRegister(syscall.SYS_CLOSE, fscall(syscall.SYS_CLOSE))
+	isyscall.MustRegister(syscall.SYS_FSTAT, fscall(syscall.SYS_FSTAT))
+	isyscall.MustRegister(syscall.SYS_IOCTL, fscall(syscall.SYS_IOCTL))
+	isyscall.MustRegister(syscall.SYS_FCNTL, sysFcntl)
+	isyscall.MustRegister(syscall.SYS_NEWFSTATAT, sysFstatat64)
+	isyscall.MustRegister(syscall.SYS_LSEEK, sysLseek)
+	isyscall.MustRegister(syscall.SYS_PIPE2, sysPipe2)
+	isyscall.MustRegister(syscall.SYS_EPOLL_CREATE1, sysEpollCreate1)
+	isyscall.MustRegister(syscall.SYS_UNAME, sysUname)
+	isyscall.MustRegister(355, sysRandom)
 }
 
 func Init() {
@@ -165,13 +165,13 @@ func htons(n uint16) uint16 {
 }
 
 func init() {
-	isyscall.Register(syscall.SYS_SOCKET, sysSocket)
-	isyscall.Register(syscall.SYS_BIND, sysBind)
-	isyscall.Register(syscall.SYS_LISTEN, sysListen)
-	isyscall.Register(syscall.SYS_ACCEPT4, sysAccept4)
-	isyscall.Register(syscall.SYS_CONNECT, sysConnect)
-	isyscall.Register(syscall.SYS_SETSOCKOPT, sysSetsockopt)
-	isyscall.Register(syscall.SYS_GETSOCKOPT, sysGetsockopt)
-	isyscall.Register(syscall.SYS_GETSOCKNAME, sysGetsockname)
-	isyscall.Register(syscall.SYS_GETPEERNAME, sysGetpeername)
+	isyscall.MustRegister(syscall.SYS_SOCKET, sysSocket)
+	isyscall.MustRegister(syscall.SYS_BIND, sysBind)
+	isyscall.MustRegister(syscall.SYS_LISTEN, sysListen)
+	isyscall.MustRegister(syscall.SYS_ACCEPT4, sysAccept4)
+	isyscall.MustRegister(syscall.SYS_CONNECT, sysConnect)
+	isyscall.MustRegister(syscall.SYS_SETSOCKOPT, sysSetsockopt)
+	isyscall.MustRegister(syscall.SYS_GETSOCKOPT, sysGetsockopt)
+	isyscall.MustRegister(syscall.SYS_GETSOCKNAME, sysGetsockname)
+	isyscall.MustRegister(syscall.SYS_GETPEERNAME, sysGetpeername)
 }
@@ -16,9 +16,12 @@ import (
 	"gvisor.dev/gvisor/pkg/waiter"
 )
 
-//go:linkname evnotify github.com/icexin/eggos/kernel.epollNotify
+//go:linkname evnotify github.com/icexin/eggos/kernel.lockedEpollNotify
 func evnotify(fd, events uintptr)
 
+//go:linkname evclear github.com/icexin/eggos/kernel.lockedEpollClear
+func evclear(fd, events uintptr)
+
 type sockFile struct {
 	fd int
 	ep tcpip.Endpoint
@@ -61,6 +64,7 @@ func (s *sockFile) Read(p []byte) (int, error) {
 	switch terr.(type) {
 	case nil:
 	case *tcpip.ErrWouldBlock:
+		s.clearEvent(waiter.EventIn)
 		return 0, syscall.EAGAIN
 	case *tcpip.ErrClosedForReceive:
 		return 0, nil
@@ -83,6 +87,7 @@ func (s *sockFile) Write(p []byte) (int, error) {
 
 	switch terr.(type) {
 	case *tcpip.ErrWouldBlock:
+		s.clearEvent(waiter.EventOut)
 		return 0, syscall.EAGAIN
 	case *tcpip.ErrClosedForSend:
 		return 0, syscall.EPIPE
@@ -119,6 +124,16 @@ func (s *sockFile) evcallback(e *waiter.Entry, mask waiter.EventMask) {
 	evnotify(uintptr(s.fd), uintptr(mask.ToLinux()))
 }
 
+// clearEvent clears the ready events of fd in kernel when the operation would block,
+// so the level-triggered epoll won't report it again.
+func (s *sockFile) clearEvent(mask waiter.EventMask) {
+	evclear(uintptr(s.fd), uintptr(mask.ToLinux()))
+	// the event may happen before clearing
+	if ready := s.ep.Readiness(mask); ready != 0 {
+		s.evcallback(nil, ready)
+	}
+}
+
 func (s *sockFile) Bind(uaddr, uaddrlen uintptr) error {
 	var saddr *linux.SockAddrInet
 	if uaddrlen < unsafe.Sizeof(*saddr) {
@@ -178,6 +193,7 @@ func (s *sockFile) Accept4(uaddr, uaddrlen, flag uintptr) (int, error) {
 	switch err.(type) {
 	case nil:
 	case *tcpip.ErrWouldBlock:
+		s.clearEvent(waiter.EventIn)
 		return 0, syscall.EAGAIN
 	default:
 		log.Infof("[socket] accept error:%s", err)
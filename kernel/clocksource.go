@@ -0,0 +1,182 @@
+package kernel
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/drivers/hpet"
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+const (
+	_CLOCK_TSC = iota
+	_CLOCK_HPET
+)
+
+const (
+	_CPUID_FN_POWER          = 0x80000007
+	_CPUID_EDX_INVARIANT_TSC = 1 << 8
+	_CPUID_ECX_TSC_DEADLINE  = 1 << 24
+
+	_MSR_TSC_DEADLINE = 0x6e0
+
+	_CLOCK_REALTIME = 0
+
+	// layout of vdso page, sync with syscall.s
+	_VDSO_CLOCK_GETTIME_OFFSET  = 0x100
+	_VDSO_CLOCK_GETTIME_MAXSIZE = 0x100
+	_VDSO_DATA_OFFSET           = 0x800
+)
+
+// clocksource is the counter used by nanosecond
+type clocksource struct {
+	name string
+	kind int
+	freq uint64
+	// nanosecond = (cycles - base) * mult >> 32
+	mult uint64
+	base uint64
+}
+
+// vdsoData is shared with vdsoClockgettime in the vdso page, sync with syscall.s
+type vdsoData struct {
+	// odd when updating
+	seq  uint32
+	_    uint32
+	base uint64
+	// zero if the clocksource can't be read in user mode
+	mult uint64
+	// the unix time in nanosecond of clocksource base
+	wallBase int64
+}
+
+var (
+	clocksrc clocksource
+
+	// the frequency of local apic timer in HZ
+	lapicFreq uint64
+	// use TSC-deadline mode of local apic timer
+	tscDeadline bool
+
+	// the unix time in nanosecond of boot time
+	wallBase int64
+)
+
+//go:nosplit
+func (c *clocksource) cycles() uint64 {
+	if c.kind == _CLOCK_HPET {
+		return hpet.Counter()
+	}
+	return sys.Rdtsc()
+}
+
+// nanosecond returns the monotonic time since boot,
+// tsc is assumed to be synchronized between cpus.
+//go:nosplit
+func nanosecond() int64 {
+	c := &clocksrc
+	hi, lo := bits.Mul64(c.cycles()-c.base, c.mult)
+	return int64(hi<<32 | lo>>32)
+}
+
+// nanoToTSC converts the monotonic time to tsc, only valid for tsc clocksource,
+// the time too far to be represented saturates at the max tsc.
+//go:nosplit
+func nanoToTSC(n int64) uint64 {
+	hi, lo := bits.Mul64(uint64(n), clocksrc.freq)
+	if hi >= second {
+		return ^uint64(0)
+	}
+	q, _ := bits.Div64(hi, lo, second)
+	if q > ^uint64(0)-clocksrc.base {
+		return ^uint64(0)
+	}
+	return q + clocksrc.base
+}
+
+//go:nosplit
+func invariantTSC() bool {
+	maxfn, _, _, _ := cpuid(0x80000000, 0)
+	if maxfn < _CPUID_FN_POWER {
+		return false
+	}
+	_, _, _, edx := cpuid(_CPUID_FN_POWER, 0)
+	return edx&_CPUID_EDX_INVARIANT_TSC != 0
+}
+
+// clocksourceInit selects the clocksource and calibrates the frequency of tsc
+// and local apic timer against HPET or PIT.
+// The invariant tsc is preferred, HPET is used if tsc is not stable.
+//go:nosplit
+func clocksourceInit() {
+	useHPET := hpet.Init()
+
+	const max = ^uint32(0)
+	apic.TimerStart(apic.VECTOR_TIMER, max, false)
+	tsc0 := sys.Rdtsc()
+	if useHPET {
+		h0 := hpet.Counter()
+		for hpet.Counter()-h0 < hpet.Freq()/_CALIBRATE_HZ {
+		}
+	} else {
+		pitWait(_PIT_HZ / _CALIBRATE_HZ)
+	}
+	tsc1 := sys.Rdtsc()
+	lapicFreq = uint64(max-apic.TimerCurrent()) * _CALIBRATE_HZ
+	apic.TimerStop()
+
+	c := &clocksrc
+	if useHPET && !invariantTSC() {
+		c.name = "hpet"
+		c.kind = _CLOCK_HPET
+		c.freq = hpet.Freq()
+		c.base = hpet.Counter()
+	} else {
+		c.name = "tsc"
+		c.kind = _CLOCK_TSC
+		c.freq = (tsc1 - tsc0) * _CALIBRATE_HZ
+		c.base = tsc0
+	}
+	c.mult = (second << 32) / c.freq
+
+	_, _, ecx, _ := cpuid(_CPUID_FN_STD, 0)
+	tscDeadline = c.kind == _CLOCK_TSC && ecx&_CPUID_ECX_TSC_DEADLINE != 0
+}
+
+//go:nosplit
+func vdsoClockgettime()
+
+//go:nosplit
+func vdsoDataPtr() *vdsoData {
+	return (*vdsoData)(unsafe.Pointer(uintptr(vdsoGettimeofdaySym + _VDSO_DATA_OFFSET)))
+}
+
+//go:linkname runtimeVdsoClockgettimeSym runtime.vdsoClockgettimeSym
+var runtimeVdsoClockgettimeSym uintptr
+
+// vdsoClockInit copies vdsoClockgettime to vdso page, and makes the go runtime use it,
+// the time is read without trapping into kernel if the clocksource is tsc.
+//go:nosplit
+func vdsoClockInit() {
+	dst := sys.UnsafeBuffer(vdsoGettimeofdaySym+_VDSO_CLOCK_GETTIME_OFFSET, _VDSO_CLOCK_GETTIME_MAXSIZE)
+	src := sys.UnsafeBuffer(sys.FuncPC(vdsoClockgettime), _VDSO_CLOCK_GETTIME_MAXSIZE)
+	copy(dst, src)
+
+	d := vdsoDataPtr()
+	d.base = clocksrc.base
+	if clocksrc.kind == _CLOCK_TSC {
+		d.mult = clocksrc.mult
+	}
+	runtimeVdsoClockgettimeSym = vdsoGettimeofdaySym + _VDSO_CLOCK_GETTIME_OFFSET
+}
+
+// setWallBase sets the unix time of boot time, called outside of trap
+func setWallBase(unixNano int64) {
+	wallBase = unixNano - nanosecond()
+	d := vdsoDataPtr()
+	atomic.AddUint32(&d.seq, 1)
+	d.wallBase = wallBase
+	atomic.AddUint32(&d.seq, 1)
+}
@@ -0,0 +1,55 @@
+package entropy
+
+import "math/bits"
+
+// "expand 32-byte k"
+const (
+	sigma0 = 0x61707865
+	sigma1 = 0x3320646e
+	sigma2 = 0x79622d32
+	sigma3 = 0x6b206574
+)
+
+//go:nosplit
+func quarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d ^= a
+	d = bits.RotateLeft32(d, 16)
+	c += d
+	b ^= c
+	b = bits.RotateLeft32(b, 12)
+	a += b
+	d ^= a
+	d = bits.RotateLeft32(d, 8)
+	c += d
+	b ^= c
+	b = bits.RotateLeft32(b, 7)
+	return a, b, c, d
+}
+
+// chachaBlock generates a ChaCha20 keystream block of key and counter, the nonce is zero.
+//go:nosplit
+func chachaBlock(out *[16]uint32, key *[8]uint32, counter uint64) {
+	in := [16]uint32{
+		sigma0, sigma1, sigma2, sigma3,
+		key[0], key[1], key[2], key[3],
+		key[4], key[5], key[6], key[7],
+		uint32(counter), uint32(counter >> 32), 0, 0,
+	}
+	x := in
+	for i := 0; i < 10; i++ {
+		// column rounds
+		x[0], x[4], x[8], x[12] = quarterRound(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = quarterRound(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = quarterRound(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = quarterRound(x[3], x[7], x[11], x[15])
+		// diagonal rounds
+		x[0], x[5], x[10], x[15] = quarterRound(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = quarterRound(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = quarterRound(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = quarterRound(x[3], x[4], x[9], x[14])
+	}
+	for i := range out {
+		out[i] = x[i] + in[i]
+	}
+}
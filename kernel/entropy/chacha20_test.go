@@ -0,0 +1,22 @@
+package entropy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"unsafe"
+)
+
+func TestChachaBlock(t *testing.T) {
+	// RFC 7539 A.1, test vector #1
+	var key [8]uint32
+	var block [16]uint32
+	chachaBlock(&block, &key, 0)
+	expect, _ := hex.DecodeString(
+		"76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7" +
+			"da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586")
+	got := (*[64]byte)(unsafe.Pointer(&block))[:]
+	if !bytes.Equal(got, expect) {
+		t.Fatalf("expect %x, got %x", expect, got)
+	}
+}
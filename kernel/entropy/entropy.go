@@ -0,0 +1,195 @@
+// Package entropy provides the random numbers of kernel.
+//
+// An entropy pool collects the noise from RDSEED/RDRAND, tsc jitter and
+// interrupt timing, and seeds a ChaCha20 DRBG which generates the output.
+// The key of DRBG is replaced after every output (fast key erasure),
+// so the previous output can't be recovered from the state.
+//
+// All functions are nosplit and can be called in trap and user context.
+package entropy
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+const (
+	_CPUID_ECX_RDRAND = 1 << 30
+	_CPUID_EBX_RDSEED = 1 << 18
+
+	_FLAGS_IF = 0x200
+
+	poolSize = 8
+	// reseed when enough samples are collected
+	reseedSamples = 64
+	// the max bytes generated in one lock holding
+	chunkSize = 256
+	// number of jitter samples when initializing
+	jitterRounds = 256
+)
+
+type state struct {
+	lock uint32
+
+	key     [8]uint32
+	counter uint64
+
+	pool    [poolSize]uint64
+	poolIdx int
+	samples int
+
+	hasRdrand bool
+	hasRdseed bool
+}
+
+var st state
+
+//go:nosplit
+func cpuid(fn, cx uint32) (eax, ebx, ecx, edx uint32)
+
+//go:nosplit
+func rdrand() (v uint64, ok bool)
+
+//go:nosplit
+func rdseed() (v uint64, ok bool)
+
+//go:nosplit
+func (s *state) acquire() uintptr {
+	flags := sys.Flags()
+	sys.Cli()
+	for !atomic.CompareAndSwapUint32(&s.lock, 0, 1) {
+		sys.Pause()
+	}
+	return flags
+}
+
+//go:nosplit
+func (s *state) release(flags uintptr) {
+	atomic.StoreUint32(&s.lock, 0)
+	if flags&_FLAGS_IF != 0 {
+		sys.Sti()
+	}
+}
+
+//go:nosplit
+func (s *state) mix(v uint64) {
+	p := &s.pool[s.poolIdx]
+	*p = bits.RotateLeft64(*p, 7) ^ (v * 0x9e3779b97f4a7c15)
+	s.poolIdx = (s.poolIdx + 1) % poolSize
+	s.samples++
+}
+
+// hwrand returns the random number from cpu, RDSEED is preferred
+//go:nosplit
+func (s *state) hwrand() (uint64, bool) {
+	// both instructions may fail transiently
+	for i := 0; i < 10; i++ {
+		if s.hasRdseed {
+			if v, ok := rdseed(); ok {
+				return v, true
+			}
+		}
+		if s.hasRdrand {
+			if v, ok := rdrand(); ok {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// rekey replaces the key with the next keystream block
+//go:nosplit
+func (s *state) rekey() {
+	var block [16]uint32
+	chachaBlock(&block, &s.key, s.counter)
+	s.counter++
+	copy(s.key[:], block[:8])
+}
+
+// reseed folds the entropy pool and the hardware random number into key
+//go:nosplit
+func (s *state) reseed() {
+	if v, ok := s.hwrand(); ok {
+		s.mix(v)
+	}
+	s.mix(sys.Rdtsc())
+	for i := range s.pool {
+		s.key[i] ^= uint32(s.pool[i]) ^ uint32(s.pool[i]>>32)
+	}
+	s.rekey()
+	s.samples = 0
+}
+
+// Init seeds the pool, it must be called before any Read.
+//go:nosplit
+func Init() {
+	_, _, ecx, _ := cpuid(1, 0)
+	st.hasRdrand = ecx&_CPUID_ECX_RDRAND != 0
+	maxfn, _, _, _ := cpuid(0, 0)
+	if maxfn >= 7 {
+		_, ebx, _, _ := cpuid(7, 0)
+		st.hasRdseed = ebx&_CPUID_EBX_RDSEED != 0
+	}
+
+	for i := 0; i < poolSize; i++ {
+		if v, ok := st.hwrand(); ok {
+			st.mix(v)
+		}
+	}
+	// the execution time of a loop varies with cache, tlb and
+	// interrupts of the host, which makes the low bits of tsc noisy.
+	var acc uint64
+	for i := 0; i < jitterRounds; i++ {
+		t0 := sys.Rdtsc()
+		for j := 0; j < i%16+1; j++ {
+			acc = bits.RotateLeft64(acc, 13) ^ uint64(j)
+		}
+		st.mix(sys.Rdtsc() - t0 ^ acc)
+	}
+	st.reseed()
+}
+
+// HasHardware reports whether RDSEED or RDRAND is available
+//go:nosplit
+func HasHardware() bool {
+	return st.hasRdrand || st.hasRdseed
+}
+
+// AddSample mixes the noise v into the entropy pool, eg. the tsc of interrupts.
+//go:nosplit
+func AddSample(v uint64) {
+	flags := st.acquire()
+	st.mix(v)
+	st.release(flags)
+}
+
+// Read fills b with random bytes, it never fails.
+//go:nosplit
+func Read(b []byte) int {
+	n := len(b)
+	for len(b) > 0 {
+		flags := st.acquire()
+		if st.samples >= reseedSamples {
+			st.reseed()
+		}
+		size := len(b)
+		if size > chunkSize {
+			size = chunkSize
+		}
+		var block [16]uint32
+		for off := 0; off < size; off += len(block) * 4 {
+			chachaBlock(&block, &st.key, st.counter)
+			st.counter++
+			buf := (*[64]byte)(unsafe.Pointer(&block))
+			copy(b[off:size], buf[:])
+		}
+		st.rekey()
+		st.release(flags)
+		b = b[size:]
+	}
+	return n
+}
@@ -0,0 +1,26 @@
+#include "textflag.h"
+
+// cpuid(fn, cx uint32) (ax, bx, cx, dx uint32) - CPU Identification.
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL fn+0(FP), AX
+	MOVL cx+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// rdrand() (uint64, bool)
+TEXT ·rdrand(SB), NOSPLIT, $0-9
+	RDRANDQ AX
+	MOVQ    AX, v+0(FP)
+	SETCS   ok+8(FP)
+	RET
+
+// rdseed() (uint64, bool)
+TEXT ·rdseed(SB), NOSPLIT, $0-9
+	RDSEEDQ AX
+	MOVQ    AX, v+0(FP)
+	SETCS   ok+8(FP)
+	RET
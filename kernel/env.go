@@ -46,7 +46,6 @@ func prepareArgs(sp uintptr) {
 	envput(&buf, 0)
 
 	envTerm := envptr(&buf)
-	envGoDebug := envptr(&buf)
 	putKernelArgs(&buf)
 	// end of env
 	envput(&buf, 0)
@@ -59,7 +58,6 @@ func prepareArgs(sp uintptr) {
 
 	*arg0 = envdup(&buf, "eggos\x00")
 	*envTerm = envdup(&buf, "TERM=xterm\x00")
-	*envGoDebug = envdup(&buf, "GODEBUG=asyncpreemptoff=1\x00")
 }
 
 //go:nosplit
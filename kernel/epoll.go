@@ -11,137 +11,333 @@ import (
 )
 
 const (
+	// the epoll fd created before fs is ready, eg. the netpoll of go runtime
 	epollFd = 3
 
-	maxFds = 1024
+	_EPOLLEXCLUSIVE = 1 << 28
+	_EPOLLONESHOT   = 1 << 30
+	_EPOLLET        = 1 << 31
+
+	// events always reported
+	_EPOLL_ALWAYS = syscall.EPOLLHUP | syscall.EPOLLERR
 )
 
 var (
-	// source of fd events, set by netstack
-	// cleared by epoll_wait
-	fdevents [maxFds]uint32
-
-	// to manage epoll event
+	// to manage epoll instances and items
 	eventpool mm.Pool
-
-	// header of registered epoll events
-	epollEvents epollEvent
-
-	// notify of epoll events
-	epollNote note
+	itempool  mm.Pool
 )
 
+// eventpoll is an epoll instance
+//go:notinheap
+type eventpoll struct {
+	// the interest list
+	items *epitem
+	// increased on every event of the interest list,
+	// threads in epoll_wait sleep on it.
+	seq uint32
+}
+
+// epitem is a fd registered to an epoll instance, it's linked
+// in the interest list of epoll and the watcher list of fd.
 //go:notinheap
-type epollEvent struct {
+type epitem struct {
+	ep  *eventpoll
 	fd  uintptr
 	sub linux.EpollEvent
 
-	pre, next *epollEvent
+	// events happened since last reported, used by EPOLLET
+	pending uint32
+	// set after reported if EPOLLONESHOT, until EPOLL_CTL_MOD
+	disabled bool
+
+	pre, next     *epitem
+	fdPre, fdNext *epitem
+}
+
+// epollOf returns the epoll instance of epfd, nil if epfd is not an epoll fd
+//go:nosplit
+func epollOf(epfd uintptr) *eventpoll {
+	f := fdOf(epfd)
+	if f == nil {
+		return nil
+	}
+	return f.ep
+}
+
+//go:nosplit
+func epollCreate(epfd int) syscall.Errno {
+	if epfd < 0 {
+		return syscall.EBADF
+	}
+	f := fdAlloc(uintptr(epfd))
+	if f == nil {
+		return syscall.EMFILE
+	}
+	if f.ep != nil {
+		return syscall.EBADF
+	}
+	f.ep = (*eventpoll)(unsafe.Pointer(eventpool.Alloc()))
+	return 0
+}
+
+//go:nosplit
+func freeEventpoll(ep *eventpoll) {
+	for ep.items != nil {
+		freeEpitem(ep.items)
+	}
+	// threads in epoll_wait find the fd closed
+	epollWake(ep, -1)
+	eventpool.Free(uintptr(unsafe.Pointer(ep)))
 }
 
 //go:nosplit
-func newEpollEvent() *epollEvent {
-	ptr := eventpool.Alloc()
-	e := (*epollEvent)(unsafe.Pointer(ptr))
-	e.pre = &epollEvents
-	e.next = epollEvents.next
-	if epollEvents.next != nil {
-		epollEvents.next.pre = e
+func newEpitem(ep *eventpoll, fd uintptr, f *fdEntry) *epitem {
+	it := (*epitem)(unsafe.Pointer(itempool.Alloc()))
+	it.ep = ep
+	it.fd = fd
+	it.next = ep.items
+	if ep.items != nil {
+		ep.items.pre = it
+	}
+	ep.items = it
+	it.fdNext = f.items
+	if f.items != nil {
+		f.items.fdPre = it
 	}
-	epollEvents.next = e
-	return e
+	f.items = it
+	return it
 }
 
 //go:nosplit
-func freeEpollEvent(e *epollEvent) {
-	e.pre.next = e.next
-	if e.next != nil {
-		e.next.pre = e.pre
+func freeEpitem(it *epitem) {
+	if it.pre != nil {
+		it.pre.next = it.next
+	} else {
+		it.ep.items = it.next
+	}
+	if it.next != nil {
+		it.next.pre = it.pre
+	}
+	if it.fdPre != nil {
+		it.fdPre.fdNext = it.fdNext
+	} else {
+		fdOf(it.fd).items = it.fdNext
 	}
-	eventpool.Free(uintptr(unsafe.Pointer(e)))
+	if it.fdNext != nil {
+		it.fdNext.fdPre = it.fdPre
+	}
+	itempool.Free(uintptr(unsafe.Pointer(it)))
 }
 
 //go:nosplit
-func findEpollEvent(fd uintptr) *epollEvent {
-	for e := epollEvents.next; e != nil; e = e.next {
-		if e.fd == fd {
-			return e
+func findEpitem(ep *eventpoll, fd uintptr) *epitem {
+	for it := ep.items; it != nil; it = it.next {
+		if it.fd == fd {
+			return it
 		}
 	}
 	return nil
 }
 
+// epollWake wakes at most n threads waiting on ep, n < 0 means all threads.
+//go:nosplit
+func epollWake(ep *eventpoll, n int) int {
+	ep.seq++
+	return waitqWake(uintptr(unsafe.Pointer(&ep.seq)), n, _WAIT_BITS_ANY)
+}
+
 //go:nosplit
 func epollCtl(epfd, op, fd, desc uintptr) uintptr {
+	// the event is read before any other check like linux
+	if op != syscall.EPOLL_CTL_DEL && desc == 0 {
+		return isyscall.Errno(errno.EFAULT)
+	}
+	ep := epollOf(epfd)
+	if ep == nil {
+		return isyscall.Errno(errno.EBADF)
+	}
+	if fd == epfd {
+		return isyscall.Errno(errno.EINVAL)
+	}
+	f := fdAlloc(fd)
+	if f == nil {
+		return isyscall.Errno(errno.EBADF)
+	}
 	euser := (*linux.EpollEvent)(unsafe.Pointer(desc))
-	var e *epollEvent
+	it := findEpitem(ep, fd)
 	switch op {
 	case syscall.EPOLL_CTL_ADD:
-		e = findEpollEvent(fd)
-		if e == nil {
-			e = newEpollEvent()
+		if it != nil {
+			return isyscall.Errno(errno.EEXIST)
 		}
-		e.fd = fd
-		e.sub = *euser
-		e.sub.Events |= syscall.EPOLLHUP
-		return 0
+		it = newEpitem(ep, fd, f)
 	case syscall.EPOLL_CTL_MOD:
-		e = findEpollEvent(fd)
-		if e == nil {
+		if it == nil {
+			return isyscall.Errno(errno.ENOENT)
+		}
+		if euser.Events&_EPOLLEXCLUSIVE != 0 || it.sub.Events&_EPOLLEXCLUSIVE != 0 {
 			return isyscall.Errno(errno.EINVAL)
 		}
-		e.sub = *euser
-		e.sub.Events |= syscall.EPOLLHUP
-		return 0
 	case syscall.EPOLL_CTL_DEL:
-		e = findEpollEvent(fd)
-		if e == nil {
-			return isyscall.Errno(errno.EINVAL)
+		if it == nil {
+			return isyscall.Errno(errno.ENOENT)
 		}
-		freeEpollEvent(e)
+		freeEpitem(it)
 		return 0
 	default:
 		return isyscall.Errno(errno.EINVAL)
 	}
+	it.sub = *euser
+	it.sub.Events |= _EPOLL_ALWAYS
+	it.disabled = false
+	// the current state is reported as an edge
+	it.pending = fdPoll(fd)
+	if it.pending&it.sub.Events != 0 {
+		epollWake(ep, -1)
+	}
+	return 0
 }
 
+// epollCollect fills events with the ready items of ep
 //go:nosplit
-func epollWait(epfd, eventptr, len, _ms uintptr) uintptr {
-	if _ms != 0 {
-		ts := linux.Timespec{
-			Sec:  int64(_ms / 1000),
-			Nsec: int64(_ms%1000) * ms,
+func epollCollect(ep *eventpoll, events []linux.EpollEvent) int {
+	cnt := 0
+	for it := ep.items; it != nil && cnt < len(events); it = it.next {
+		if it.disabled {
+			continue
 		}
-		// wait fd event
-		epollNote.sleep(&ts)
-		epollNote.clear()
-	}
-
-	events := (*[256]linux.EpollEvent)(unsafe.Pointer(eventptr))[:len]
-	var cnt uintptr = 0
-	for e := epollEvents.next; e != nil && cnt < len; e = e.next {
-		event := fdevents[e.fd]
-		if event == 0 {
+		if it.sub.Events&_EPOLLET != 0 {
+			if it.pending == 0 {
+				continue
+			}
+			it.pending = 0
+		}
+		ready := fdPoll(it.fd) & it.sub.Events
+		if ready == 0 {
 			continue
 		}
 		ue := &events[cnt]
-		ue.Data = e.sub.Data
-		ue.Events = event & e.sub.Events
-		// clear events
-		// FIXME: only clear masked events?
-		fdevents[e.fd] = 0
+		ue.Data = it.sub.Data
+		ue.Events = ready
+		if it.sub.Events&_EPOLLONESHOT != 0 {
+			it.disabled = true
+		}
 		cnt++
 	}
 	return cnt
 }
 
+// epollWait waits events of epfd, timeout is in millisecond,
+// negative timeout means wait forever.
+//go:nosplit
+func epollWait(epfd, eventptr uintptr, n int, timeout int) uintptr {
+	ep := epollOf(epfd)
+	if ep == nil {
+		return isyscall.Errno(errno.EBADF)
+	}
+	if n <= 0 {
+		return isyscall.Errno(errno.EINVAL)
+	}
+	events := (*[1 << 20]linux.EpollEvent)(unsafe.Pointer(eventptr))[:n:n]
+	var deadline int64
+	if timeout > 0 {
+		deadline = nanosecond() + int64(timeout)*ms
+	}
+	for {
+		seq := ep.seq
+		cnt := epollCollect(ep, events)
+		if cnt > 0 || timeout == 0 {
+			return uintptr(cnt)
+		}
+		if futexWait(&ep.seq, seq, deadline, _WAIT_BITS_ANY) == syscall.ETIMEDOUT {
+			return 0
+		}
+		// closed by another thread
+		if epollOf(epfd) != ep {
+			return isyscall.Errno(errno.EBADF)
+		}
+	}
+}
+
+// fdNotify wakes the epoll instances watching fd when events happen on fd
+//go:nosplit
+func fdNotify(fd uintptr, events uint32) {
+	f := fdOf(fd)
+	if f == nil {
+		return
+	}
+	exclusiveWoken := false
+	for it := f.items; it != nil; it = it.fdNext {
+		if it.disabled || it.sub.Events&events == 0 {
+			continue
+		}
+		it.pending |= events
+		if it.sub.Events&_EPOLLEXCLUSIVE == 0 {
+			epollWake(it.ep, -1)
+			continue
+		}
+		// wake one thread of the epoll instances with EPOLLEXCLUSIVE
+		if !exclusiveWoken && epollWake(it.ep, 1) > 0 {
+			exclusiveWoken = true
+		}
+	}
+}
+
+// epollNotify sets the ready events of fd, eg. socket
 //go:nosplit
 func epollNotify(fd, events uintptr) {
-	fdevents[fd] |= uint32(events)
-	epollNote.wakeup()
+	f := fdAlloc(fd)
+	if f == nil {
+		return
+	}
+	f.ready |= uint32(events)
+	fdNotify(fd, uint32(events))
+}
+
+// epollClear clears the ready events of fd, eg. read returns EAGAIN
+//go:nosplit
+func epollClear(fd, events uintptr) {
+	f := fdOf(fd)
+	if f == nil {
+		return
+	}
+	f.ready &^= uint32(events)
+}
+
+// lockedEpollNotify is the version of epollNotify called outside of trap, eg. by netstack.
+//go:nosplit
+func lockedEpollNotify(fd, events uintptr) {
+	flags := pushcli()
+	klock.lock()
+	epollNotify(fd, events)
+	klock.unlock()
+	popcli(flags)
+}
+
+// lockedEpollClear is the version of epollClear called outside of trap
+//go:nosplit
+func lockedEpollClear(fd, events uintptr) {
+	flags := pushcli()
+	klock.lock()
+	epollClear(fd, events)
+	klock.unlock()
+	popcli(flags)
+}
+
+// lockedEpollCreate binds the fd allocated by fs to a new epoll instance
+//go:nosplit
+func lockedEpollCreate(epfd int) syscall.Errno {
+	flags := pushcli()
+	klock.lock()
+	errno := epollCreate(epfd)
+	klock.unlock()
+	popcli(flags)
+	return errno
 }
 
 //go:nosplit
 func epollInit() {
-	mm.PoolInit(&eventpool, unsafe.Sizeof(epollEvent{}))
+	mm.PoolInit(&eventpool, unsafe.Sizeof(eventpoll{}))
+	mm.PoolInit(&itempool, unsafe.Sizeof(epitem{}))
 }
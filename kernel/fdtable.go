@@ -0,0 +1,103 @@
+package kernel
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/mm"
+)
+
+const (
+	_FD_CHUNK_SIZE = 256
+	_MAX_FD_CHUNKS = 256
+
+	// the max fd known by kernel
+	maxFds = _FD_CHUNK_SIZE * _MAX_FD_CHUNKS
+)
+
+// fdEntry is the kernel state of a fd, the fd number is allocated by fs.
+type fdEntry struct {
+	// the pipe end if fd is a pipe
+	pipe pipeEnd
+	// the epoll instance if fd is an epoll fd
+	ep *eventpoll
+	// ready events reported by epollNotify, used by the files
+	// whose state is not known by kernel, eg. socket
+	ready uint32
+	// epoll items watching fd
+	items *epitem
+}
+
+type fdChunk [_FD_CHUNK_SIZE]fdEntry
+
+var (
+	// chunks of fd table, allocated on demand
+	fdChunks [_MAX_FD_CHUNKS]uintptr
+)
+
+// fdOf returns the entry of fd, nil if fd is out of range or the chunk is not allocated
+//go:nosplit
+func fdOf(fd uintptr) *fdEntry {
+	if fd >= maxFds || fdChunks[fd/_FD_CHUNK_SIZE] == 0 {
+		return nil
+	}
+	chunk := (*fdChunk)(unsafe.Pointer(fdChunks[fd/_FD_CHUNK_SIZE]))
+	return &chunk[fd%_FD_CHUNK_SIZE]
+}
+
+// fdAlloc is like fdOf, but allocates the chunk if needed
+//go:nosplit
+func fdAlloc(fd uintptr) *fdEntry {
+	if fd >= maxFds {
+		return nil
+	}
+	idx := fd / _FD_CHUNK_SIZE
+	if fdChunks[idx] == 0 {
+		// mmap clears the memory
+		fdChunks[idx] = mm.Mmap(0, unsafe.Sizeof(fdChunk{}))
+	}
+	return fdOf(fd)
+}
+
+// fdPoll returns the ready events of fd
+//go:nosplit
+func fdPoll(fd uintptr) uint32 {
+	f := fdOf(fd)
+	if f == nil {
+		return 0
+	}
+	if f.pipe.p != nil {
+		return pipePoll(&f.pipe)
+	}
+	return f.ready
+}
+
+// fdClose releases the kernel state of fd
+//go:nosplit
+func fdClose(fd uintptr) {
+	f := fdOf(fd)
+	if f == nil {
+		return
+	}
+	// closed fd is removed from all epoll instances
+	for f.items != nil {
+		freeEpitem(f.items)
+	}
+	if f.pipe.p != nil {
+		pipeClose(&f.pipe)
+	}
+	if ep := f.ep; ep != nil {
+		f.ep = nil
+		freeEventpoll(ep)
+	}
+	f.ready = 0
+}
+
+// lockedFdClose is called by fs when fd is closed
+//go:nosplit
+func lockedFdClose(fd int) {
+	flags := pushcli()
+	klock.lock()
+	fdClose(uintptr(fd))
+	klock.unlock()
+	popcli(flags)
+}
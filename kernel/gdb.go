@@ -0,0 +1,143 @@
+package kernel
+
+import (
+	"github.com/icexin/eggos/kernel/gdbstub"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+	"github.com/icexin/eggos/kernel/trap"
+)
+
+// The gdb stub runs in trap context of the trapped thread with kernel lock held,
+// other cpus are not stopped but block on kernel lock at their next trap.
+// The registers of threads are read from their last trap frames,
+// which are stale for the threads running on other cpus.
+
+var gdbTarget = gdbstub.Target{
+	Threads:     gdbThreads,
+	ThreadState: gdbThreadState,
+	GetRegs:     gdbGetRegs,
+	SetRegs:     gdbSetRegs,
+	Mapped:      mm.Present,
+}
+
+// gdbThread returns the live thread of tid, nil if not found
+//go:nosplit
+func gdbThread(tid int) *Thread {
+	t := threadByID(tid)
+	if t == nil || t.tf == nil {
+		return nil
+	}
+	return t
+}
+
+//go:nosplit
+func gdbThreads(ids []int) int {
+	n := 0
+	for i := 0; i < nthreads && n < len(ids); i++ {
+		if gdbThread(i) == nil {
+			continue
+		}
+		ids[n] = i
+		n++
+	}
+	return n
+}
+
+//go:nosplit
+func gdbThreadState(tid int) string {
+	t := gdbThread(tid)
+	if t == nil {
+		return "dead"
+	}
+	return t.stateName()
+}
+
+//go:nosplit
+func gdbGetRegs(tid int, r *gdbstub.Regs) bool {
+	t := gdbThread(tid)
+	if t == nil {
+		return false
+	}
+	tf := t.tf
+	r[gdbstub.RAX] = uint64(tf.AX)
+	r[gdbstub.RBX] = uint64(tf.BX)
+	r[gdbstub.RCX] = uint64(tf.CX)
+	r[gdbstub.RDX] = uint64(tf.DX)
+	r[gdbstub.RSI] = uint64(tf.SI)
+	r[gdbstub.RDI] = uint64(tf.DI)
+	r[gdbstub.RBP] = uint64(tf.BP)
+	r[gdbstub.RSP] = uint64(tf.SP)
+	r[gdbstub.R8] = uint64(tf.R8)
+	r[gdbstub.R9] = uint64(tf.R9)
+	r[gdbstub.R10] = uint64(tf.R10)
+	r[gdbstub.R11] = uint64(tf.R11)
+	r[gdbstub.R12] = uint64(tf.R12)
+	r[gdbstub.R13] = uint64(tf.R13)
+	r[gdbstub.R14] = uint64(tf.R14)
+	r[gdbstub.R15] = uint64(tf.R15)
+	r[gdbstub.RIP] = uint64(tf.IP)
+	r[gdbstub.EFLAGS] = uint64(tf.FLAGS)
+	r[gdbstub.CS] = uint64(tf.CS)
+	r[gdbstub.SS] = uint64(tf.SS)
+	r[gdbstub.DS] = uint64(tf.SS)
+	r[gdbstub.ES] = uint64(tf.SS)
+	r[gdbstub.FS] = 0
+	r[gdbstub.GS] = 0
+	return true
+}
+
+// gdbSetRegs writes the general registers, the segment registers are ignored
+//go:nosplit
+func gdbSetRegs(tid int, r *gdbstub.Regs) bool {
+	t := gdbThread(tid)
+	if t == nil {
+		return false
+	}
+	tf := t.tf
+	tf.AX = uintptr(r[gdbstub.RAX])
+	tf.BX = uintptr(r[gdbstub.RBX])
+	tf.CX = uintptr(r[gdbstub.RCX])
+	tf.DX = uintptr(r[gdbstub.RDX])
+	tf.SI = uintptr(r[gdbstub.RSI])
+	tf.DI = uintptr(r[gdbstub.RDI])
+	tf.BP = uintptr(r[gdbstub.RBP])
+	tf.SP = uintptr(r[gdbstub.RSP])
+	tf.R8 = uintptr(r[gdbstub.R8])
+	tf.R9 = uintptr(r[gdbstub.R9])
+	tf.R10 = uintptr(r[gdbstub.R10])
+	tf.R11 = uintptr(r[gdbstub.R11])
+	tf.R12 = uintptr(r[gdbstub.R12])
+	tf.R13 = uintptr(r[gdbstub.R13])
+	tf.R14 = uintptr(r[gdbstub.R14])
+	tf.R15 = uintptr(r[gdbstub.R15])
+	tf.IP = uintptr(r[gdbstub.RIP])
+	// IOPL and the other system flags can't be changed
+	tf.FLAGS = tf.FLAGS&^_FLAGS_USER | uintptr(r[gdbstub.EFLAGS])&_FLAGS_USER
+	return true
+}
+
+// gdbTrap handles #DB and #BP
+//go:nosplit
+func gdbTrap() {
+	gdbstub.Trap(Mythread().id, gdbstub.SIGTRAP)
+}
+
+// gdbPoll is called by timer interrupt to check Ctrl-C from gdb,
+// so Ctrl-C is noticed at the next timer interrupt of any cpu.
+//go:nosplit
+func gdbPoll() {
+	if gdbstub.Interrupted() {
+		gdbstub.Trap(Mythread().id, gdbstub.SIGINT)
+	}
+}
+
+//go:nosplit
+func gdbInit() {
+	if !gdbstub.Init(&gdbTarget) {
+		return
+	}
+	trap.Register(1, gdbTrap)
+	trap.Register(3, gdbTrap)
+	// threads run in ring 3, int3 needs a user gate
+	setIdtDesc(&idt[3], sys.FuncPC(vectors[3]), segDplUser)
+}
@@ -0,0 +1,532 @@
+// Package gdbstub implements the GDB remote serial protocol on COM2,
+// which makes the kernel debuggable on real hardware.
+//
+// The stub is entered on #BP and #DB traps, or when Ctrl-C is received,
+// and serves gdb until it continues or steps. Kernel threads are reported as gdb threads,
+// the gdb thread id is the kernel thread id plus one, since zero means any thread in gdb.
+//
+// Usage:
+//
+//	(gdb) target remote /dev/ttyS1
+//
+// All functions are nosplit and called in trap context with kernel lock held.
+package gdbstub
+
+import "unsafe"
+
+// register numbers of amd64 in gdb
+const (
+	RAX = iota
+	RBX
+	RCX
+	RDX
+	RSI
+	RDI
+	RBP
+	RSP
+	R8
+	R9
+	R10
+	R11
+	R12
+	R13
+	R14
+	R15
+	RIP
+	EFLAGS
+	CS
+	SS
+	DS
+	ES
+	FS
+	GS
+	NumRegs
+)
+
+// signals reported to gdb
+const (
+	SIGINT  = 2
+	SIGTRAP = 5
+)
+
+const (
+	_FLAGS_TF = 0x100
+
+	bufSize = 4096
+	pgsize  = 4096
+)
+
+// Regs is the register file in gdb order
+type Regs [NumRegs]uint64
+
+// Target is the interface of kernel, it must be filled before Init.
+type Target struct {
+	// Threads fills ids with the ids of live threads and returns the number of threads
+	Threads func(ids []int) int
+	// ThreadState returns the state of thread, eg. "running"
+	ThreadState func(tid int) string
+	// GetRegs reads the registers of thread, it returns false if tid is invalid
+	GetRegs func(tid int, regs *Regs) bool
+	// SetRegs writes the registers of thread, it returns false if tid is invalid
+	SetRegs func(tid int, regs *Regs) bool
+	// Mapped reports whether the page of addr can be accessed
+	Mapped func(addr uintptr) bool
+}
+
+type stub struct {
+	target  *Target
+	enabled bool
+	// gdb is waiting for the stop reply of continue or step
+	waiting bool
+
+	// the thread trapped into stub
+	cur int
+	// the thread selected by Hg
+	sel int
+	sig int
+
+	in   [bufSize]byte
+	out  [bufSize]byte
+	nout int
+
+	threads [bufSize / 8]int
+	nthread int
+	// cursor of qsThreadInfo
+	tidx int
+
+	regs Regs
+}
+
+var s stub
+
+const hexdigits = "0123456789abcdef"
+
+// Init sets up COM2 for gdb, it returns false if COM2 is absent.
+//go:nosplit
+func Init(t *Target) bool {
+	if !serialInit() {
+		return false
+	}
+	s.target = t
+	s.enabled = true
+	return true
+}
+
+// Enabled reports whether the stub is available
+//go:nosplit
+func Enabled() bool {
+	return s.enabled
+}
+
+// Interrupted polls COM2 and reports whether gdb sends Ctrl-C,
+// the other bytes received while running are dropped.
+//go:nosplit
+func Interrupted() bool {
+	if !s.enabled {
+		return false
+	}
+	for hasInput() {
+		if getc() == 0x03 {
+			return true
+		}
+	}
+	return false
+}
+
+// Trap serves gdb until it resumes the thread, tid is the trapped thread,
+// sig is the signal reported to gdb.
+//go:nosplit
+func Trap(tid int, sig int) {
+	if !s.enabled {
+		return
+	}
+	s.cur = tid
+	s.sel = tid
+	s.sig = sig
+	if s.waiting {
+		s.waiting = false
+		s.stopReply()
+	}
+	for {
+		n := s.recvPacket()
+		if s.handle(s.in[:n]) {
+			return
+		}
+	}
+}
+
+//go:nosplit
+func (s *stub) recvPacket() int {
+	for {
+		// wait for the start of packet, Ctrl-C and acks are ignored
+		for getc() != '$' {
+		}
+		n := 0
+		var sum byte
+		for {
+			ch := getc()
+			if ch == '#' {
+				break
+			}
+			if n < len(s.in) {
+				s.in[n] = ch
+				n++
+			}
+			sum += ch
+		}
+		hi, ok1 := unhex(getc())
+		lo, ok2 := unhex(getc())
+		if ok1 && ok2 && byte(hi<<4|lo) == sum {
+			putc('+')
+			return n
+		}
+		putc('-')
+	}
+}
+
+//go:nosplit
+func (s *stub) sendPacket() {
+	for {
+		putc('$')
+		var sum byte
+		for i := 0; i < s.nout; i++ {
+			putc(s.out[i])
+			sum += s.out[i]
+		}
+		putc('#')
+		putc(hexdigits[sum>>4])
+		putc(hexdigits[sum&0xf])
+		// wait for ack
+		ch := getc()
+		for ch != '+' && ch != '-' {
+			ch = getc()
+		}
+		if ch == '+' {
+			break
+		}
+	}
+	s.nout = 0
+}
+
+//go:nosplit
+func (s *stub) putByte(b byte) {
+	if s.nout < len(s.out) {
+		s.out[s.nout] = b
+		s.nout++
+	}
+}
+
+//go:nosplit
+func (s *stub) putStr(str string) {
+	for i := 0; i < len(str); i++ {
+		s.putByte(str[i])
+	}
+}
+
+//go:nosplit
+func (s *stub) putHexByte(b byte) {
+	s.putByte(hexdigits[b>>4])
+	s.putByte(hexdigits[b&0xf])
+}
+
+// putHex writes v in big endian hex without leading zeros
+//go:nosplit
+func (s *stub) putHex(v uint64) {
+	shift := 60
+	for shift > 0 && (v>>uint(shift))&0xf == 0 {
+		shift -= 4
+	}
+	for ; shift >= 0; shift -= 4 {
+		s.putByte(hexdigits[(v>>uint(shift))&0xf])
+	}
+}
+
+// putHexLE writes the low size bytes of v in little endian hex, the format of registers
+//go:nosplit
+func (s *stub) putHexLE(v uint64, size int) {
+	for i := 0; i < size; i++ {
+		s.putHexByte(byte(v >> uint(i*8)))
+	}
+}
+
+//go:nosplit
+func (s *stub) reply(str string) {
+	s.putStr(str)
+	s.sendPacket()
+}
+
+//go:nosplit
+func (s *stub) stopReply() {
+	s.putByte('T')
+	s.putHexByte(byte(s.sig))
+	s.putStr("thread:")
+	s.putHex(uint64(s.cur + 1))
+	s.putByte(';')
+	s.sendPacket()
+}
+
+//go:nosplit
+func unhex(ch byte) (uint64, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return uint64(ch - '0'), true
+	case ch >= 'a' && ch <= 'f':
+		return uint64(ch - 'a' + 10), true
+	case ch >= 'A' && ch <= 'F':
+		return uint64(ch - 'A' + 10), true
+	}
+	return 0, false
+}
+
+// parseHex parses the hex number at the beginning of b,
+// it returns the number and the rest of b.
+//go:nosplit
+func parseHex(b []byte) (uint64, []byte) {
+	var v uint64
+	i := 0
+	for ; i < len(b); i++ {
+		d, ok := unhex(b[i])
+		if !ok {
+			break
+		}
+		v = v<<4 | d
+	}
+	return v, b[i:]
+}
+
+// parseHexLE parses size bytes in little endian hex
+//go:nosplit
+func parseHexLE(b []byte, size int) (uint64, []byte) {
+	var v uint64
+	for i := 0; i < size && len(b) >= 2; i++ {
+		hi, _ := unhex(b[0])
+		lo, _ := unhex(b[1])
+		v |= (hi<<4 | lo) << uint(i*8)
+		b = b[2:]
+	}
+	return v, b
+}
+
+// parseTid parses the gdb thread id, -1 and 0 mean the current thread
+//go:nosplit
+func (s *stub) parseTid(b []byte) int {
+	if len(b) > 0 && b[0] == '-' {
+		return s.cur
+	}
+	v, _ := parseHex(b)
+	if v == 0 {
+		return s.cur
+	}
+	return int(v) - 1
+}
+
+// skipSep skips the separator at the beginning of b
+//go:nosplit
+func skipSep(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	return b[1:]
+}
+
+//go:nosplit
+func hasPrefix(b []byte, prefix string) bool {
+	if len(b) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		if b[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//go:nosplit
+func regSize(n int) int {
+	if n < EFLAGS {
+		return 8
+	}
+	return 4
+}
+
+// accessible reports whether all pages in [addr, addr+n) are mapped
+//go:nosplit
+func (s *stub) accessible(addr, n uintptr) bool {
+	if n == 0 {
+		return true
+	}
+	if addr+n < addr {
+		return false
+	}
+	for p := addr &^ (pgsize - 1); p < addr+n; p += pgsize {
+		if !s.target.Mapped(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// handle handles a packet, it returns true if the thread should resume
+//go:nosplit
+func (s *stub) handle(pkt []byte) bool {
+	if len(pkt) == 0 {
+		s.reply("")
+		return false
+	}
+	t := s.target
+	args := pkt[1:]
+	switch pkt[0] {
+	case '?':
+		s.stopReply()
+	case 'g':
+		if !t.GetRegs(s.sel, &s.regs) {
+			s.reply("E01")
+			break
+		}
+		for i := 0; i < NumRegs; i++ {
+			s.putHexLE(s.regs[i], regSize(i))
+		}
+		s.sendPacket()
+	case 'G':
+		if !t.GetRegs(s.sel, &s.regs) {
+			s.reply("E01")
+			break
+		}
+		for i := 0; i < NumRegs && len(args) > 0; i++ {
+			s.regs[i], args = parseHexLE(args, regSize(i))
+		}
+		t.SetRegs(s.sel, &s.regs)
+		s.reply("OK")
+	case 'p':
+		n, _ := parseHex(args)
+		if n >= NumRegs || !t.GetRegs(s.sel, &s.regs) {
+			s.reply("E01")
+			break
+		}
+		s.putHexLE(s.regs[n], regSize(int(n)))
+		s.sendPacket()
+	case 'P':
+		n, rest := parseHex(args)
+		if n >= NumRegs || len(rest) == 0 || rest[0] != '=' || !t.GetRegs(s.sel, &s.regs) {
+			s.reply("E01")
+			break
+		}
+		s.regs[n], _ = parseHexLE(rest[1:], regSize(int(n)))
+		t.SetRegs(s.sel, &s.regs)
+		s.reply("OK")
+	case 'm':
+		addr, rest := parseHex(args)
+		n, _ := parseHex(skipSep(rest))
+		if n > bufSize/2 || !s.accessible(uintptr(addr), uintptr(n)) {
+			s.reply("E14")
+			break
+		}
+		for i := uintptr(0); i < uintptr(n); i++ {
+			s.putHexByte(*(*byte)(unsafe.Pointer(uintptr(addr) + i)))
+		}
+		s.sendPacket()
+	case 'M':
+		addr, rest := parseHex(args)
+		n, rest := parseHex(skipSep(rest))
+		if len(rest) == 0 || uint64(len(rest)-1) < n*2 || !s.accessible(uintptr(addr), uintptr(n)) {
+			s.reply("E14")
+			break
+		}
+		rest = rest[1:]
+		for i := uintptr(0); i < uintptr(n); i++ {
+			var b uint64
+			b, rest = parseHexLE(rest, 1)
+			*(*byte)(unsafe.Pointer(uintptr(addr) + i)) = byte(b)
+		}
+		s.reply("OK")
+	case 'c', 's':
+		if t.GetRegs(s.cur, &s.regs) {
+			if len(args) > 0 {
+				s.regs[RIP], _ = parseHex(args)
+			}
+			if pkt[0] == 's' {
+				s.regs[EFLAGS] |= _FLAGS_TF
+			} else {
+				s.regs[EFLAGS] &^= _FLAGS_TF
+			}
+			t.SetRegs(s.cur, &s.regs)
+		}
+		s.waiting = true
+		return true
+	case 'D':
+		if t.GetRegs(s.cur, &s.regs) {
+			s.regs[EFLAGS] &^= _FLAGS_TF
+			t.SetRegs(s.cur, &s.regs)
+		}
+		s.reply("OK")
+		return true
+	case 'k':
+		return true
+	case 'H':
+		if len(args) > 0 && args[0] == 'g' {
+			s.sel = s.parseTid(args[1:])
+		}
+		s.reply("OK")
+	case 'T':
+		if t.GetRegs(s.parseTid(args), &s.regs) {
+			s.reply("OK")
+		} else {
+			s.reply("E01")
+		}
+	case 'q':
+		s.handleQuery(args)
+	default:
+		// unsupported
+		s.reply("")
+	}
+	return false
+}
+
+//go:nosplit
+func (s *stub) handleQuery(q []byte) {
+	t := s.target
+	switch {
+	case hasPrefix(q, "Supported"):
+		s.reply("PacketSize=1000")
+	case hasPrefix(q, "Attached"):
+		s.reply("1")
+	case hasPrefix(q, "C"):
+		s.putStr("QC")
+		s.putHex(uint64(s.cur + 1))
+		s.sendPacket()
+	case hasPrefix(q, "fThreadInfo"):
+		s.nthread = t.Threads(s.threads[:])
+		s.tidx = 0
+		s.threadInfo()
+	case hasPrefix(q, "sThreadInfo"):
+		s.threadInfo()
+	case hasPrefix(q, "ThreadExtraInfo,"):
+		tid := s.parseTid(q[len("ThreadExtraInfo,"):])
+		state := t.ThreadState(tid)
+		for i := 0; i < len(state); i++ {
+			s.putHexByte(state[i])
+		}
+		s.sendPacket()
+	default:
+		s.reply("")
+	}
+}
+
+// threadInfo replies a part of thread list
+//go:nosplit
+func (s *stub) threadInfo() {
+	if s.tidx >= s.nthread {
+		s.reply("l")
+		return
+	}
+	s.putByte('m')
+	for n := 0; s.tidx < s.nthread && n < 64; n++ {
+		if n > 0 {
+			s.putByte(',')
+		}
+		s.putHex(uint64(s.threads[s.tidx] + 1))
+		s.tidx++
+	}
+	s.sendPacket()
+}
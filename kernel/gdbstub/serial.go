@@ -0,0 +1,58 @@
+package gdbstub
+
+import "github.com/icexin/eggos/kernel/sys"
+
+// the gdb stub uses COM2 by polling, no interrupt is used
+const (
+	com2 = uint16(0x2f8)
+
+	regData    = 0
+	regIntr    = 1
+	regFifo    = 2
+	regLine    = 3
+	regModem   = 4
+	regLStatus = 5
+	regScratch = 7
+
+	lsrDataReady = 0x01
+	lsrTxEmpty   = 0x20
+)
+
+// serialInit initializes COM2 with 115200 8N1, it returns false if COM2 is absent
+//go:nosplit
+func serialInit() bool {
+	// probe by the scratch register
+	sys.Outb(com2+regScratch, 0x5a)
+	if sys.Inb(com2+regScratch) != 0x5a {
+		return false
+	}
+	sys.Outb(com2+regIntr, 0x00)
+	sys.Outb(com2+regLine, 0x80) // unlock divisor
+	sys.Outb(com2+regData, 1)    // 115200
+	sys.Outb(com2+regIntr, 0)
+	sys.Outb(com2+regLine, 0x03) // lock divisor, 8N1
+	sys.Outb(com2+regFifo, 0xc7) // enable and clear fifo
+	sys.Outb(com2+regModem, 0x03)
+	return true
+}
+
+//go:nosplit
+func hasInput() bool {
+	return sys.Inb(com2+regLStatus)&lsrDataReady != 0
+}
+
+//go:nosplit
+func getc() byte {
+	for !hasInput() {
+		sys.Pause()
+	}
+	return sys.Inb(com2 + regData)
+}
+
+//go:nosplit
+func putc(ch byte) {
+	for sys.Inb(com2+regLStatus)&lsrTxEmpty == 0 {
+		sys.Pause()
+	}
+	sys.Outb(com2+regData, ch)
+}
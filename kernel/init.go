@@ -6,13 +6,14 @@ import "github.com/icexin/eggos/drivers/clock"
 func Init() {
 	clockTimeInit()
 	idleInit()
+	smpStart()
 	go runTrapThread()
 	go runSyscallThread()
+	watchdogStart()
 	bootstrapDone = true
 }
 
 func clockTimeInit() {
 	t := clock.ReadCmosTime()
-	baseUnixTime = t.Time().Unix()
-	clockBaseCounter = counter
+	setWallBase(t.Time().UnixNano())
 }
@@ -1,6 +1,10 @@
 package isyscall
 
 import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	_ "unsafe"
 )
@@ -10,14 +14,43 @@ const (
 )
 
 var (
-	handlers [512]Handler
+	// ErrRegistered is returned by Register if the syscall already has a handler
+	ErrRegistered = errors.New("syscall already registered")
+	// ErrNotRegistered is returned by Unregister if the syscall has no handler
+	ErrNotRegistered = errors.New("syscall not registered")
 )
 
-//go:linkname wakeup github.com/icexin/eggos/kernel.wakeup
+// entry is the handler and middlewares of a syscall
+type entry struct {
+	handler Handler
+	// middlewares from inner to outer
+	mws []*middleware
+}
+
+type middleware struct {
+	fn Middleware
+}
+
+var (
+	// protects entries
+	mu      sync.Mutex
+	entries = map[uintptr]*entry{}
+
+	// the composed handlers of syscalls, a map[uintptr]Handler replaced on every change,
+	// so the syscall thread reads it without lock.
+	handlers atomic.Value
+)
+
+//go:linkname wakeup github.com/icexin/eggos/kernel.lockedWakeup
 func wakeup(lock *uintptr, n int)
 
+// Handler handles the syscall forwarded by kernel
 type Handler func(req *Request)
 
+// Middleware intercepts the syscall before the wrapped handler,
+// it calls next to pass the request down, or completes req by itself.
+type Middleware func(req *Request, next Handler)
+
 type Request struct {
 	tf *trapFrame
 
@@ -62,12 +95,149 @@ func (r *Request) Done() {
 	wakeup(&r.Lock, 1)
 }
 
+// GetHandler returns the handler of syscall no wrapped by the middlewares,
+// nil if the syscall has neither handler nor middleware.
 func GetHandler(no uintptr) Handler {
-	return handlers[no]
+	m, _ := handlers.Load().(map[uintptr]Handler)
+	return m[no]
+}
+
+// Lookup returns the handler registered by Register without middlewares
+func Lookup(no uintptr) Handler {
+	mu.Lock()
+	defer mu.Unlock()
+	if e := entries[no]; e != nil {
+		return e.handler
+	}
+	return nil
+}
+
+// Registered returns the numbers of syscalls which have handlers or middlewares
+func Registered() []uintptr {
+	mu.Lock()
+	defer mu.Unlock()
+	nos := make([]uintptr, 0, len(entries))
+	for no := range entries {
+		nos = append(nos, no)
+	}
+	return nos
+}
+
+// Register sets the handler of syscall no, it returns ErrRegistered
+// if another handler is registered, the middlewares are kept.
+func Register(no uintptr, handler Handler) error {
+	if handler == nil {
+		panic("isyscall: nil handler")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	e := entries[no]
+	if e == nil {
+		e = new(entry)
+		entries[no] = e
+	}
+	if e.handler != nil {
+		return fmt.Errorf("register syscall %d: %w", no, ErrRegistered)
+	}
+	e.handler = handler
+	publish()
+	return nil
+}
+
+// MustRegister is like Register but panics if the syscall is registered,
+// it's used by the packages registering their syscalls at init.
+func MustRegister(no uintptr, handler Handler) {
+	if err := Register(no, handler); err != nil {
+		panic(err)
+	}
 }
 
-func Register(no uintptr, handler Handler) {
-	handlers[no] = handler
+// Unregister removes the handler of syscall no, the requests
+// passed through the middlewares are failed with ENOSYS.
+func Unregister(no uintptr) error {
+	mu.Lock()
+	defer mu.Unlock()
+	e := entries[no]
+	if e == nil || e.handler == nil {
+		return fmt.Errorf("unregister syscall %d: %w", no, ErrNotRegistered)
+	}
+	e.handler = nil
+	if len(e.mws) == 0 {
+		delete(entries, no)
+	}
+	publish()
+	return nil
+}
+
+// Wrap puts mw in front of the handler and middlewares of syscall no,
+// the handler needs not be registered first. It returns a function to remove mw.
+func Wrap(no uintptr, mw Middleware) (unwrap func()) {
+	if mw == nil {
+		panic("isyscall: nil middleware")
+	}
+	m := &middleware{fn: mw}
+	mu.Lock()
+	defer mu.Unlock()
+	e := entries[no]
+	if e == nil {
+		e = new(entry)
+		entries[no] = e
+	}
+	e.mws = append(e.mws, m)
+	publish()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			e.remove(m)
+			if e.handler == nil && len(e.mws) == 0 && entries[no] == e {
+				delete(entries, no)
+			}
+			publish()
+		})
+	}
+}
+
+func (e *entry) remove(m *middleware) {
+	for i, mm := range e.mws {
+		if mm == m {
+			e.mws = append(e.mws[:i:i], e.mws[i+1:]...)
+			return
+		}
+	}
+}
+
+// compose returns the handler of e wrapped by the middlewares
+func (e *entry) compose() Handler {
+	h := e.handler
+	if h == nil {
+		h = nosys
+	}
+	for _, m := range e.mws {
+		h = chain(m.fn, h)
+	}
+	return h
+}
+
+func chain(mw Middleware, next Handler) Handler {
+	return func(req *Request) {
+		mw(req, next)
+	}
+}
+
+func nosys(req *Request) {
+	req.SetErrorNO(syscall.ENOSYS)
+}
+
+// publish rebuilds the handler table, mu must be held
+func publish() {
+	m := make(map[uintptr]Handler, len(entries))
+	for no, e := range entries {
+		m[no] = e.compose()
+	}
+	handlers.Store(m)
 }
 
 func Errno(code syscall.Errno) uintptr {
@@ -0,0 +1,43 @@
+package isyscall
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWrap(t *testing.T) {
+	const no = 1000
+	var calls []string
+	if err := Register(no, func(req *Request) { calls = append(calls, "handler") }); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister(no)
+	if err := Register(no, func(req *Request) {}); !errors.Is(err, ErrRegistered) {
+		t.Fatalf("expect ErrRegistered, got %v", err)
+	}
+
+	unwrap1 := Wrap(no, func(req *Request, next Handler) {
+		calls = append(calls, "mw1")
+		next(req)
+	})
+	unwrap2 := Wrap(no, func(req *Request, next Handler) {
+		calls = append(calls, "mw2")
+		next(req)
+	})
+	GetHandler(no)(nil)
+	unwrap1()
+	unwrap1()
+	GetHandler(no)(nil)
+	unwrap2()
+	GetHandler(no)(nil)
+
+	expect := []string{"mw2", "mw1", "handler", "mw2", "handler", "handler"}
+	if len(calls) != len(expect) {
+		t.Fatalf("expect %v, got %v", expect, calls)
+	}
+	for i := range calls {
+		if calls[i] != expect[i] {
+			t.Fatalf("expect %v, got %v", expect, calls)
+		}
+	}
+}
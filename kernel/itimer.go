@@ -0,0 +1,472 @@
+package kernel
+
+import (
+	"math"
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/isyscall"
+	"gvisor.dev/gvisor/pkg/abi/linux"
+	"gvisor.dev/gvisor/pkg/abi/linux/errno"
+)
+
+// Interval timers of setitimer and timer_create.
+// The timers of wall clocks expire at the absolute deadline, they are checked by timer interrupt.
+// The timers of cpu clocks count down the cpu time consumed by threads, which is charged
+// on timer interrupt and thread switch, the timer interrupt is armed at the earliest expiry.
+// The signal of a process timer is sent to the thread consuming the cpu time for cpu clocks,
+// or a thread not blocking the signal for wall clocks.
+
+const (
+	// the first timers are used by setitimer, indexed by ITIMER_REAL, ITIMER_VIRTUAL and ITIMER_PROF,
+	// ITIMER_VIRTUAL is never used since the user time is not accounted.
+	_NITIMERS   = 3
+	_MAX_TIMERS = 256
+)
+
+type itimer struct {
+	used  bool
+	clock int32
+	// the signal sent on expiry, zero means SIGEV_NONE
+	signo int32
+	// si_code of the signal
+	code int32
+	// the target thread of SIGEV_THREAD_ID, -1 means the process
+	tid int
+	// the thread counted by CLOCK_THREAD_CPUTIME_ID
+	owner int
+
+	// the absolute deadline of wall clocks, or the remaining time
+	// of cpu clocks, zero means disarmed.
+	value    int64
+	interval int64
+	// expirations missed before the last signal
+	overrun int32
+}
+
+var (
+	itimers [_MAX_TIMERS]itimer
+	// number of timer slots ever used, to bound the scan
+	nitimers = _NITIMERS
+	// the cpu time charged to all threads, the value of CLOCK_PROCESS_CPUTIME_ID
+	procCPUTime int64
+)
+
+//go:nosplit
+func (it *itimer) cpuClock() bool {
+	return it.clock == linux.CLOCK_PROCESS_CPUTIME_ID || it.clock == linux.CLOCK_THREAD_CPUTIME_ID
+}
+
+//go:nosplit
+func (it *itimer) armed() bool {
+	return it.used && it.value != 0
+}
+
+// cpuClockNow returns the current value of the cpu clock of it
+//go:nosplit
+func (it *itimer) cpuClockNow() int64 {
+	if it.clock == linux.CLOCK_PROCESS_CPUTIME_ID {
+		return procCPUTime
+	}
+	if t := threadByID(it.owner); t != nil {
+		return t.cputime
+	}
+	return 0
+}
+
+// itimerOf returns the timer created by timer_create, nil if not found
+//go:nosplit
+func itimerOf(id uintptr) *itimer {
+	if id < _NITIMERS || id >= _MAX_TIMERS || !itimers[id].used {
+		return nil
+	}
+	return &itimers[id]
+}
+
+// itimerSignal sends the signal of it on expiry, t is the thread
+// consuming cpu time for cpu clocks, nil for wall clocks.
+//go:nosplit
+func itimerSignal(it *itimer, t *Thread) {
+	if it.signo == 0 {
+		return
+	}
+	switch {
+	case it.tid >= 0:
+		t = threadByID(it.tid)
+	case t == nil:
+		t = signalTarget(int(it.signo))
+	}
+	if t == nil {
+		return
+	}
+	signalSend(t, int(it.signo), it.code)
+}
+
+// itimerFire rearms it after it expired at now, and sends the signal
+//go:nosplit
+func itimerFire(it *itimer, t *Thread, now int64) {
+	if it.interval == 0 {
+		it.value = 0
+	} else if it.cpuClock() {
+		// value is the overdue time
+		missed := -it.value / it.interval
+		it.value += (missed + 1) * it.interval
+		it.overrun = int32(missed)
+	} else {
+		missed := (now - it.value) / it.interval
+		it.value += missed * it.interval
+		// the next expiry of a long interval may be out of range
+		if it.interval > math.MaxInt64-it.value {
+			it.value = math.MaxInt64
+		} else {
+			it.value += it.interval
+		}
+		it.overrun = int32(missed)
+	}
+	itimerSignal(it, t)
+}
+
+// itimerCharge charges the cpu time used by t since last charged,
+// and fires the expired timers of cpu clocks.
+//go:nosplit
+func itimerCharge(t *Thread, now int64) {
+	used := now - t.runStart
+	t.runStart = now
+	if t.idle || used <= 0 {
+		return
+	}
+	t.cputime += used
+	procCPUTime += used
+	for i := 0; i < nitimers; i++ {
+		it := &itimers[i]
+		if !it.armed() || !it.cpuClock() {
+			continue
+		}
+		if it.clock == linux.CLOCK_THREAD_CPUTIME_ID && it.owner != t.id {
+			continue
+		}
+		it.value -= used
+		if it.value <= 0 {
+			itimerFire(it, t, now)
+		}
+	}
+}
+
+// itimerExpire fires the expired timers of wall clocks
+//go:nosplit
+func itimerExpire(now int64) {
+	for i := 0; i < nitimers; i++ {
+		it := &itimers[i]
+		if it.armed() && !it.cpuClock() && it.value <= now {
+			itimerFire(it, nil, now)
+		}
+	}
+}
+
+// itimerNext returns the earliest expiry of timers if t runs from now,
+// zero if no timer is armed.
+//go:nosplit
+func itimerNext(t *Thread, now int64) int64 {
+	var next int64
+	for i := 0; i < nitimers; i++ {
+		it := &itimers[i]
+		if !it.armed() {
+			continue
+		}
+		deadline := it.value
+		if it.cpuClock() {
+			if t.idle || (it.clock == linux.CLOCK_THREAD_CPUTIME_ID && it.owner != t.id) {
+				continue
+			}
+			deadline = math.MaxInt64
+			if it.value <= math.MaxInt64-now {
+				deadline = now + it.value
+			}
+		}
+		if next == 0 || deadline < next {
+			next = deadline
+		}
+	}
+	return next
+}
+
+// itimerThreadExit deletes the timers bound to the exited thread
+//go:nosplit
+func itimerThreadExit(t *Thread) {
+	for i := _NITIMERS; i < nitimers; i++ {
+		it := &itimers[i]
+		if it.used && (it.owner == t.id && it.clock == linux.CLOCK_THREAD_CPUTIME_ID || it.tid == t.id) {
+			*it = itimer{}
+		}
+	}
+}
+
+// itimerGet returns the remaining time and interval of it
+//go:nosplit
+func itimerGet(it *itimer) (value, interval int64) {
+	if !it.armed() {
+		return 0, it.interval
+	}
+	value = it.value
+	if !it.cpuClock() {
+		value -= nanosecond()
+		if value <= 0 {
+			value = 1
+		}
+	}
+	return value, it.interval
+}
+
+// itimerSet arms it with value and interval in nanoseconds, value is absolute if abs is set,
+// zero value disarms it.
+//go:nosplit
+func itimerSet(it *itimer, value, interval int64, abs bool) {
+	it.interval = interval
+	it.overrun = 0
+	switch {
+	case value == 0 || it.cpuClock():
+	case !abs:
+		value = deadlineAfter(value)
+	case it.clock == linux.CLOCK_REALTIME:
+		value -= wallBase
+		if value <= 0 {
+			value = 1
+		}
+	}
+	it.value = value
+	// the timer interrupt of current cpu may be armed later than the new expiry
+	timerArm(Mythread())
+}
+
+// timevalToNano returns the nanoseconds of tv, saturated at math.MaxInt64
+//go:nosplit
+func timevalToNano(tv *linux.Timeval) int64 {
+	return timespecNano(tv.Sec, tv.Usec*1000)
+}
+
+//go:nosplit
+func nanoToTimeval(n int64, tv *linux.Timeval) {
+	// round up to microsecond
+	if n <= math.MaxInt64-999 {
+		n += 999
+	}
+	tv.Sec = n / second
+	tv.Usec = n % second / 1000
+}
+
+// timespecToNano returns the nanoseconds of ts, saturated at math.MaxInt64
+//go:nosplit
+func timespecToNano(ts *linux.Timespec) int64 {
+	return timespecNano(ts.Sec, ts.Nsec)
+}
+
+//go:nosplit
+func nanoToTimespec(n int64, ts *linux.Timespec) {
+	ts.Sec = n / second
+	ts.Nsec = n % second
+}
+
+//go:nosplit
+func validTimeval(tv *linux.Timeval) bool {
+	return tv.Sec >= 0 && tv.Usec >= 0 && tv.Usec < 1000000
+}
+
+//go:nosplit
+func validTimespec(ts *linux.Timespec) bool {
+	return ts.Sec >= 0 && ts.Nsec >= 0 && ts.Nsec < second
+}
+
+// sysGetitimer returns EINVAL for ITIMER_VIRTUAL, see sysSetitimer
+//go:nosplit
+func sysGetitimer(req *isyscall.Request) {
+	which := req.Arg(0)
+	if which >= _NITIMERS || which == linux.ITIMER_VIRTUAL {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	if req.Arg(1) == 0 {
+		req.SetRet(isyscall.Errno(errno.EFAULT))
+		return
+	}
+	cur := (*linux.ItimerVal)(unsafe.Pointer(req.Arg(1)))
+	value, interval := itimerGet(&itimers[which])
+	nanoToTimeval(value, &cur.Value)
+	nanoToTimeval(interval, &cur.Interval)
+}
+
+// sysSetitimer supports ITIMER_REAL and ITIMER_PROF. ITIMER_VIRTUAL returns EINVAL,
+// the user and kernel time are not accounted separately, it would be the same as ITIMER_PROF.
+//go:nosplit
+func sysSetitimer(req *isyscall.Request) {
+	which := req.Arg(0)
+	if which >= _NITIMERS || which == linux.ITIMER_VIRTUAL {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	it := &itimers[which]
+	if !it.used {
+		it.used = true
+		it.tid = -1
+		it.code = linux.SI_KERNEL
+		switch which {
+		case linux.ITIMER_REAL:
+			it.clock = linux.CLOCK_MONOTONIC
+			it.signo = int32(syscall.SIGALRM)
+		case linux.ITIMER_PROF:
+			it.clock = linux.CLOCK_PROCESS_CPUTIME_ID
+			it.signo = int32(syscall.SIGPROF)
+		}
+	}
+	if old := req.Arg(2); old != 0 {
+		oldval := (*linux.ItimerVal)(unsafe.Pointer(old))
+		value, interval := itimerGet(it)
+		nanoToTimeval(value, &oldval.Value)
+		nanoToTimeval(interval, &oldval.Interval)
+	}
+	if req.Arg(1) == 0 {
+		return
+	}
+	newval := (*linux.ItimerVal)(unsafe.Pointer(req.Arg(1)))
+	if !validTimeval(&newval.Value) || !validTimeval(&newval.Interval) {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	itimerSet(it, timevalToNano(&newval.Value), timevalToNano(&newval.Interval), false)
+}
+
+//go:nosplit
+func sysTimerCreate(req *isyscall.Request) {
+	clock := req.Arg(0)
+	switch clock {
+	case linux.CLOCK_REALTIME, linux.CLOCK_MONOTONIC, linux.CLOCK_BOOTTIME,
+		linux.CLOCK_PROCESS_CPUTIME_ID, linux.CLOCK_THREAD_CPUTIME_ID:
+	default:
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	// the id is written back at last, the slot is taken only if it can be returned
+	if req.Arg(2) == 0 {
+		req.SetRet(isyscall.Errno(errno.EFAULT))
+		return
+	}
+	var id int
+	for id = _NITIMERS; id < _MAX_TIMERS; id++ {
+		if !itimers[id].used {
+			break
+		}
+	}
+	if id >= _MAX_TIMERS {
+		req.SetRet(isyscall.Errno(errno.EAGAIN))
+		return
+	}
+	it := itimer{
+		used:  true,
+		clock: int32(clock),
+		signo: int32(syscall.SIGALRM),
+		code:  linux.SI_TIMER,
+		tid:   -1,
+		owner: Mythread().id,
+	}
+	if clock == linux.CLOCK_BOOTTIME {
+		it.clock = linux.CLOCK_MONOTONIC
+	}
+	if sevp := req.Arg(1); sevp != 0 {
+		ev := (*linux.Sigevent)(unsafe.Pointer(sevp))
+		switch ev.Notify {
+		case linux.SIGEV_NONE:
+			it.signo = 0
+		case linux.SIGEV_SIGNAL, linux.SIGEV_THREAD_ID:
+			if !validSignal(uintptr(ev.Signo)) {
+				req.SetRet(isyscall.Errno(errno.EINVAL))
+				return
+			}
+			it.signo = ev.Signo
+			if ev.Notify == linux.SIGEV_THREAD_ID {
+				if threadByID(int(ev.Tid)) == nil {
+					req.SetRet(isyscall.Errno(errno.EINVAL))
+					return
+				}
+				it.tid = int(ev.Tid)
+			}
+		default:
+			req.SetRet(isyscall.Errno(errno.EINVAL))
+			return
+		}
+	}
+	itimers[id] = it
+	if id >= nitimers {
+		nitimers = id + 1
+	}
+	*(*int32)(unsafe.Pointer(req.Arg(2))) = int32(id)
+}
+
+//go:nosplit
+func sysTimerSettime(req *isyscall.Request) {
+	it := itimerOf(req.Arg(0))
+	if it == nil {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	if req.Arg(2) == 0 {
+		req.SetRet(isyscall.Errno(errno.EFAULT))
+		return
+	}
+	newval := (*linux.Itimerspec)(unsafe.Pointer(req.Arg(2)))
+	if !validTimespec(&newval.Value) || !validTimespec(&newval.Interval) {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	if old := req.Arg(3); old != 0 {
+		oldval := (*linux.Itimerspec)(unsafe.Pointer(old))
+		value, interval := itimerGet(it)
+		nanoToTimespec(value, &oldval.Value)
+		nanoToTimespec(interval, &oldval.Interval)
+	}
+	abs := req.Arg(1)&linux.TIMER_ABSTIME != 0
+	value := timespecToNano(&newval.Value)
+	if abs && it.cpuClock() && value != 0 {
+		// the cpu clocks count down the remaining time, the elapsed target expires immediately
+		value -= it.cpuClockNow()
+		if value <= 0 {
+			value = 1
+		}
+	}
+	itimerSet(it, value, timespecToNano(&newval.Interval), abs)
+}
+
+//go:nosplit
+func sysTimerGettime(req *isyscall.Request) {
+	it := itimerOf(req.Arg(0))
+	if it == nil {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	if req.Arg(1) == 0 {
+		req.SetRet(isyscall.Errno(errno.EFAULT))
+		return
+	}
+	cur := (*linux.Itimerspec)(unsafe.Pointer(req.Arg(1)))
+	value, interval := itimerGet(it)
+	nanoToTimespec(value, &cur.Value)
+	nanoToTimespec(interval, &cur.Interval)
+}
+
+//go:nosplit
+func sysTimerGetoverrun(req *isyscall.Request) {
+	it := itimerOf(req.Arg(0))
+	if it == nil {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	req.SetRet(uintptr(it.overrun))
+}
+
+//go:nosplit
+func sysTimerDelete(req *isyscall.Request) {
+	it := itimerOf(req.Arg(0))
+	if it == nil {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	*it = itimer{}
+}
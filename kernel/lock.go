@@ -1,6 +1,8 @@
 package kernel
 
 import (
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 
 	"gvisor.dev/gvisor/pkg/abi/linux"
@@ -9,88 +11,119 @@ import (
 const (
 	_FUTEX_WAIT         = 0
 	_FUTEX_WAKE         = 1
+	_FUTEX_REQUEUE      = 3
+	_FUTEX_CMP_REQUEUE  = 4
+	_FUTEX_WAIT_BITSET  = 9
+	_FUTEX_WAKE_BITSET  = 10
 	_FUTEX_PRIVATE_FLAG = 128
-	_FUTEX_WAIT_PRIVATE = _FUTEX_WAIT | _FUTEX_PRIVATE_FLAG
-	_FUTEX_WAKE_PRIVATE = _FUTEX_WAKE | _FUTEX_PRIVATE_FLAG
+	// the timeout of FUTEX_WAIT_BITSET is measured against CLOCK_REALTIME
+	_FUTEX_CLOCK_REALTIME = 256
+	_FUTEX_CMD_MASK       = ^uintptr(_FUTEX_PRIVATE_FLAG | _FUTEX_CLOCK_REALTIME)
 )
 
+// futex implements the futex syscall, all the futexes are private,
+// val2 is the timeout or the number of threads to requeue, depending on op.
 //go:nosplit
-func futex(addr *uintptr, op, val uintptr, ts *linux.Timespec) {
-	switch op {
-	case _FUTEX_WAIT, _FUTEX_WAIT_PRIVATE:
-		if ts != nil {
-			sleeptimeout(addr, val, ts)
-			return
+func futex(addr *uint32, op uintptr, val uint32, val2 uintptr, addr2 *uint32, val3 uint32) (uintptr, syscall.Errno) {
+	switch op & _FUTEX_CMD_MASK {
+	case _FUTEX_WAIT:
+		var deadline int64
+		if ts := (*linux.Timespec)(unsafe.Pointer(val2)); ts != nil {
+			deadline = deadlineAfter(timespecNano(ts.Sec, ts.Nsec))
 		}
-		for *addr == val {
-			sleepon(addr)
+		return 0, futexWait(addr, val, deadline, _WAIT_BITS_ANY)
+	case _FUTEX_WAIT_BITSET:
+		if val3 == 0 {
+			return 0, syscall.EINVAL
 		}
-		return
-	case _FUTEX_WAKE, _FUTEX_WAKE_PRIVATE:
-		wakeup(addr, int(val))
+		// the timeout is absolute
+		var deadline int64
+		if ts := (*linux.Timespec)(unsafe.Pointer(val2)); ts != nil {
+			deadline = timespecNano(ts.Sec, ts.Nsec)
+			if op&_FUTEX_CLOCK_REALTIME != 0 {
+				deadline -= wallBase
+			}
+			if deadline <= 0 {
+				return 0, syscall.ETIMEDOUT
+			}
+		}
+		return 0, futexWait(addr, val, deadline, val3)
+	case _FUTEX_WAKE:
+		return uintptr(waitqWake(uintptr(unsafe.Pointer(addr)), int(val), _WAIT_BITS_ANY)), 0
+	case _FUTEX_WAKE_BITSET:
+		if val3 == 0 {
+			return 0, syscall.EINVAL
+		}
+		return uintptr(waitqWake(uintptr(unsafe.Pointer(addr)), int(val), val3)), 0
+	case _FUTEX_REQUEUE, _FUTEX_CMP_REQUEUE:
+		if int32(val2) < 0 || addr2 == nil {
+			return 0, syscall.EINVAL
+		}
+		if op&_FUTEX_CMD_MASK == _FUTEX_CMP_REQUEUE && atomic.LoadUint32(addr) != val3 {
+			return 0, syscall.EAGAIN
+		}
+		key := uintptr(unsafe.Pointer(addr))
+		woken := waitqWake(key, int(val), _WAIT_BITS_ANY)
+		requeued := waitqRequeue(key, uintptr(unsafe.Pointer(addr2)), int(int32(val2)))
+		if op&_FUTEX_CMD_MASK == _FUTEX_CMP_REQUEUE {
+			return uintptr(woken + requeued), 0
+		}
+		return uintptr(woken), 0
 	default:
-		panic("futex: invalid op")
+		return 0, syscall.ENOSYS
 	}
 }
 
+// futexWait sleeps on addr if *addr == val, until waked up or the deadline expires,
+// zero deadline means no timeout.
 //go:nosplit
-func sleeptimeout(addr *uintptr, val uintptr, ts *linux.Timespec) {
-	if ts == nil {
-		panic("sleeptimeout: nil ts")
+func futexWait(addr *uint32, val uint32, deadline int64, bits uint32) syscall.Errno {
+	if atomic.LoadUint32(addr) != val {
+		return syscall.EAGAIN
+	}
+	if deadline != 0 && nanosecond() >= deadline {
+		return syscall.ETIMEDOUT
 	}
-	deadline := nanosecond() + int64(ts.Nsec) + int64(ts.Sec)*second
-	// check on every timer intr
-	now := nanosecond()
 	t := Mythread()
-	for now < deadline && *addr == val {
-		t.timerKey = uintptr(unsafe.Pointer(&sleeplock))
-		t.sleepKey = uintptr(unsafe.Pointer(addr))
-		t.state = SLEEPING
-		Sched()
-		t.timerKey = 0
-		t.sleepKey = 0
-		now = nanosecond()
+	waitqAdd(t, uintptr(unsafe.Pointer(addr)), bits)
+	if deadline != 0 {
+		timerAdd(t, deadline)
+	}
+	t.state = SLEEPING
+	Sched()
+	timerDel(t)
+	// still on the wait queue, not waked up by futex wake
+	if t.waiting {
+		waitqDel(t)
+		if deadline != 0 && nanosecond() >= deadline {
+			return syscall.ETIMEDOUT
+		}
 	}
+	return 0
 }
 
 //go:nosplit
 func sleepon(lock *uintptr) {
 	t := Mythread()
-	t.sleepKey = uintptr(unsafe.Pointer(lock))
+	waitqAdd(t, uintptr(unsafe.Pointer(lock)), _WAIT_BITS_ANY)
 	t.state = SLEEPING
 	Sched()
-	t.sleepKey = 0
+	waitqDel(t)
 }
 
 // wakeup thread sleep on lock, n == -1 means all threads
 //go:nosplit
 func wakeup(lock *uintptr, n int) {
-	limit := uint(n)
-	cnt := uint(0)
-	lockKey := uintptr(unsafe.Pointer(lock))
-	for i := 0; i < _NTHREDS; i++ {
-		t := &threads[i]
-		if (t.sleepKey == lockKey || t.timerKey == lockKey) && cnt < limit {
-			cnt++
-			t.state = RUNNABLE
-		}
-	}
-}
-
-type note uintptr
-
-//go:nosplit
-func (n *note) sleep(ts *linux.Timespec) {
-	futex((*uintptr)(unsafe.Pointer(n)), _FUTEX_WAIT, 0, ts)
-}
-
-//go:nosplit
-func (n *note) wakeup() {
-	*n = 1
-	futex((*uintptr)(unsafe.Pointer(n)), _FUTEX_WAKE, 1, nil)
+	waitqWake(uintptr(unsafe.Pointer(lock)), n, _WAIT_BITS_ANY)
 }
 
+// lockedWakeup is the version of wakeup called outside of trap,
+// eg. by the syscall thread when a forwarded syscall is done.
 //go:nosplit
-func (n *note) clear() {
-	*n = 0
+func lockedWakeup(lock *uintptr, n int) {
+	flags := pushcli()
+	klock.lock()
+	wakeup(lock, n)
+	klock.unlock()
+	popcli(flags)
 }
@@ -0,0 +1,349 @@
+package mm
+
+import (
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/multiboot"
+)
+
+const (
+	// the max order of block is MAX_ORDER-1, which is 4M bytes
+	MAX_ORDER = 11
+
+	// the page descriptor of block head, lower bits are the order of block,
+	// the page is the head of a free block
+	_PG_FREE = 0x40
+	// the page is the head of an allocated block
+	_PG_ALLOC = 0x80
+)
+
+const (
+	// the memory below 4G, the devices using 32 bit dma address require it
+	_ZONE_DMA32 = iota
+	_ZONE_NORMAL
+	_NR_ZONES
+)
+
+var zoneNames = [_NR_ZONES]string{
+	_ZONE_DMA32:  "DMA32",
+	_ZONE_NORMAL: "Normal",
+}
+
+// freeBlock is the list node put at the start of free block
+//go:notinheap
+type freeBlock struct {
+	next *freeBlock
+	prev *freeBlock
+}
+
+// zone is a buddy allocator of a physical address range
+type zone struct {
+	// the physical range [start, end) of zone
+	start, end uintptr
+
+	free  [MAX_ORDER]*freeBlock
+	nfree [MAX_ORDER]int
+
+	// number of pages managed by zone, the holes are excluded
+	managed uintptr
+	// number of free pages
+	freePages uintptr
+}
+
+//go:nosplit
+func (z *zone) contains(p, size uintptr) bool {
+	return p >= z.start && p+size <= z.end
+}
+
+//go:nosplit
+func (z *zone) push(p uintptr, order int) {
+	b := (*freeBlock)(unsafe.Pointer(P2V(p)))
+	b.prev = nil
+	b.next = z.free[order]
+	if b.next != nil {
+		b.next.prev = b
+	}
+	z.free[order] = b
+	z.nfree[order]++
+	*kmm.pgmeta(p) = _PG_FREE | uint8(order)
+}
+
+//go:nosplit
+func (z *zone) remove(p uintptr, order int) {
+	b := (*freeBlock)(unsafe.Pointer(P2V(p)))
+	if b.prev != nil {
+		b.prev.next = b.next
+	} else {
+		z.free[order] = b.next
+	}
+	if b.next != nil {
+		b.next.prev = b.prev
+	}
+	z.nfree[order]--
+	*kmm.pgmeta(p) = 0
+}
+
+// pgmeta returns the page descriptor of physical page p
+//go:nosplit
+func (k *kmmt) pgmeta(p uintptr) *uint8 {
+	return &k.meta[p/PGSIZE]
+}
+
+//go:nosplit
+func (k *kmmt) zoneOf(p uintptr) *zone {
+	for i := range k.zones {
+		z := &k.zones[i]
+		if p >= z.start && p < z.end {
+			return z
+		}
+	}
+	return nil
+}
+
+//go:nosplit
+func (k *kmmt) allocOrder(order int) uintptr {
+	if order < 0 || order >= MAX_ORDER {
+		return 0
+	}
+	flags := k.acquire()
+	// prefer the higher zone to keep the dma memory
+	for i := len(k.zones) - 1; i >= 0; i-- {
+		z := &k.zones[i]
+		for o := order; o < MAX_ORDER; o++ {
+			if z.free[o] == nil {
+				continue
+			}
+			p := uintptr(unsafe.Pointer(z.free[o])) - physOffset
+			z.remove(p, o)
+			// split the block and put back the upper halves
+			for o > order {
+				o--
+				z.push(p+PGSIZE<<o, o)
+			}
+			*k.pgmeta(p) = _PG_ALLOC | uint8(order)
+			z.freePages -= 1 << order
+			k.release(flags)
+			return p
+		}
+	}
+	k.release(flags)
+	return 0
+}
+
+//go:nosplit
+func (k *kmmt) freeOrder(p uintptr, order int) {
+	if order < 0 || order >= MAX_ORDER || p%(PGSIZE<<order) != 0 {
+		throw("kmemt.free")
+	}
+	flags := k.acquire()
+	z := k.zoneOf(p)
+	if z == nil || *k.pgmeta(p) != _PG_ALLOC|uint8(order) {
+		throw("kmemt.free")
+	}
+	*k.pgmeta(p) = 0
+	z.freePages += 1 << order
+	// merge with the free buddies
+	for order < MAX_ORDER-1 {
+		buddy := p ^ (PGSIZE << order)
+		if !z.contains(buddy, PGSIZE<<order) || *k.pgmeta(buddy) != _PG_FREE|uint8(order) {
+			break
+		}
+		z.remove(buddy, order)
+		p &= buddy
+		order++
+	}
+	z.push(p, order)
+	k.release(flags)
+}
+
+//go:nosplit
+func (k *kmmt) alloc() uintptr {
+	if k.early != 0 {
+		p := k.early
+		k.early += PGSIZE
+		return p
+	}
+	p := k.allocOrder(0)
+	if p == 0 {
+		throw("kmemt.alloc")
+	}
+	return p
+}
+
+//go:nosplit
+func (k *kmmt) free(p uintptr) {
+	k.freeOrder(p, 0)
+}
+
+// freeRange puts the pages in [start, end) to the zones
+//go:nosplit
+func (k *kmmt) freeRange(start, end uintptr) {
+	p := pageRoundUp(start)
+	end = pageRoundDown(end)
+	for p < end {
+		z := k.zoneOf(p)
+		if z == nil {
+			throw("page out of zone")
+		}
+		// the largest aligned block fits in range and zone
+		order := MAX_ORDER - 1
+		for order > 0 && (p%(PGSIZE<<order) != 0 || p+PGSIZE<<order > end ||
+			!z.contains(p, PGSIZE<<order)) {
+			order--
+		}
+		*k.pgmeta(p) = _PG_ALLOC | uint8(order)
+		z.managed += 1 << order
+		k.freeOrder(p, order)
+		p += PGSIZE << order
+	}
+}
+
+//go:nosplit
+func (k *kmmt) init() {
+	k.zones[_ZONE_DMA32].start = 0
+	k.zones[_ZONE_DMA32].end = 4 << 30
+	k.zones[_ZONE_NORMAL].start = 4 << 30
+	k.zones[_ZONE_NORMAL].end = ^uintptr(0)
+	for i := range k.zones {
+		if k.zones[i].end > memtop {
+			k.zones[i].end = memtop
+		}
+		if k.zones[i].start > k.zones[i].end {
+			k.zones[i].start = k.zones[i].end
+		}
+	}
+
+	// one byte descriptor per page, put them at the start of memory,
+	// followed by the pages allocated before.
+	npage := memtop / PGSIZE
+	k.meta = (*[MAX_MEMTOP / PGSIZE]uint8)(unsafe.Pointer(P2V(MEMSTART)))[:npage:npage]
+	for i := range k.meta {
+		k.meta[i] = 0
+	}
+	k.metaEnd = k.early
+	k.early = 0
+
+	if !multiboot.Enabled() {
+		k.freeRange(k.metaEnd, memtop)
+		return
+	}
+	k.freeAvail(0, memtop)
+}
+
+// freeAvail puts the available memory in [lo, hi) to the zones
+//go:nosplit
+func (k *kmmt) freeAvail(lo, hi uintptr) {
+	if lo < k.metaEnd {
+		lo = k.metaEnd
+	}
+	if hi > memtop {
+		hi = memtop
+	}
+	for _, e := range multiboot.BootInfo.MmapEntries() {
+		if e.Type != multiboot.MemoryAvailable {
+			continue
+		}
+		start, end := uintptr(e.Addr), uintptr(e.Addr+e.Len)
+		if start < lo {
+			start = lo
+		}
+		if end > hi {
+			end = hi
+		}
+		if start < end {
+			k.freeExceptModules(start, end)
+		}
+	}
+}
+
+// freeExceptModules puts the range [start, end) to the zones,
+// the boot modules in it are kept for initrd until FreeModule.
+//go:nosplit
+func (k *kmmt) freeExceptModules(start, end uintptr) {
+	mods := multiboot.BootInfo.Modules()
+	for start < end {
+		// the lowest module overlapping [start, end)
+		next, skip := end, end
+		for i, m := range mods {
+			if k.modFreed(i) {
+				continue
+			}
+			ms, me := pageRoundDown(uintptr(m.Start)), pageRoundUp(uintptr(m.End))
+			if ms < next && me > start {
+				next, skip = ms, me
+			}
+		}
+		if start < next {
+			k.freeRange(start, next)
+		}
+		start = skip
+	}
+}
+
+//go:nosplit
+func (k *kmmt) modFreed(i int) bool {
+	return k.modsFreed[i/64]&(1<<(i%64)) != 0
+}
+
+// FreeModule releases the pages of boot module i, which is not used since then,
+// eg. it's unpacked to initrd. The pages shared with other modules are kept.
+//go:nosplit
+func FreeModule(i int) {
+	mods := multiboot.BootInfo.Modules()
+	if i < 0 || i >= len(mods) || kmm.modFreed(i) {
+		return
+	}
+	kmm.modsFreed[i/64] |= 1 << (i % 64)
+	m := mods[i]
+	kmm.freeAvail(pageRoundDown(uintptr(m.Start)), pageRoundUp(uintptr(m.End)))
+}
+
+// ZoneStat is the statistics of a memory zone
+type ZoneStat struct {
+	Name string
+	// the physical range [Start, End) of zone
+	Start, End uintptr
+	// number of pages managed by zone and free
+	Managed uintptr
+	Free    uintptr
+	// number of free blocks of each order
+	FreeBlocks [MAX_ORDER]int
+}
+
+// Stat is the statistics of physical memory in bytes
+type Stat struct {
+	Total uintptr
+	Used  uintptr
+	Free  uintptr
+	// number of 2M pages mapped by Mmap
+	HugePages uintptr
+	Zones     []ZoneStat
+}
+
+// Stats returns the statistics of physical memory
+func Stats() Stat {
+	var zones [_NR_ZONES]ZoneStat
+	flags := kmm.acquire()
+	for i := range kmm.zones {
+		z := &kmm.zones[i]
+		zones[i] = ZoneStat{
+			Name:       zoneNames[i],
+			Start:      z.start,
+			End:        z.end,
+			Managed:    z.managed,
+			Free:       z.freePages,
+			FreeBlocks: z.nfree,
+		}
+	}
+	kmm.release(flags)
+
+	var st Stat
+	for _, z := range zones {
+		st.Total += z.Managed * PGSIZE
+		st.Free += z.Free * PGSIZE
+		st.Zones = append(st.Zones, z)
+	}
+	st.Used = st.Total - st.Free
+	st.HugePages = vmm.nhuge
+	return st
+}
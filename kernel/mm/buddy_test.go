@@ -0,0 +1,258 @@
+package mm
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// the functions of kernel called by mm
+//go:linkname testThrow github.com/icexin/eggos/kernel.throw
+func testThrow(msg string) {
+	panic(msg)
+}
+
+//go:linkname testCpuid github.com/icexin/eggos/kernel.cpuid
+func testCpuid(fn, cx uint32) (eax, ebx, ecx, edx uint32) {
+	return
+}
+
+//go:linkname testTlbShootdown github.com/icexin/eggos/kernel.tlbShootdown
+func testTlbShootdown(va, size uintptr) {
+	nshootdown++
+}
+
+var nshootdown int
+
+// the fake physical memory straddles the zones at 4G,
+// it's backed by an anonymous mapping of the host.
+const (
+	testPhysStart = 4<<30 - 8<<20
+	testPhysEnd   = 4<<30 + 8<<20
+)
+
+func setupKmm(t *testing.T) {
+	mem, err := syscall.Mmap(-1, 0, testPhysEnd-testPhysStart,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		kmm = kmmt{}
+		vmm = vmmt{}
+		tlbb = tlbBatch{}
+		physOffset, memtop = 0, 0
+		syscall.Munmap(mem)
+	})
+	physOffset = uintptr(unsafe.Pointer(&mem[0])) - testPhysStart
+	memtop = testPhysEnd
+	kmm = kmmt{nointr: true, meta: make([]uint8, testPhysEnd/PGSIZE)}
+	kmm.zones[_ZONE_DMA32] = zone{start: testPhysStart, end: 4 << 30}
+	kmm.zones[_ZONE_NORMAL] = zone{start: 4 << 30, end: testPhysEnd}
+}
+
+// checkZones checks the free lists agree with the page descriptors and counters
+func checkZones(t *testing.T) {
+	t.Helper()
+	for i := range kmm.zones {
+		z := &kmm.zones[i]
+		var free uintptr
+		for order, b := range z.free {
+			n := 0
+			for ; b != nil; b = b.next {
+				p := uintptr(unsafe.Pointer(b)) - physOffset
+				size := uintptr(PGSIZE) << order
+				if p%size != 0 || !z.contains(p, size) {
+					t.Fatalf("zone %s: bad block %x of order %d", zoneNames[i], p, order)
+				}
+				if *kmm.pgmeta(p) != _PG_FREE|uint8(order) {
+					t.Fatalf("zone %s: block %x of order %d has meta %x", zoneNames[i], p, order, *kmm.pgmeta(p))
+				}
+				free += 1 << order
+				n++
+			}
+			if n != z.nfree[order] {
+				t.Fatalf("zone %s: expect %d blocks of order %d, got %d", zoneNames[i], z.nfree[order], order, n)
+			}
+		}
+		if free != z.freePages {
+			t.Fatalf("zone %s: expect %d free pages, got %d", zoneNames[i], z.freePages, free)
+		}
+	}
+}
+
+func TestFreeRange(t *testing.T) {
+	cases := []struct {
+		name       string
+		start, end uintptr
+		managed    [_NR_ZONES]uintptr
+		nfree      [_NR_ZONES][MAX_ORDER]int
+	}{
+		{
+			name: "aligned", start: testPhysStart, end: testPhysStart + 4<<20,
+			managed: [_NR_ZONES]uintptr{1024, 0},
+			nfree:   [_NR_ZONES][MAX_ORDER]int{{10: 1}},
+		},
+		{
+			// the partial pages at both ends are skipped
+			name: "unaligned", start: testPhysStart + 100, end: testPhysStart + 5*PGSIZE + 1,
+			managed: [_NR_ZONES]uintptr{4, 0},
+			nfree:   [_NR_ZONES][MAX_ORDER]int{{0: 2, 1: 1}},
+		},
+		{
+			name: "straddle", start: 4<<30 - 6<<20, end: 4<<30 + 3<<20,
+			managed: [_NR_ZONES]uintptr{1536, 768},
+			nfree:   [_NR_ZONES][MAX_ORDER]int{{9: 1, 10: 1}, {8: 1, 9: 1}},
+		},
+		{
+			name: "empty", start: testPhysStart + 100, end: testPhysStart + 200,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			setupKmm(t)
+			kmm.freeRange(c.start, c.end)
+			checkZones(t)
+			for i := range kmm.zones {
+				z := &kmm.zones[i]
+				if z.managed != c.managed[i] || z.freePages != c.managed[i] {
+					t.Fatalf("zone %s: expect %d pages, got managed %d free %d",
+						zoneNames[i], c.managed[i], z.managed, z.freePages)
+				}
+				if z.nfree != c.nfree[i] {
+					t.Fatalf("zone %s: expect free blocks %v, got %v", zoneNames[i], c.nfree[i], z.nfree)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitMerge(t *testing.T) {
+	for order := 0; order < MAX_ORDER; order++ {
+		setupKmm(t)
+		kmm.freeRange(testPhysStart, testPhysStart+4<<20)
+		z := &kmm.zones[_ZONE_DMA32]
+
+		p := kmm.allocOrder(order)
+		if p != testPhysStart {
+			t.Fatalf("order %d: expect block at %x, got %x", order, testPhysStart, p)
+		}
+		checkZones(t)
+		// the upper halves of the split blocks are left free
+		for o := range z.nfree {
+			expect := 0
+			if o >= order && o < MAX_ORDER-1 {
+				expect = 1
+			}
+			if z.nfree[o] != expect {
+				t.Fatalf("order %d: expect %d free blocks of order %d, got %v", order, expect, o, z.nfree)
+			}
+		}
+		if z.freePages != 1024-1<<order {
+			t.Fatalf("order %d: expect %d free pages, got %d", order, 1024-1<<order, z.freePages)
+		}
+
+		// the buddies are merged back to a single block
+		kmm.freeOrder(p, order)
+		checkZones(t)
+		if z.nfree != [MAX_ORDER]int{10: 1} {
+			t.Fatalf("order %d: expect merged, got %v", order, z.nfree)
+		}
+	}
+}
+
+func TestMergeOutOfOrder(t *testing.T) {
+	setupKmm(t)
+	kmm.freeRange(testPhysStart, testPhysStart+8*PGSIZE)
+	var pages []uintptr
+	for i := 0; i < 8; i++ {
+		pages = append(pages, kmm.allocOrder(0))
+	}
+	// free the odd pages first, no buddies are merged
+	for i := 1; i < 8; i += 2 {
+		kmm.freeOrder(pages[i], 0)
+	}
+	checkZones(t)
+	z := &kmm.zones[_ZONE_DMA32]
+	if z.nfree != [MAX_ORDER]int{0: 4} {
+		t.Fatalf("expect 4 pages not merged, got %v", z.nfree)
+	}
+	for i := 0; i < 8; i += 2 {
+		kmm.freeOrder(pages[i], 0)
+	}
+	checkZones(t)
+	if z.nfree != [MAX_ORDER]int{3: 1} {
+		t.Fatalf("expect merged to order 3, got %v", z.nfree)
+	}
+}
+
+func TestAllocPages(t *testing.T) {
+	setupKmm(t)
+	kmm.freeRange(testPhysStart, testPhysEnd)
+	total := kmm.zones[_ZONE_DMA32].freePages + kmm.zones[_ZONE_NORMAL].freePages
+	for _, order := range []int{0, 1, 3, 9, MAX_ORDER - 1} {
+		for i := 0; i < 2; i++ {
+			va := AllocPages(order)
+			if va == 0 {
+				t.Fatalf("order %d: out of memory", order)
+			}
+			size := uintptr(PGSIZE) << order
+			pa := V2P(va)
+			if pa%size != 0 || pa < testPhysStart || pa+size > testPhysEnd {
+				t.Fatalf("order %d: bad block %x", order, pa)
+			}
+			buf := (*[PGSIZE << (MAX_ORDER - 1)]byte)(unsafe.Pointer(va))[:size]
+			for j := range buf {
+				if buf[j] != 0 {
+					t.Fatalf("order %d: page not zeroed at %d", order, j)
+				}
+				// dirty the pages for the next round
+				buf[j] = 0xff
+			}
+			FreePages(va, order)
+			checkZones(t)
+		}
+	}
+	if free := kmm.zones[_ZONE_DMA32].freePages + kmm.zones[_ZONE_NORMAL].freePages; free != total {
+		t.Fatalf("expect %d free pages, got %d", total, free)
+	}
+}
+
+func TestAllocExhausted(t *testing.T) {
+	setupKmm(t)
+	// 8 pages below 4G and 8 pages above
+	kmm.freeRange(4<<30-8*PGSIZE, 4<<30+8*PGSIZE)
+	if p := kmm.allocOrder(4); p != 0 {
+		t.Fatalf("expect no block of order 4 across zones, got %x", p)
+	}
+	if p := kmm.allocOrder(MAX_ORDER); p != 0 {
+		t.Fatalf("expect no block of order %d, got %x", MAX_ORDER, p)
+	}
+	var pages []uintptr
+	for {
+		p := kmm.allocOrder(0)
+		if p == 0 {
+			break
+		}
+		pages = append(pages, p)
+	}
+	if len(pages) != 16 {
+		t.Fatalf("expect 16 pages, got %d", len(pages))
+	}
+	// the higher zone is used first
+	if pages[0] < 4<<30 || pages[15] >= 4<<30 {
+		t.Fatalf("expect Normal zone first, got %x %x", pages[0], pages[15])
+	}
+	if AllocPages(0) != 0 {
+		t.Fatal("expect AllocPages fails")
+	}
+	for _, p := range pages {
+		kmm.free(p)
+	}
+	checkZones(t)
+	for i := range kmm.zones {
+		if z := &kmm.zones[i]; z.nfree != [MAX_ORDER]int{3: 1} {
+			t.Fatalf("zone %s: expect merged to order 3, got %v", zoneNames[i], z.nfree)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package mm
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+const (
+	// the buddy order of 2M page
+	_HUGE_ORDER = 9
+
+	// the bits compared when merging pages into a huge page
+	_PTE_PERM_MASK = PTE_P | PTE_W | PTE_U | PTE_NX | _PTE_FIXED | _PTE_PROTNONE
+)
+
+// mapHuge maps a new 2M page at va, it returns false if the 2M range
+// has a page table or there is no free 2M block.
+//go:nosplit
+func (v *vmmt) mapHuge(va, perm uintptr) bool {
+	// the huge page is always present, see entry.huge
+	if perm&PTE_P == 0 {
+		return false
+	}
+	pde := v.walklvl(va, 2, true)
+	if pde == nil || *pde != 0 {
+		return false
+	}
+	pa := kmm.allocOrder(_HUGE_ORDER)
+	if pa == 0 {
+		return false
+	}
+	sys.Memclr(P2V(pa), PGSIZE_2M)
+	*pde = entry(pa | perm | PTE_PS)
+	v.nhuge++
+	return true
+}
+
+// split replaces the 2M page of entry pde at va by a page table of 4K pages
+//go:nosplit
+func (v *vmmt) split(pde *entry, va, pgsize uintptr) {
+	if pgsize != PGSIZE_2M {
+		throw("split 1G page")
+	}
+	pa := pde.addr()
+	perm := uintptr(*pde) & _PTE_PERM_MASK
+	if *pde&_PTE_FIXED == 0 {
+		// the 4K pages are freed one by one since then
+		kmm.split(pa, _HUGE_ORDER)
+		v.nhuge--
+	}
+	pt := kmm.alloc()
+	ptes := (*entryPage)(unsafe.Pointer(P2V(pt)))
+	for i := range ptes {
+		ptes[i] = entry(pa + uintptr(i)*PGSIZE | perm)
+	}
+	*pde = entry(pt | PTE_P | PTE_W | PTE_U)
+	// the mapping is not changed, but the stale 2M entries mix with the new 4K entries,
+	// flushing any address in the 2M page drops the whole entry.
+	tlbShootdown(va, PGSIZE)
+}
+
+// promote replaces the page table of 2M range at va by a 2M page if all
+// the 4K pages are present with the same protection. The pages are made
+// inaccessible while being copied to the new 2M page, the accesses of other cpus
+// meanwhile fault and wait for the kernel lock, then retry, see Spurious.
+//go:nosplit
+func (v *vmmt) promote(va uintptr) bool {
+	pde := v.walklvl(va, 2, false)
+	if pde == nil || !pde.present() || pde.huge() {
+		return false
+	}
+	ptes := pde.entryPage()
+	perm := uintptr(ptes[0]) & _PTE_PERM_MASK
+	if perm&(PTE_P|_PTE_FIXED) != PTE_P {
+		return false
+	}
+	for i := range ptes {
+		if uintptr(ptes[i])&_PTE_PERM_MASK != perm {
+			return false
+		}
+	}
+	pa := kmm.allocOrder(_HUGE_ORDER)
+	if pa == 0 {
+		return false
+	}
+	for i := range ptes {
+		ptes[i] = ptes[i]&^PTE_P | _PTE_PROTNONE
+	}
+	tlbShootdown(va, PGSIZE_2M)
+	for i := range ptes {
+		dst := sys.UnsafeBuffer(P2V(pa+uintptr(i)*PGSIZE), PGSIZE)
+		copy(dst, sys.UnsafeBuffer(P2V(ptes[i].addr()), PGSIZE))
+	}
+	pt := pde.addr()
+	*pde = entry(pa | perm | PTE_PS)
+	// the page table may be cached by the cpus faulted meanwhile
+	tlbShootdown(va, PGSIZE_2M)
+	for i := range ptes {
+		kmm.free(ptes[i].addr())
+	}
+	kmm.free(pt)
+	v.nhuge++
+	return true
+}
+
+// madvise applies the advice to the pages in [va, va+size).
+// The pages of MADV_DONTNEED are freed after the shootdown, and populated
+// with zeroed pages on the next access, see Fault.
+//go:nosplit
+func (v *vmmt) madvise(va, size, advice uintptr) {
+	p := pageRoundDown(va)
+	end := pageRoundUp(va + size)
+	for p < end {
+		pte, pgsize := v.lookup(p)
+		if pte == nil {
+			p = (p + PGSIZE_2M) &^ (PGSIZE_2M - 1)
+			continue
+		}
+		if !pte.mapped() || *pte&_PTE_FIXED != 0 {
+			p += PGSIZE
+			continue
+		}
+		base := p &^ (pgsize - 1)
+		switch advice {
+		case syscall.MADV_DONTNEED:
+			if pgsize != PGSIZE {
+				// the pages are populated one by one since then
+				v.split(pte, base, pgsize)
+				continue
+			}
+			v.release(pte, p)
+		case syscall.MADV_HUGEPAGE:
+			if pgsize == PGSIZE && p%PGSIZE_2M == 0 && end-p >= PGSIZE_2M && v.promote(p) {
+				p += PGSIZE_2M
+				continue
+			}
+		case syscall.MADV_NOHUGEPAGE:
+			if pgsize == PGSIZE_2M {
+				v.split(pte, base, pgsize)
+			}
+		}
+		p += PGSIZE
+	}
+	tlbb.flush()
+}
+
+// release unmaps the 4K page of entry pte at va and keeps its protection,
+// the page is freed by tlbb.flush.
+//go:nosplit
+func (v *vmmt) release(pte *entry, va uintptr) {
+	old := *pte
+	*pte = entry(_PTE_LAZY | uintptr(old)&(PTE_W|PTE_U|PTE_NX|_PTE_PROTNONE))
+	if old.present() {
+		tlbb.unmap(va, PGSIZE)
+	}
+	tlbb.free(old.addr(), false)
+}
+
+// split makes the allocated block of order at pa 4K pages, which are freed one by one
+//go:nosplit
+func (k *kmmt) split(pa uintptr, order int) {
+	flags := k.acquire()
+	if *k.pgmeta(pa) != _PG_ALLOC|uint8(order) {
+		throw("kmemt.split")
+	}
+	for i := uintptr(0); i < 1<<order; i++ {
+		*k.pgmeta(pa + i*PGSIZE) = _PG_ALLOC
+	}
+	k.release(flags)
+}
+
+// Madvise applies MADV_DONTNEED, MADV_HUGEPAGE and MADV_NOHUGEPAGE
+// to the pages in [va, va+size), other advices are ignored.
+// The go runtime never advises MADV_HUGEPAGE here, since it's enabled only if
+// /sys/kernel/mm/transparent_hugepage/hpage_pmd_size is read on startup,
+// the heap arenas get 2M pages from Mmap instead.
+//go:nosplit
+func Madvise(va, size, advice uintptr) {
+	if size == 0 {
+		return
+	}
+	vmm.madvise(va, size, advice)
+}
@@ -0,0 +1,187 @@
+package mm
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+const testVA = VMSTART
+
+// setupVmm makes an empty page table in the fake physical memory of setupKmm
+func setupVmm(t *testing.T) {
+	setupKmm(t)
+	kmm.freeRange(testPhysStart, testPhysEnd)
+	top := kmm.alloc()
+	sys.Memclr(P2V(top), PGSIZE)
+	vmm = vmmt{topPage: (*entryPage)(unsafe.Pointer(P2V(top))), cr3: top}
+}
+
+func freePages() uintptr {
+	return kmm.zones[_ZONE_DMA32].freePages + kmm.zones[_ZONE_NORMAL].freePages
+}
+
+// page returns the content of page at va through the direct map
+func page(t *testing.T, va uintptr) []byte {
+	t.Helper()
+	pte, pgsize := vmm.lookup(va)
+	if pte == nil || !pte.present() {
+		t.Fatalf("page %x not present", va)
+	}
+	return sys.UnsafeBuffer(P2V(pte.addr()+va&(pgsize-1)&^(PGSIZE-1)), PGSIZE)
+}
+
+// walks returns the number of tlb entries and page table reads to map [va, va+size)
+func walks(va, size uintptr) (entries, reads int) {
+	for p := va; p < va+size; {
+		_, pgsize := vmm.lookup(p)
+		entries++
+		// 4 levels for 4K page and 3 levels for 2M page
+		reads += 4
+		if pgsize == PGSIZE_2M {
+			reads--
+		}
+		p = p&^(pgsize-1) + pgsize
+	}
+	return
+}
+
+func TestMmapHuge(t *testing.T) {
+	setupVmm(t)
+	const size = 4*PGSIZE_2M + PGSIZE
+	if !vmm.mmap(testVA, size, PTE_P|PTE_W|PTE_U) {
+		t.Fatal("mmap failed")
+	}
+	if vmm.nhuge != 4 || Stats().HugePages != 4 {
+		t.Fatalf("expect 4 huge pages, got %d", vmm.nhuge)
+	}
+	for p := uintptr(testVA); p < testVA+size; p += PGSIZE {
+		pte, pgsize := vmm.lookup(p)
+		expect := uintptr(PGSIZE_2M)
+		if p >= testVA+4*PGSIZE_2M {
+			expect = PGSIZE
+		}
+		if pte == nil || !pte.present() || pgsize != expect {
+			t.Fatalf("page %x: expect present page of %d, got %d", p, expect, pgsize)
+		}
+	}
+	// the 2049 4K pages are mapped by 5 tlb entries
+	entries, reads := walks(testVA, size)
+	if entries != 5 || reads != 4*3+4 {
+		t.Fatalf("expect 5 tlb entries by 16 reads, got %d by %d", entries, reads)
+	}
+	t.Logf("%d pages: %d tlb entries and %d page table reads, %d and %d with 4K pages",
+		size/PGSIZE, entries, reads, size/PGSIZE, size/PGSIZE*4)
+
+	before := freePages()
+	vmm.munmap(testVA, size)
+	if vmm.nhuge != 0 || freePages() != before+4*512+1 {
+		t.Fatalf("expect all pages freed, got %d huge and %d free pages", vmm.nhuge, freePages()-before)
+	}
+}
+
+func TestMadviseHugepage(t *testing.T) {
+	setupVmm(t)
+	// the 4K pages are mapped if the range is smaller than 2M
+	for i := uintptr(0); i < 4; i++ {
+		vmm.mmap(testVA+i*PGSIZE_2M/4, PGSIZE_2M/4, PTE_P|PTE_W|PTE_U)
+	}
+	for p := uintptr(testVA); p < testVA+PGSIZE_2M; p += PGSIZE {
+		page(t, p)[0] = byte(p >> 12)
+	}
+	if entries, _ := walks(testVA, PGSIZE_2M); entries != 512 {
+		t.Fatalf("expect 512 tlb entries, got %d", entries)
+	}
+
+	before := freePages()
+	vmm.madvise(testVA, PGSIZE_2M, syscall.MADV_HUGEPAGE)
+	if entries, _ := walks(testVA, PGSIZE_2M); entries != 1 || vmm.nhuge != 1 {
+		t.Fatalf("expect promoted to 2M page, got %d entries", entries)
+	}
+	// the 4K pages and page table are freed
+	if freePages() != before-512+513 {
+		t.Fatalf("expect 1 page freed, got %d", freePages()-before)
+	}
+	for p := uintptr(testVA); p < testVA+PGSIZE_2M; p += PGSIZE {
+		if page(t, p)[0] != byte(p>>12) {
+			t.Fatalf("page %x not copied", p)
+		}
+	}
+
+	vmm.madvise(testVA, PGSIZE_2M, syscall.MADV_NOHUGEPAGE)
+	if entries, _ := walks(testVA, PGSIZE_2M); entries != 512 || vmm.nhuge != 0 {
+		t.Fatalf("expect split to 4K pages, got %d entries", entries)
+	}
+}
+
+func TestMadviseDontneed(t *testing.T) {
+	setupVmm(t)
+	start := freePages()
+	vmm.mmap(testVA, PGSIZE_2M, PTE_P|PTE_W|PTE_U)
+	for p := uintptr(testVA); p < testVA+PGSIZE_2M; p += PGSIZE {
+		page(t, p)[0] = 0xff
+	}
+
+	before := freePages()
+	shootdown := nshootdown
+	// the 2M page is split and 2 pages are released
+	vmm.madvise(testVA+PGSIZE, 2*PGSIZE, syscall.MADV_DONTNEED)
+	if freePages() != before-1+2 || nshootdown == shootdown {
+		t.Fatalf("expect 2 pages freed after shootdown, got %d", freePages()-before+1)
+	}
+	for _, p := range []uintptr{testVA + PGSIZE, testVA + 2*PGSIZE} {
+		pte, _ := vmm.lookup(p)
+		if pte == nil || pte.present() || !pte.lazy() || pte.addr() != 0 {
+			t.Fatalf("page %x: expect released, got %x", p, *pte)
+		}
+	}
+	if page(t, testVA)[0] != 0xff || page(t, testVA+3*PGSIZE)[0] != 0xff {
+		t.Fatal("the pages out of range are released")
+	}
+	// the syscalls can access the released pages
+	if !vmm.mapped(testVA, 4*PGSIZE, PTE_P|PTE_W) {
+		t.Fatal("expect released pages writable")
+	}
+
+	if !vmm.mprotect(testVA+2*PGSIZE, PGSIZE, protPerm(syscall.PROT_READ)) {
+		t.Fatal("mprotect released page failed")
+	}
+	cases := []struct {
+		va, errcode uintptr
+		ok          bool
+	}{
+		{testVA, _PF_WRITE | _PF_USER, false},
+		{testVA + PGSIZE, _PF_WRITE | _PF_USER, true},
+		{testVA + 2*PGSIZE, _PF_WRITE | _PF_USER, false},
+		{testVA + 2*PGSIZE, _PF_USER, true},
+		{testVA + PGSIZE_2M, _PF_USER, false},
+	}
+	for _, c := range cases {
+		if Fault(c.va, c.errcode) != c.ok {
+			t.Fatalf("fault %x %x: expect %v", c.va, c.errcode, c.ok)
+		}
+		if !c.ok {
+			continue
+		}
+		pte, _ := vmm.lookup(c.va)
+		if !pte.present() || pte.lazy() {
+			t.Fatalf("page %x: expect populated, got %x", c.va, *pte)
+		}
+		for _, b := range page(t, c.va) {
+			if b != 0 {
+				t.Fatalf("page %x: expect zeroed", c.va)
+			}
+		}
+	}
+	if pte, _ := vmm.lookup(testVA + 2*PGSIZE); *pte&PTE_W != 0 {
+		t.Fatalf("expect read only page, got %x", *pte)
+	}
+
+	// only the page tables are left
+	vmm.munmap(testVA, PGSIZE_2M)
+	if start-freePages() != 3 {
+		t.Fatalf("expect 3 page tables left, got %d pages", start-freePages())
+	}
+}
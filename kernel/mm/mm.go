@@ -1,30 +1,76 @@
 package mm
 
 import (
+	"sync/atomic"
+	"syscall"
 	"unsafe"
 
 	"github.com/icexin/eggos/drivers/multiboot"
 	"github.com/icexin/eggos/kernel/sys"
 )
 
+// The layout of virtual memory
+//
+//	[0, MEMSTART)                  identity map of kernel image and boot data
+//	[MEMSTART, 1<<47)              identity map of firmware tables and mmio, see Physmap and Fixmap
+//	[PHYSBASE, PHYSBASE+memtop)    direct map of all physical memory
+//	[VMSTART, ...)                 go heap and anonymous mmap
 const (
-	PGSIZE = 4 << 10
+	PGSIZE    = 4 << 10
+	PGSIZE_2M = 2 << 20
+	PGSIZE_1G = 1 << 30
 	// 1-100 Mb memory reverse for kernel image
 	MEMSTART = 100 << 20
 	// 默认可以使用的物理内存终止地址，如果能从grub那里获取就用grub的
 	DEFAULT_MEMTOP = 256 << 20
-	// 虚拟内存起始地址
-	VMSTART = 1 << 30
-
-	PTE_P = 0x001
-	PTE_W = 0x002
-	PTE_U = 0x004
+	// the max physical memory, limited by the size of direct map
+	MAX_MEMTOP = 64 << 40
+	// the start of direct map, the higher half of address space
+	PHYSBASE = 0xffff800000000000
+	// 虚拟内存起始地址, above the direct map
+	VMSTART = PHYSBASE + MAX_MEMTOP
+
+	// the memory mapped by boot64.S, used before switching to our page table
+	_BOOT_MAPTOP = 1 << 30
+
+	PTE_P  = 0x001
+	PTE_W  = 0x002
+	PTE_U  = 0x004
+	PTE_PS = 0x080
+	PTE_NX = 1 << 63
+
+	// the bits ignored by mmu, used to track the state of page
+	// the page is mapped by Fixmap or Physmap and not owned by allocator
+	_PTE_FIXED = 0x200
+	// the page is mapped with PROT_NONE, the present bit is cleared
+	_PTE_PROTNONE = 0x400
+	// the page is a guard page, which is never mapped
+	_PTE_GUARD = 0x800
+	// the page is released by MADV_DONTNEED and populated with a zeroed page
+	// on the next access, the present bit and address are cleared, see Fault
+	_PTE_LAZY = 1 << 52
+
+	_PTE_ADDR_MASK = 0x000ffffffffff000
+
+	// the bits of page fault error code
+	_PF_WRITE = 0x02
+	_PF_USER  = 0x04
+	_PF_FETCH = 0x10
+
+	_FLAGS_IF = 0x200
 
 	_ENTRY_NUMBER = PGSIZE / sys.PtrSize
+
+	_CPUID_FN_EXT      = 0x80000001
+	_CPUID_EDX_PAGE1GB = 1 << 26
 )
 
 var (
 	memtop uintptr
+	// the offset of direct map, P2V is identity before switching to the direct map
+	physOffset uintptr
+	// set if the cpus support no-execute page
+	nxEnabled bool
 
 	kmm = kmmt{voffset: VMSTART}
 	vmm vmmt
@@ -34,11 +80,42 @@ var (
 func pageEnable()
 
 //go:nosplit
-func lcr3(topPage *entryPage)
+func lcr3(pa uintptr)
+
+// invlpg invalidates the tlb entry of page va on current cpu
+//go:nosplit
+func invlpg(va uintptr)
+
+// flushAll invalidates all the tlb entries on current cpu
+//go:nosplit
+func flushAll()
 
 //go:linkname throw github.com/icexin/eggos/kernel.throw
 func throw(msg string)
 
+//go:linkname cpuid github.com/icexin/eggos/kernel.cpuid
+func cpuid(fn, cx uint32) (eax, ebx, ecx, edx uint32)
+
+// P2V returns the address of physical address pa in the direct map
+//go:nosplit
+func P2V(pa uintptr) uintptr {
+	return pa + physOffset
+}
+
+// V2P returns the physical address of va, 0 if va is not mapped
+// or released by MADV_DONTNEED and not accessed since then.
+//go:nosplit
+func V2P(va uintptr) uintptr {
+	if physOffset != 0 && va >= physOffset && va < physOffset+MAX_MEMTOP {
+		return va - physOffset
+	}
+	pte, size := vmm.lookup(va)
+	if pte == nil || !pte.present() {
+		return 0
+	}
+	return pte.addr() + va&(size-1)
+}
+
 //go:nosplit
 func pageRoundUp(size uintptr) uintptr {
 	return (size + PGSIZE - 1) &^ (PGSIZE - 1)
@@ -54,19 +131,41 @@ func pageEntryIdx(v uintptr, lvl int) uintptr {
 	return (v >> (12 + (lvl-1)*9)) & (_ENTRY_NUMBER - 1)
 }
 
-//go:notinheap
-type page struct {
-	next *page
+type kmmt struct {
+	// lock protects zones, since Alloc can be called outside of kernel
+	lock    uint32
+	voffset uintptr
+	zones   [_NR_ZONES]zone
+	// the page descriptors of all physical pages below memtop, see pgmeta
+	meta []uint8
+	// the next page allocated before the buddy allocator is ready, 0 after that
+	early uintptr
+	// the end of page descriptors and early pages, the memory below is never freed
+	metaEnd uintptr
+	// the bitmap of boot modules released by FreeModule, indexed by module
+	modsFreed [(multiboot.MaxModules + 63) / 64]uint64
+	// the interrupt flag is left alone, set by the tests running in user mode
+	nointr bool
 }
 
-type kmmstat struct {
-	alloc int
+//go:nosplit
+func (k *kmmt) acquire() uintptr {
+	flags := sys.Flags()
+	if !k.nointr {
+		sys.Cli()
+	}
+	for !atomic.CompareAndSwapUint32(&k.lock, 0, 1) {
+		sys.Pause()
+	}
+	return flags
 }
 
-type kmmt struct {
-	freelist *page
-	voffset  uintptr
-	stat     kmmstat
+//go:nosplit
+func (k *kmmt) release(flags uintptr) {
+	atomic.StoreUint32(&k.lock, 0)
+	if flags&_FLAGS_IF != 0 && !k.nointr {
+		sys.Sti()
+	}
 }
 
 //go:nosplit
@@ -79,99 +178,194 @@ func (k *kmmt) sbrk(n uintptr) uintptr {
 	return p
 }
 
+//go:notinheap
+type entryPage [_ENTRY_NUMBER]entry
+
+type entry uintptr
+
 //go:nosplit
-func (k *kmmt) alloc() uintptr {
-	r := k.freelist
-	if r == nil {
-		throw("kmemt.alloc")
-	}
-	k.stat.alloc++
-	k.freelist = r.next
-	return uintptr(unsafe.Pointer(r))
+func (p entry) present() bool {
+	return p&PTE_P != 0
 }
 
+// huge reports whether the entry above level 1 maps a 2M or 1G page
 //go:nosplit
-func (k *kmmt) freeRange(start, end uintptr) {
-	p := pageRoundUp(start)
-	for ; p+PGSIZE <= end; p += PGSIZE {
-		k.free(p)
-	}
+func (p entry) huge() bool {
+	return p&(PTE_P|PTE_PS) == PTE_P|PTE_PS
 }
 
+// mapped reports whether a physical page is mapped, accessible or not
 //go:nosplit
-func (k *kmmt) free(p uintptr) {
-	if p%PGSIZE != 0 || p >= memtop {
-		throw("kmemt.free")
-	}
-	r := (*page)(unsafe.Pointer(p))
-	r.next = k.freelist
-	k.freelist = r
+func (p entry) mapped() bool {
+	return p&(PTE_P|_PTE_PROTNONE) != 0 && p&_PTE_LAZY == 0
 }
 
-//go:notinheap
-type entryPage [_ENTRY_NUMBER]entry
-
-type entry uintptr
-
+// lazy reports whether the page is released and not populated yet
 //go:nosplit
-func (p entry) present() bool {
-	return p&PTE_P != 0
+func (p entry) lazy() bool {
+	return p&_PTE_LAZY != 0
 }
 
 //go:nosplit
 func (p entry) addr() uintptr {
-	return uintptr(p) &^ 0xfff
+	return uintptr(p) & _PTE_ADDR_MASK
+}
+
+// protPerm returns the pte bits of mmap protection prot
+//go:nosplit
+func protPerm(prot uintptr) uintptr {
+	if prot&(syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC) == 0 {
+		return _PTE_PROTNONE
+	}
+	perm := uintptr(PTE_P | PTE_U)
+	if prot&syscall.PROT_WRITE != 0 {
+		perm |= PTE_W
+	}
+	if prot&syscall.PROT_EXEC == 0 && nxEnabled {
+		perm |= PTE_NX
+	}
+	return perm
 }
 
 //go:nosplit
 func (p entry) entryPage() *entryPage {
-	return (*entryPage)(unsafe.Pointer(p.addr()))
+	return (*entryPage)(unsafe.Pointer(P2V(p.addr())))
 }
 
 type vmmt struct {
 	topPage *entryPage
+	// the physical address of topPage
+	cr3 uintptr
+	// number of 2M pages mapped by mmap
+	nhuge uintptr
 }
 
+// munmap unmaps the pages in [va, va+size), the holes in range are skipped.
 //go:nosplit
-func (v *vmmt) munmap(va, size uintptr) bool {
-	// println("mumap va=", va, " size=", size)
+func (v *vmmt) munmap(va, size uintptr) {
 	p := pageRoundDown(va)
-	last := pageRoundDown(va + size - 1)
-	for ; p != last; p += PGSIZE {
-		pte := v.walkpgdir(p, false)
+	end := pageRoundUp(va + size)
+	for p < end {
+		pte, pgsize := v.lookup(p)
 		if pte == nil {
+			// the page table of 2M range is not present
+			p = (p + PGSIZE_2M) &^ (PGSIZE_2M - 1)
+			continue
+		}
+		base := p &^ (pgsize - 1)
+		if base < p || base+pgsize > end {
+			// unmap part of huge page
+			v.split(pte, base, pgsize)
+			continue
+		}
+		v.unmapPage(pte, base, pgsize)
+		p = base + pgsize
+	}
+	tlbb.flush()
+}
+
+// unmapPage clears the entry pte of the page at va, the page is freed
+// by tlbb.flush after the tlb of all cpus are flushed.
+//go:nosplit
+func (v *vmmt) unmapPage(pte *entry, va, pgsize uintptr) {
+	old := *pte
+	*pte = 0
+	if old.present() {
+		tlbb.unmap(va, pgsize)
+	}
+	if old.mapped() && old&_PTE_FIXED == 0 {
+		if pgsize != PGSIZE {
+			v.nhuge--
+		}
+		tlbb.free(old.addr(), pgsize != PGSIZE)
+	}
+}
+
+// mprotect changes the protection of pages in [va, va+size),
+// it returns false if any page in range is not mapped.
+//go:nosplit
+func (v *vmmt) mprotect(va, size, perm uintptr) bool {
+	p := pageRoundDown(va)
+	end := pageRoundUp(va + size)
+	// check all pages before changing them
+	for ; p < end; p += PGSIZE {
+		pte, _ := v.lookup(p)
+		if pte == nil || !pte.mapped() && !pte.lazy() {
 			return false
 		}
-		if !pte.present() {
+	}
+	for p = pageRoundDown(va); p < end; {
+		pte, pgsize := v.lookup(p)
+		base := p &^ (pgsize - 1)
+		if pgsize != PGSIZE && (base < p || base+pgsize > end || perm&PTE_P == 0) {
+			// the huge page can't be inaccessible, see entry.huge
+			v.split(pte, base, pgsize)
+			continue
+		}
+		if pte.lazy() {
+			// the page is populated with the new protection
+			*pte = entry(_PTE_LAZY | perm&^PTE_P)
+			p += PGSIZE
+			continue
+		}
+		flags := uintptr(*pte) & _PTE_FIXED
+		if pgsize != PGSIZE {
+			flags |= PTE_PS
+		}
+		*pte = entry(pte.addr() | flags | perm)
+		p = base + pgsize
+	}
+	// the entries cached with more permissions are flushed,
+	// and the ones with less cause page faults not handled.
+	start := pageRoundDown(va)
+	tlbShootdown(start, p-start)
+	return true
+}
+
+// guard makes the pages in [va, va+size) guard pages
+//go:nosplit
+func (v *vmmt) guard(va, size uintptr) bool {
+	v.munmap(va, size)
+	p := pageRoundDown(va)
+	last := pageRoundDown(va + size - 1)
+	for {
+		pte := v.walkpgdir(p, true)
+		if pte == nil {
 			return false
 		}
-		kmm.free(pte.addr())
-		*pte = 0
+		*pte = _PTE_GUARD
+		if p == last {
+			break
+		}
+		p += PGSIZE
 	}
 	return true
 }
 
+// mmap maps the new pages in [va, va+size), 2M pages are used if alignment allows.
+// There is no need to flush tlb, since the entries not present are never cached.
 //go:nosplit
 func (v *vmmt) mmap(va, size, perm uintptr) bool {
 	// println("mmap va=", unsafe.Pointer(va), " size=", size>>10)
 	var pa uintptr
 	p := pageRoundDown(va)
-	last := pageRoundDown(va + size - 1)
-	for {
+	end := pageRoundUp(va + size)
+	for p < end {
+		if p%PGSIZE_2M == 0 && end-p >= PGSIZE_2M && v.mapHuge(p, perm) {
+			p += PGSIZE_2M
+			continue
+		}
 		pte := v.walkpgdir(p, true)
 		if pte == nil {
 			return false
 		}
-		if pte.present() {
+		if pte.mapped() {
 			throw("mmap remap")
 		} else {
 			pa = kmm.alloc()
-			sys.Memclr(pa, PGSIZE)
+			sys.Memclr(P2V(pa), PGSIZE)
 			*pte = entry(pa | perm)
 		}
-		if p == last {
-			break
-		}
 		p += PGSIZE
 	}
 	return true
@@ -188,28 +382,201 @@ func Mmap(va, size uintptr) uintptr {
 		va = kmm.sbrk(size)
 	}
 	vmm.mmap(va, size, PTE_P|PTE_W|PTE_U)
-	// flush page table cache
-	lcr3(vmm.topPage)
 	return va
 }
 
+// MmapProt like Mmap but maps the pages with protection prot,
+// the pages of PROT_NONE are allocated but not accessible.
+//go:nosplit
+func MmapProt(va, size, prot uintptr) uintptr {
+	if va == 0 {
+		va = kmm.sbrk(size)
+	}
+	vmm.mmap(va, size, protPerm(prot))
+	return va
+}
+
+// MmapGuard maps size bytes below which a guard page is left,
+// the access of guard page is reported by IsGuard.
 //go:nosplit
-func Munmap(va, size uintptr) bool {
-	ok := vmm.munmap(va, size)
-	lcr3(vmm.topPage)
-	return ok
+func MmapGuard(size uintptr) uintptr {
+	va := kmm.sbrk(PGSIZE + size)
+	vmm.guard(va, PGSIZE)
+	vmm.mmap(va+PGSIZE, size, PTE_P|PTE_W|PTE_U)
+	return va + PGSIZE
+}
+
+// Munmap unmaps the pages in [va, va+size), the pages not mapped are ignored.
+//go:nosplit
+func Munmap(va, size uintptr) {
+	if size == 0 {
+		return
+	}
+	vmm.munmap(va, size)
+}
+
+// Mprotect changes the protection of pages in [va, va+size),
+// it returns false if any page in range is not mapped.
+//go:nosplit
+func Mprotect(va, size, prot uintptr) bool {
+	if size == 0 {
+		return true
+	}
+	return vmm.mprotect(va, size, protPerm(prot))
+}
+
+// Guard unmaps the pages in [va, va+size) and makes them guard pages
+//go:nosplit
+func Guard(va, size uintptr) {
+	if size == 0 {
+		return
+	}
+	if !vmm.guard(va, size) {
+		throw("guard")
+	}
+}
+
+// IsGuard reports whether va is in a guard page
+//go:nosplit
+func IsGuard(va uintptr) bool {
+	pte := vmm.walkpgdir(pageRoundDown(va), false)
+	return pte != nil && *pte == _PTE_GUARD
+}
+
+// EnableNX makes the pages mapped without PROT_EXEC no-execute,
+// it must be called after all cpus enable the NXE bit of EFER.
+//go:nosplit
+func EnableNX() {
+	nxEnabled = true
 }
 
 //go:nosplit
 func Fixmap(va, pa, size uintptr) {
 	vmm.fixmap(va, pa, size, PTE_P|PTE_W|PTE_U)
-	// flush page table cache
-	lcr3(vmm.topPage)
 }
 
+// Physmap identity maps the physical range [pa, pa+size),
+// pages that are already mapped are left untouched.
+// It's used to access firmware tables and MMIO registers out of memtop.
+//go:nosplit
+func Physmap(pa, size uintptr) {
+	p := pageRoundDown(pa)
+	last := pageRoundDown(pa + size - 1)
+	for {
+		pte := vmm.walkpgdir(p, true)
+		if pte == nil {
+			throw("physmap")
+		}
+		if !pte.mapped() {
+			*pte = entry(p | PTE_P | PTE_W | PTE_U | _PTE_FIXED)
+		}
+		if p == last {
+			break
+		}
+		p += PGSIZE
+	}
+}
+
+// PageTable returns the physical address of the top level page table.
+//go:nosplit
+func PageTable() uintptr {
+	return vmm.cr3
+}
+
+// Present reports whether the page of va is mapped
+//go:nosplit
+func Present(va uintptr) bool {
+	pte := vmm.walkpgdir(pageRoundDown(va), false)
+	return pte != nil && pte.present()
+}
+
+// Spurious reports whether the page fault at va is caused by the stale tlb entries
+// or the pages being changed, the faulting instruction can be retried.
+// errcode is the error code of page fault.
+//go:nosplit
+func Spurious(va, errcode uintptr) bool {
+	pte, _ := vmm.lookup(va)
+	if pte == nil || !pte.present() {
+		return false
+	}
+	if errcode&_PF_WRITE != 0 && *pte&PTE_W == 0 {
+		return false
+	}
+	if errcode&_PF_USER != 0 && *pte&PTE_U == 0 {
+		return false
+	}
+	if errcode&_PF_FETCH != 0 && *pte&PTE_NX != 0 {
+		return false
+	}
+	return true
+}
+
+// Fault populates the page of va released by MADV_DONTNEED with a zeroed page,
+// it returns false if va is not such a page or the access is not allowed.
+// errcode is the error code of page fault.
+//go:nosplit
+func Fault(va, errcode uintptr) bool {
+	pte, _ := vmm.lookup(va)
+	if pte == nil || !pte.lazy() || *pte&_PTE_PROTNONE != 0 {
+		return false
+	}
+	perm := uintptr(*pte)&^_PTE_LAZY | PTE_P
+	if errcode&_PF_WRITE != 0 && perm&PTE_W == 0 {
+		return false
+	}
+	if errcode&_PF_USER != 0 && perm&PTE_U == 0 {
+		return false
+	}
+	if errcode&_PF_FETCH != 0 && perm&PTE_NX != 0 {
+		return false
+	}
+	pa := kmm.alloc()
+	sys.Memclr(P2V(pa), PGSIZE)
+	// the entries not present are never cached, no need to flush tlb
+	*pte = entry(pa | perm)
+	return true
+}
+
+// Writable reports whether the pages of [va, va+size) are all mapped writable
+//go:nosplit
+func Writable(va, size uintptr) bool {
+	return vmm.mapped(va, size, PTE_P|PTE_W)
+}
+
+// Readable reports whether the pages of [va, va+size) are all mapped
+//go:nosplit
+func Readable(va, size uintptr) bool {
+	return vmm.mapped(va, size, PTE_P)
+}
+
+// mapped reports whether the pages of [va, va+size) all have the perm bits,
+// the pages released by MADV_DONTNEED are checked as if they were populated.
+//go:nosplit
+func (v *vmmt) mapped(va, size, perm uintptr) bool {
+	if va+size < va {
+		return false
+	}
+	for p := va; p < va+size; {
+		pte, pgsize := v.lookup(p)
+		if pte == nil {
+			return false
+		}
+		bits := uintptr(*pte)
+		if pte.lazy() && bits&_PTE_PROTNONE == 0 {
+			bits |= PTE_P
+		}
+		if bits&perm != perm {
+			return false
+		}
+		p = p&^(pgsize-1) + pgsize
+	}
+	return true
+}
+
+// Alloc returns a zeroed page in the direct map, use V2P to get its physical address
 //go:nosplit
 func Alloc() uintptr {
-	ptr := kmm.alloc()
+	ptr := P2V(kmm.alloc())
 	buf := sys.UnsafeBuffer(ptr, PGSIZE)
 	for i := range buf {
 		buf[i] = 0
@@ -217,6 +584,31 @@ func Alloc() uintptr {
 	return ptr
 }
 
+// Free puts back the page allocated by Alloc
+//go:nosplit
+func Free(p uintptr) {
+	kmm.free(V2P(p))
+}
+
+// AllocPages allocates 1<<order physically contiguous pages aligned to their size,
+// it returns 0 if there is no such block.
+//go:nosplit
+func AllocPages(order int) uintptr {
+	p := kmm.allocOrder(order)
+	if p == 0 {
+		return 0
+	}
+	p = P2V(p)
+	sys.Memclr(p, PGSIZE<<order)
+	return p
+}
+
+// FreePages puts back the pages allocated by AllocPages
+//go:nosplit
+func FreePages(p uintptr, order int) {
+	kmm.freeOrder(V2P(p), order)
+}
+
 //go:nosplit
 func (v *vmmt) fixmap(va, pa, size, perm uintptr) bool {
 	p := pageRoundDown(va)
@@ -226,10 +618,23 @@ func (v *vmmt) fixmap(va, pa, size, perm uintptr) bool {
 		if pte == nil {
 			return false
 		}
-		if pte.present() {
-			throw("fixmap remap")
+		if pte.mapped() {
+			// mapping the same physical page again is allowed,
+			// eg. msi-x table lives in the BAR of driver
+			if pte.huge() {
+				if V2P(p) != pa {
+					throw("fixmap remap")
+				}
+			} else {
+				if pte.addr() != pa {
+					throw("fixmap remap")
+				}
+				*pte = entry(pa | perm | _PTE_FIXED)
+				invlpg(p)
+			}
+		} else {
+			*pte = entry(pa | perm | _PTE_FIXED)
 		}
-		*pte = entry(pa | perm)
 		if p == last {
 			break
 		}
@@ -239,54 +644,127 @@ func (v *vmmt) fixmap(va, pa, size, perm uintptr) bool {
 	return true
 }
 
+// walklvl returns the entry of va at level lvl, the page tables on the way
+// are allocated if alloc is true. The entry of huge page above lvl is returned
+// if there is one.
 //go:nosplit
-func (v *vmmt) walkpglvl(pg *entryPage, va uintptr, lvl int, alloc bool) *entry {
-	idx := pageEntryIdx(va, lvl)
-	if int(idx) >= len(pg) {
-		throw("bad page index")
+func (v *vmmt) walklvl(va uintptr, lvl int, alloc bool) *entry {
+	pg := v.topPage
+	for i := 4; ; i-- {
+		pe := &pg[pageEntryIdx(va, i)]
+		if i <= lvl || pe.huge() {
+			return pe
+		}
+		if !pe.present() {
+			if !alloc {
+				return nil
+			}
+			// alloc a page to map entry page
+			addr := kmm.alloc()
+			sys.Memclr(P2V(addr), PGSIZE)
+			*pe = entry(addr | PTE_P | PTE_W | PTE_U)
+		}
+		pg = pe.entryPage()
 	}
-	pe := &pg[idx]
-	if lvl == 1 {
-		return pe
+}
+
+//go:nosplit
+func (v *vmmt) walkpgdir(va uintptr, alloc bool) *entry {
+	return v.walklvl(va, 1, alloc)
+}
+
+// lookup returns the last level entry of va and the size of page it maps,
+// nil if the page table of va is not present.
+//go:nosplit
+func (v *vmmt) lookup(va uintptr) (*entry, uintptr) {
+	pg := v.topPage
+	for i := 4; i >= 1; i-- {
+		pe := &pg[pageEntryIdx(va, i)]
+		if i == 1 || pe.huge() {
+			return pe, PGSIZE << ((i - 1) * 9)
+		}
+		if !pe.present() {
+			return nil, 0
+		}
+		pg = pe.entryPage()
 	}
+	return nil, 0
+}
 
-	// find entry
-	if pe.present() {
-		return pe
+// maplarge maps [va, va+size) to [pa, pa+size) by the pages of pgsize,
+// va, pa and size must be aligned to pgsize.
+//go:nosplit
+func (v *vmmt) maplarge(va, pa, size, pgsize, perm uintptr) {
+	lvl := 2
+	if pgsize == PGSIZE_1G {
+		lvl = 3
 	}
-	// not found and no alloc
-	if !alloc {
-		return nil
+	for end := va + size; va < end; va += pgsize {
+		pe := v.walklvl(va, lvl, true)
+		if pe.present() {
+			throw("maplarge remap")
+		}
+		*pe = entry(pa | perm | PTE_PS | _PTE_FIXED)
+		pa += pgsize
 	}
-	// alloc a page to map entry page
-	addr := kmm.alloc()
-	if addr == 0 {
-		return nil
+}
+
+// mapDirect maps the ram and ACPI ranges of memory map at PHYSBASE with write-back cache,
+// the holes between them are left unmapped, which may be mmio with side effects.
+//go:nosplit
+func mapDirect(maxpg uintptr) {
+	if !multiboot.Enabled() {
+		vmm.mapPhys(0, memtop, maxpg)
+		return
+	}
+	for _, e := range multiboot.BootInfo.MmapEntries() {
+		switch e.Type {
+		case multiboot.MemoryAvailable, multiboot.MemoryACPIReclaimable, multiboot.MemoryNVS:
+		default:
+			continue
+		}
+		end := e.Addr + e.Len
+		if end > MAX_MEMTOP {
+			end = MAX_MEMTOP
+		}
+		if e.Addr < end {
+			vmm.mapPhys(uintptr(e.Addr), uintptr(end), maxpg)
+		}
 	}
-	sys.Memclr(addr, PGSIZE)
-	// map new page to entry
-	*pe = entry(addr | PTE_P | PTE_W | PTE_U)
-	// log.PrintHex(uintptr(unsafe.Pointer(pg)))
-	// log.PrintStr("@")
-	// log.PrintHex(idx)
-	// log.PrintStr("=")
-	// log.PrintHex(addr)
-	// log.PrintStr("\n")
-	return pe
 }
 
+// mapPhys maps the physical range [pa, end) in the direct map, the pages
+// no larger than maxpg are used if alignment allows. The pages mapped are skipped,
+// since the ranges may share the pages at the boundary.
 //go:nosplit
-func (v *vmmt) walkpgdir(va uintptr, alloc bool) *entry {
-	epg := v.topPage
-	var pe *entry
-	for i := 4; i >= 1; i-- {
-		pe = v.walkpglvl(epg, va, i, alloc)
-		if pe == nil {
-			return nil
+func (v *vmmt) mapPhys(pa, end, maxpg uintptr) {
+	pa = pageRoundDown(pa)
+	end = pageRoundUp(end)
+	for pa < end {
+		if pte, size := v.lookup(PHYSBASE + pa); pte != nil && pte.present() {
+			pa = pa&^(size-1) + size
+			continue
 		}
-		epg = pe.entryPage()
+		pgsize, lvl := uintptr(PGSIZE), 1
+		switch {
+		case maxpg == PGSIZE_1G && pa%PGSIZE_1G == 0 && end-pa >= PGSIZE_1G:
+			pgsize, lvl = PGSIZE_1G, 3
+		case pa%PGSIZE_2M == 0 && end-pa >= PGSIZE_2M:
+			pgsize, lvl = PGSIZE_2M, 2
+		}
+		pe := v.walklvl(PHYSBASE+pa, lvl, true)
+		// part of the large page is mapped by a page table
+		for pe.present() {
+			pgsize, lvl = pgsize>>9, lvl-1
+			pe = v.walklvl(PHYSBASE+pa, lvl, true)
+		}
+		perm := uintptr(PTE_P | PTE_W | PTE_U | _PTE_FIXED)
+		if lvl > 1 {
+			perm |= PTE_PS
+		}
+		*pe = entry(pa | perm)
+		pa += pgsize
 	}
-	return pe
 }
 
 //go:nosplit
@@ -300,8 +778,8 @@ func findMemTop() uintptr {
 			continue
 		}
 		ptop := e.Addr + e.Len
-		if ptop > VMSTART {
-			ptop = VMSTART
+		if ptop > MAX_MEMTOP {
+			ptop = MAX_MEMTOP
 		}
 		if top < uintptr(ptop) {
 			top = uintptr(ptop)
@@ -317,14 +795,32 @@ func findMemTop() uintptr {
 func Init() {
 	memtop = findMemTop()
 	kmm.voffset = VMSTART
-	kmm.freeRange(MEMSTART, memtop)
-
-	vmm.topPage = (*entryPage)(unsafe.Pointer(kmm.alloc()))
-	sys.Memclr(uintptr(unsafe.Pointer(vmm.topPage)), PGSIZE)
-	// 4096-MEMTOP 用来让微内核访问到所有的地址空间
-	// identity map all phy memory
-	vmm.fixmap(4096, 4096, memtop-4096, PTE_P|PTE_W|PTE_U)
+	// the page tables are allocated after the page descriptors,
+	// from the memory mapped by boot page table.
+	kmm.early = pageRoundUp(MEMSTART + memtop/PGSIZE)
+
+	top := kmm.alloc()
+	sys.Memclr(top, PGSIZE)
+	vmm.topPage = (*entryPage)(unsafe.Pointer(top))
+	vmm.cr3 = top
+	// identity map the low memory except the null page
+	vmm.fixmap(PGSIZE, PGSIZE, PGSIZE_2M-PGSIZE, PTE_P|PTE_W|PTE_U)
+	vmm.maplarge(PGSIZE_2M, PGSIZE_2M, MEMSTART-PGSIZE_2M, PGSIZE_2M, PTE_P|PTE_W|PTE_U)
+
+	// map the physical memory at PHYSBASE, using 1G pages if supported
+	pgsize := uintptr(PGSIZE_2M)
+	_, _, _, edx := cpuid(_CPUID_FN_EXT, 0)
+	if edx&_CPUID_EDX_PAGE1GB != 0 {
+		pgsize = PGSIZE_1G
+	}
+	mapDirect(pgsize)
+	if kmm.early > _BOOT_MAPTOP {
+		throw("too many early pages")
+	}
 
-	lcr3(vmm.topPage)
+	lcr3(vmm.cr3)
 	pageEnable()
+	physOffset = PHYSBASE
+	vmm.topPage = (*entryPage)(unsafe.Pointer(P2V(top)))
+	kmm.init()
 }
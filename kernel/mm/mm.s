@@ -14,10 +14,22 @@ TEXT ·pageEnable(SB), NOSPLIT, $0-0
 	MOVQ AX, CR0
 	RET
 
-// lcr3(topPage uint64) sets the CR3 register.
+// lcr3(pa uint64) sets the CR3 register.
 TEXT ·lcr3(SB), NOSPLIT, $0-8
 	// setup page dir
-	MOVQ topPage+0(FP), AX
+	MOVQ pa+0(FP), AX
 	MOVQ AX, CR3
 	RET
 
+
+// invlpg(va uint64) invalidates the TLB entry of va.
+TEXT ·invlpg(SB), NOSPLIT, $0-8
+	MOVQ   va+0(FP), AX
+	INVLPG (AX)
+	RET
+
+// flushAll invalidates all the TLB entries by reloading CR3.
+TEXT ·flushAll(SB), NOSPLIT, $0-0
+	MOVQ CR3, AX
+	MOVQ AX, CR3
+	RET
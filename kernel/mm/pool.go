@@ -28,7 +28,7 @@ func PoolInit(p *Pool, size uintptr) {
 
 //go:nosplit
 func (p *Pool) grow() {
-	start := kmm.alloc()
+	start := P2V(kmm.alloc())
 	end := start + PGSIZE
 	for v := start; v+p.size <= end; v += p.size {
 		p.Free(v)
@@ -25,3 +25,14 @@ func SysFixedMmap(vaddr, paddr, size uintptr) {
 		panic(err.Error())
 	}
 }
+
+// SysMmapGuard like SysMmap but leaves a guard page below the mapping,
+// run in user mode
+func SysMmapGuard(size uintptr) uintptr {
+	mem := SysMmap(0, PGSIZE+size)
+	_, _, err := syscall.Syscall6(syscall.SYS_MMAP, mem, PGSIZE, syscall.PROT_NONE, syscall.MAP_FIXED, 0, 0)
+	if err != 0 {
+		panic(err.Error())
+	}
+	return mem + PGSIZE
+}
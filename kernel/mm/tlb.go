@@ -0,0 +1,87 @@
+package mm
+
+import _ "unsafe"
+
+// The tlb entries of other cpus are flushed by shootdown IPI, see kernel.tlbShootdown.
+// It's required when a page is unmapped or its protection is changed,
+// the pages unmapped are freed only after all the cpus flush them.
+
+const (
+	// the tlb is flushed entirely if more pages are changed
+	_TLB_FLUSH_MAX = 32
+	// number of pages freed at once after the shootdown
+	_TLB_BATCH_SIZE = 64
+)
+
+// tlbShootdown flushes the tlb entries of [va, va+size) on all cpus
+//go:linkname tlbShootdown github.com/icexin/eggos/kernel.tlbShootdown
+func tlbShootdown(va, size uintptr)
+
+// tlbBatch collects the pages unmapped, which are freed after the shootdown.
+// Like vmm, it's protected by the kernel lock.
+type tlbBatch struct {
+	// the range of pages unmapped
+	start, end uintptr
+	n          int
+	// the physical address of pages, the low bit marks a 2M page
+	pages [_TLB_BATCH_SIZE]uintptr
+}
+
+var tlbb tlbBatch
+
+// FlushTLB invalidates the tlb entries of [va, va+size) on current cpu
+//go:nosplit
+func FlushTLB(va, size uintptr) {
+	if size > _TLB_FLUSH_MAX*PGSIZE {
+		flushAll()
+		return
+	}
+	for p := pageRoundDown(va); p < va+size; p += PGSIZE {
+		invlpg(p)
+	}
+}
+
+// unmap adds the page at va unmapped to the range flushed
+//go:nosplit
+func (b *tlbBatch) unmap(va, pgsize uintptr) {
+	if b.start == b.end {
+		b.start, b.end = va, va+pgsize
+		return
+	}
+	if va < b.start {
+		b.start = va
+	}
+	if va+pgsize > b.end {
+		b.end = va + pgsize
+	}
+}
+
+// free frees the page at pa after the shootdown, the page must be unmapped before.
+//go:nosplit
+func (b *tlbBatch) free(pa uintptr, huge bool) {
+	if b.n == len(b.pages) {
+		b.flush()
+	}
+	if huge {
+		pa |= 1
+	}
+	b.pages[b.n] = pa
+	b.n++
+}
+
+// flush does the shootdown and frees the pages collected
+//go:nosplit
+func (b *tlbBatch) flush() {
+	if b.start != b.end {
+		tlbShootdown(b.start, b.end-b.start)
+	}
+	for i := 0; i < b.n; i++ {
+		pa := b.pages[i]
+		if pa&1 != 0 {
+			kmm.freeOrder(pa&^1, _HUGE_ORDER)
+		} else {
+			kmm.free(pa)
+		}
+	}
+	b.start, b.end, b.n = 0, 0, 0
+}
@@ -1,16 +1,32 @@
 package kernel
 
 import (
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/icexin/eggos/drivers/qemu"
-	"github.com/icexin/eggos/drivers/uart"
 	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/log"
 )
 
+const (
+	// offset of goid in runtime.g, sync with go1.16
+	_G_GOID_OFFSET = 152
+)
+
 var (
 	panicPcs [32]uintptr
+	// sync with trapFrame
+	tfRegNames = [...]string{
+		"ax", "bx", "cx", "dx",
+		"bp", "si", "di", "r8",
+		"r9", "r10", "r11", "r12",
+		"r13", "r14", "r15",
+		"trapno", "err",
+		"ip", "cs", "flags", "sp", "ss",
+	}
+	// only the first panic is reported, other cpus stop here
+	panicking uint32
 )
 
 //go:nosplit
@@ -20,38 +36,109 @@ func throw(msg string) {
 	throwtf(tf, msg)
 }
 
+// throwtf prints the panic message, registers and the symbolized stack trace of tf,
+// followed by a crash block for tools, and exits qemu.
+// The crash block looks like:
+//
+//	-----BEGIN EGGOS CRASH-----
+//	msg=trap fault in kernel
+//	tid=3
+//	...
+//	frame=0x1234 main.main /path/to/main.go:10
+//	-----END EGGOS CRASH-----
 //go:nosplit
 func throwtf(tf *trapFrame, msg string) {
 	sys.Cli()
+	if !atomic.CompareAndSwapUint32(&panicking, 0, 1) {
+		for {
+			sys.Hlt()
+		}
+	}
 	n := callers(tf, panicPcs[:])
-	uart.WriteString(msg)
-	uart.WriteByte('\n')
+	printPanic(tf, msg, n)
+	printCrashBlock(tf, msg, n)
 
-	log.PrintStr("0x")
-	log.PrintHex(tf.IP)
+	qemu.Exit(0xff)
+	for {
+	}
+}
+
+// printPanic prints the panic for human
+//go:nosplit
+func printPanic(tf *trapFrame, msg string, n int) {
+	log.PrintStr(msg)
 	log.PrintStr("\n")
-	for i := 0; i < n; i++ {
-		log.PrintStr("0x")
-		log.PrintHex(panicPcs[i])
+	if tf.Trapno < uintptr(len(trapnum)) {
+		log.PrintStr("trap: ")
+		log.PrintStr(trapnum[tf.Trapno])
 		log.PrintStr("\n")
 	}
+	// the watchdog may panic in NMI handler when the cpu runs no thread
+	if t := Mythread(); t != nil {
+		log.PrintStr("thread: ")
+		log.PrintInt(t.id)
+		if goid, ok := curgoid(t); ok {
+			log.PrintStr(" goroutine: ")
+			log.PrintInt(int(goid))
+		}
+		log.PrintStr("\n")
+	}
+	printTfRegs(tf, "", " ")
+	log.PrintStr("\n")
+	for i := 0; i < n && i < len(panicPcs); i++ {
+		pc := panicPcs[i]
+		printSymbol(pc, i == 0, "()\n\t")
+		log.PrintStr(" pc=0x")
+		log.PrintHex(pc)
+		log.PrintStr("\n")
+	}
+}
 
-	qemu.Exit(0xff)
-	for {
+// printCrashBlock prints the crash block for tools, one key=value per line
+//go:nosplit
+func printCrashBlock(tf *trapFrame, msg string, n int) {
+	log.PrintStr("-----BEGIN EGGOS CRASH-----\n")
+	log.PrintStr("msg=")
+	log.PrintStr(msg)
+	log.PrintStr("\n")
+	if t := Mythread(); t != nil {
+		log.PrintStr("tid=")
+		log.PrintInt(t.id)
+		log.PrintStr("\n")
+		if goid, ok := curgoid(t); ok {
+			log.PrintStr("goid=")
+			log.PrintInt(int(goid))
+			log.PrintStr("\n")
+		}
+	}
+	printReg("cr2", sys.Cr2())
+	printTfRegs(tf, "reg.", "\n")
+	for i := 0; i < n && i < len(panicPcs); i++ {
+		pc := panicPcs[i]
+		log.PrintStr("frame=0x")
+		log.PrintHex(pc)
+		log.PrintStr(" ")
+		printSymbol(pc, i == 0, " ")
+		log.PrintStr("\n")
 	}
+	log.PrintStr("-----END EGGOS CRASH-----\n")
 }
 
+// callers fills pcs with the pc of tf and the return addresses of the frame pointer chain
 //go:nosplit
 func callers(tf *trapFrame, pcs []uintptr) int {
+	if len(pcs) == 0 {
+		return 0
+	}
+	pcs[0] = tf.IP
 	fp := tf.BP
 	var i int
-	for i = 0; i < len(pcs); i++ {
-		pc := deref(fp + 8)
-		pcs[i] = pc
-		fp = deref(fp)
-		if fp == 0 {
+	for i = 1; i < len(pcs); i++ {
+		if fp == 0 || fp&(sys.PtrSize-1) != 0 {
 			break
 		}
+		pcs[i] = deref(fp + 8)
+		fp = deref(fp)
 	}
 	return i
 }
@@ -60,3 +147,53 @@ func callers(tf *trapFrame, pcs []uintptr) int {
 func deref(addr uintptr) uintptr {
 	return *(*uintptr)(unsafe.Pointer(addr))
 }
+
+// curgoid returns the id of goroutine running on t
+//go:nosplit
+func curgoid(t *Thread) (int64, bool) {
+	// the tls is not set on idle thread and early boot
+	if t.fsBase == 0 {
+		return 0, false
+	}
+	g := getg()
+	if g == 0 {
+		return 0, false
+	}
+	return *(*int64)(unsafe.Pointer(g + _G_GOID_OFFSET)), true
+}
+
+// printSymbol prints the function, file and line of pc separated by sep,
+// pc is a return address if not exact.
+//go:nosplit
+func printSymbol(pc uintptr, exact bool, sep string) {
+	if !exact {
+		// the call instruction
+		pc--
+	}
+	f := findFunc(pc)
+	if f == nil {
+		log.PrintStr("?")
+		log.PrintStr(sep)
+		log.PrintStr("?:0")
+		return
+	}
+	log.PrintStr(funcName(f))
+	log.PrintStr(sep)
+	file, line := funcLine(f, pc)
+	log.PrintStr(file)
+	log.PrintStr(":")
+	log.PrintInt(line)
+}
+
+// printTfRegs prints the registers of tf, the order is the same as trapFrame
+//go:nosplit
+func printTfRegs(tf *trapFrame, prefix, sep string) {
+	regs := (*[len(tfRegNames)]uintptr)(unsafe.Pointer(tf))
+	for i := 0; i < len(tfRegNames); i++ {
+		log.PrintStr(prefix)
+		log.PrintStr(tfRegNames[i])
+		log.PrintStr("=0x")
+		log.PrintHex(regs[i])
+		log.PrintStr(sep)
+	}
+}
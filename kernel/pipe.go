@@ -5,32 +5,238 @@ import (
 	"unsafe"
 
 	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
 )
 
-// Timer depends on epoll and pipe.
-// When timer is frequently used, it will be more efficient
-// to implement it in the kernel
+// Pipes are handled in kernel, because the netpoll of go runtime
+// reads and writes its pipe in nosplit context.
+// The fds of pipe are allocated from the inode table of fs,
+// except the ones created before fs is ready, which use the reserved fds.
 
 const (
 	pipeReadFd  = epollFd + 1
 	pipeWriteFd = epollFd + 2
+
+	// the capacity of pipe buffer
+	_PIPE_BUF_SIZE = mm.PGSIZE
 )
 
 var (
-	// FIXME:
-	// avoid dup create pipe
-	epollPipeCreated bool
-	// the bytes number in pipe
-	pipeBufferBytes int
+	// to manage pipe objects
+	pipepool mm.Pool
 )
 
+//go:notinheap
+type pipe struct {
+	// ring buffer of _PIPE_BUF_SIZE bytes
+	buf uintptr
+	// read and write offset, never wrap
+	r, w uint
+	// fds of the two ends, -1 if closed
+	rfd, wfd int
+
+	// sleep keys of blocked readers and writers
+	rwait, wwait uintptr
+}
+
+type pipeEnd struct {
+	p        *pipe
+	write    bool
+	nonblock bool
+}
+
+//go:nosplit
+func (p *pipe) len() int {
+	return int(p.w - p.r)
+}
+
+//go:nosplit
+func (p *pipe) buffer() []byte {
+	return sys.UnsafeBuffer(p.buf, _PIPE_BUF_SIZE)
+}
+
+// pipeOf returns the pipe end of fd, nil if fd is not a pipe
+//go:nosplit
+func pipeOf(fd uintptr) *pipeEnd {
+	f := fdOf(fd)
+	if f == nil || f.pipe.p == nil {
+		return nil
+	}
+	return &f.pipe
+}
+
+// pipePoll returns the ready events of pipe end
+//go:nosplit
+func pipePoll(e *pipeEnd) uint32 {
+	p := e.p
+	var events uint32
+	if e.write {
+		if p.rfd < 0 {
+			events |= syscall.EPOLLERR
+		} else if p.len() < _PIPE_BUF_SIZE {
+			events |= syscall.EPOLLOUT
+		}
+	} else {
+		if p.len() > 0 {
+			events |= syscall.EPOLLIN
+		}
+		if p.wfd < 0 {
+			events |= syscall.EPOLLHUP
+		}
+	}
+	return events
+}
+
+//go:nosplit
+func pipeCreate(rfd, wfd int, flags uintptr) syscall.Errno {
+	if rfd < 0 || wfd < 0 {
+		return syscall.EBADF
+	}
+	rf, wf := fdAlloc(uintptr(rfd)), fdAlloc(uintptr(wfd))
+	if rf == nil || wf == nil {
+		return syscall.EMFILE
+	}
+	if rf.pipe.p != nil || wf.pipe.p != nil {
+		return syscall.EBADF
+	}
+	p := (*pipe)(unsafe.Pointer(pipepool.Alloc()))
+	p.buf = mm.Alloc()
+	p.rfd = rfd
+	p.wfd = wfd
+	nonblock := flags&syscall.O_NONBLOCK != 0
+	rf.pipe = pipeEnd{p: p, nonblock: nonblock}
+	wf.pipe = pipeEnd{p: p, write: true, nonblock: nonblock}
+	return 0
+}
+
+//go:nosplit
+func pipeRead(e *pipeEnd, b []byte) (int, syscall.Errno) {
+	p := e.p
+	for p.len() == 0 {
+		// EOF
+		if p.wfd < 0 {
+			return 0, 0
+		}
+		if e.nonblock {
+			return 0, syscall.EAGAIN
+		}
+		sleepon(&p.rwait)
+		// closed by another thread
+		if e.p != p {
+			return 0, syscall.EBADF
+		}
+	}
+	buf := p.buffer()
+	n := 0
+	for n < len(b) && p.len() > 0 {
+		off := p.r % _PIPE_BUF_SIZE
+		end := off + uint(p.len())
+		if end > _PIPE_BUF_SIZE {
+			end = _PIPE_BUF_SIZE
+		}
+		cnt := copy(b[n:], buf[off:end])
+		p.r += uint(cnt)
+		n += cnt
+	}
+	wakeup(&p.wwait, -1)
+	if p.wfd >= 0 {
+		fdNotify(uintptr(p.wfd), syscall.EPOLLOUT)
+	}
+	return n, 0
+}
+
+//go:nosplit
+func pipeWrite(e *pipeEnd, b []byte) (int, syscall.Errno) {
+	p := e.p
+	buf := p.buffer()
+	n := 0
+	for n < len(b) {
+		if p.rfd < 0 {
+			if n > 0 {
+				return n, 0
+			}
+			return 0, syscall.EPIPE
+		}
+		if p.len() == _PIPE_BUF_SIZE {
+			if e.nonblock {
+				break
+			}
+			sleepon(&p.wwait)
+			if e.p != p {
+				return n, syscall.EBADF
+			}
+			continue
+		}
+		off := p.w % _PIPE_BUF_SIZE
+		end := off + uint(_PIPE_BUF_SIZE-p.len())
+		if end > _PIPE_BUF_SIZE {
+			end = _PIPE_BUF_SIZE
+		}
+		cnt := copy(buf[off:end], b[n:])
+		p.w += uint(cnt)
+		n += cnt
+		wakeup(&p.rwait, -1)
+		fdNotify(uintptr(p.rfd), syscall.EPOLLIN)
+	}
+	if n == 0 && len(b) > 0 {
+		return 0, syscall.EAGAIN
+	}
+	return n, 0
+}
+
+//go:nosplit
+func pipeClose(e *pipeEnd) {
+	p := e.p
+	if e.write {
+		p.wfd = -1
+		wakeup(&p.rwait, -1)
+		if p.rfd >= 0 {
+			fdNotify(uintptr(p.rfd), syscall.EPOLLIN|syscall.EPOLLHUP)
+		}
+	} else {
+		p.rfd = -1
+		wakeup(&p.wwait, -1)
+		if p.wfd >= 0 {
+			fdNotify(uintptr(p.wfd), syscall.EPOLLOUT|syscall.EPOLLERR)
+		}
+	}
+	*e = pipeEnd{}
+	if p.rfd < 0 && p.wfd < 0 {
+		mm.Free(p.buf)
+		pipepool.Free(uintptr(unsafe.Pointer(p)))
+	}
+}
+
+//go:nosplit
+func pipeFcntl(e *pipeEnd, cmd, arg uintptr) uintptr {
+	switch cmd {
+	case syscall.F_GETFL:
+		var flags uintptr = syscall.O_RDONLY
+		if e.write {
+			flags = syscall.O_WRONLY
+		}
+		if e.nonblock {
+			flags |= syscall.O_NONBLOCK
+		}
+		return flags
+	case syscall.F_SETFL:
+		e.nonblock = arg&syscall.O_NONBLOCK != 0
+	}
+	return 0
+}
+
+// sysPipe2 creates the pipe before fs is ready, or called by the syscall thread
 //go:nosplit
 func sysPipe2(req *isyscall.Request) {
-	if epollPipeCreated {
-		req.SetErrorNO(syscall.EINVAL)
+	errno := pipeCreate(pipeReadFd, pipeWriteFd, req.Arg(1))
+	if errno != 0 {
+		if errno == syscall.EBADF {
+			errno = syscall.EMFILE
+		}
+		req.SetErrorNO(errno)
 		return
 	}
-	epollPipeCreated = true
 	fds := (*[2]int32)(unsafe.Pointer(req.Arg(0)))
 	fds[0] = pipeReadFd
 	fds[1] = pipeWriteFd
@@ -38,34 +244,39 @@ func sysPipe2(req *isyscall.Request) {
 }
 
 //go:nosplit
-func sysPipeRead(req *isyscall.Request) {
-	fd := req.Arg(0)
-	buffer := req.Arg(1)
-	len := req.Arg(2)
-	_ = fd
-	_ = buffer
-
-	var n int
-	if int(len) < pipeBufferBytes {
-		n = int(len)
-	} else {
-		n = pipeBufferBytes
+func sysPipeRead(req *isyscall.Request, e *pipeEnd) {
+	buf := sys.UnsafeBuffer(req.Arg(1), int(req.Arg(2)))
+	n, errno := pipeRead(e, buf)
+	if errno != 0 {
+		req.SetErrorNO(errno)
+		return
 	}
+	req.SetRet(uintptr(n))
+}
 
-	pipeBufferBytes -= n
-	epollNotify(pipeWriteFd, syscall.EPOLLOUT)
+//go:nosplit
+func sysPipeWrite(req *isyscall.Request, e *pipeEnd) {
+	buf := sys.UnsafeBuffer(req.Arg(1), int(req.Arg(2)))
+	n, errno := pipeWrite(e, buf)
+	if errno != 0 {
+		req.SetErrorNO(errno)
+		return
+	}
 	req.SetRet(uintptr(n))
 }
 
+// lockedPipeCreate binds the fds allocated by fs to a new pipe, called outside of trap
+//go:nosplit
+func lockedPipeCreate(rfd, wfd int, flags uintptr) syscall.Errno {
+	eflags := pushcli()
+	klock.lock()
+	errno := pipeCreate(rfd, wfd, flags)
+	klock.unlock()
+	popcli(eflags)
+	return errno
+}
+
 //go:nosplit
-func sysPipeWrite(req *isyscall.Request) {
-	fd := req.Arg(0)
-	buffer := req.Arg(1)
-	len := req.Arg(2)
-	_ = fd
-	_ = buffer
-
-	pipeBufferBytes += int(len)
-	epollNotify(pipeReadFd, syscall.EPOLLIN)
-	req.SetRet(len)
+func pipeInit() {
+	mm.PoolInit(&pipepool, unsafe.Sizeof(pipe{}))
 }
@@ -0,0 +1,147 @@
+package kernel
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"github.com/icexin/eggos/drivers/acpi"
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/drivers/ps2"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+// the magic2 values accepted by reboot(2)
+var rebootMagic2 = [...]uintptr{
+	syscall.LINUX_REBOOT_MAGIC2,
+	0x05121996,
+	0x16041998,
+	0x20112000,
+}
+
+// max time to wait for the other cpus stopping
+const _STOP_WAIT = second
+
+// the id+1 of the cpu stopping the others, zero if none
+var stopper int32
+
+// haltCPU stops the current cpu
+//go:nosplit
+func haltCPU() {
+	sys.Cli()
+	for {
+		sys.Hlt()
+	}
+}
+
+// stopCPUs halts the other cpus by NMI, which works even if they are
+// spinning with interrupt disabled, so nothing runs while the machine
+// is going down. It must be called with interrupt disabled.
+// If another cpu is stopping the others, the current cpu halts.
+//go:nosplit
+func stopCPUs() {
+	my := mycpu()
+	if !atomic.CompareAndSwapInt32(&stopper, 0, int32(my.id+1)) {
+		haltCPU()
+	}
+	if ncpu == 1 {
+		return
+	}
+	for i := 0; i < ncpu; i++ {
+		c := &cpus[i]
+		if c == my || atomic.LoadUint32(&c.started) == 0 {
+			continue
+		}
+		apic.SendNMI(c.apicid)
+	}
+	deadline := nanosecond() + _STOP_WAIT
+	for i := 0; i < ncpu; i++ {
+		c := &cpus[i]
+		if c == my || atomic.LoadUint32(&c.started) == 0 {
+			continue
+		}
+		for atomic.LoadUint32(&c.stopped) == 0 && nanosecond() < deadline {
+			sys.Pause()
+		}
+	}
+}
+
+// stopTrap halts the current cpu in NMI handler if stopCPUs is called by another cpu,
+// it reports whether the NMI is consumed, which is also true on the stopping cpu
+// to keep the watchdog quiet.
+//go:nosplit
+func stopTrap(c *cpu) bool {
+	id := atomic.LoadInt32(&stopper)
+	if id == 0 {
+		return false
+	}
+	if int(id) == c.id+1 {
+		return true
+	}
+	atomic.StoreUint32(&c.stopped, 1)
+	haltCPU()
+	return true
+}
+
+// halt stops all the cpus
+//go:nosplit
+func halt() {
+	sys.Cli()
+	stopCPUs()
+	haltCPU()
+}
+
+// poweroff turns off the machine by ACPI, halts the cpus if failed
+//go:nosplit
+func poweroff() {
+	sys.Cli()
+	stopCPUs()
+	acpi.Poweroff()
+	haltCPU()
+}
+
+// reboot resets the machine by ACPI reset register, keyboard controller
+// and triple fault in order, until one of them works.
+//go:nosplit
+func reboot() {
+	sys.Cli()
+	stopCPUs()
+	acpi.Reset()
+	ps2.ResetCPU()
+	for i := 0; i < 1000000; i++ {
+		sys.Pause()
+	}
+	tripleFault()
+}
+
+// func reboot(magic1, magic2 int, cmd uint, arg unsafe.Pointer)
+//go:nosplit
+func sysReboot(req *isyscall.Request) {
+	magic1, magic2, cmd := req.Arg(0), req.Arg(1), req.Arg(2)
+	valid := uint32(magic1) == syscall.LINUX_REBOOT_MAGIC1
+	if valid {
+		valid = false
+		for _, m := range rebootMagic2 {
+			if uint32(magic2) == uint32(m) {
+				valid = true
+			}
+		}
+	}
+	if !valid {
+		req.SetErrorNO(syscall.EINVAL)
+		return
+	}
+
+	switch uint32(cmd) {
+	case syscall.LINUX_REBOOT_CMD_RESTART, syscall.LINUX_REBOOT_CMD_RESTART2:
+		reboot()
+	case syscall.LINUX_REBOOT_CMD_POWER_OFF:
+		poweroff()
+	case syscall.LINUX_REBOOT_CMD_HALT:
+		halt()
+	case syscall.LINUX_REBOOT_CMD_CAD_ON, syscall.LINUX_REBOOT_CMD_CAD_OFF:
+		req.SetRet(0)
+	default:
+		req.SetErrorNO(syscall.EINVAL)
+	}
+}
@@ -1,9 +1,11 @@
 package kernel
 
 import (
+	"github.com/icexin/eggos/drivers/acpi"
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/drivers/multiboot"
-	"github.com/icexin/eggos/drivers/pic"
 	"github.com/icexin/eggos/drivers/uart"
+	"github.com/icexin/eggos/kernel/entropy"
 	"github.com/icexin/eggos/kernel/mm"
 )
 
@@ -21,16 +23,25 @@ func rdmsr(reg uint32) (value uintptr)
 
 //go:nosplit
 func preinit(magic, mbiptr uintptr) {
+	percpuInit(&cpus[0])
 	simdInit()
 	gdtInit()
 	idtInit()
 	multiboot.Init(magic, mbiptr)
 	mm.Init()
+	nxInit()
+	acpi.Init()
+	cpuDetect()
+	entropy.Init()
 	uart.PreInit()
 	syscallInit()
 	trapInit()
+	nmiInit()
+	faultStackInit()
+	tlbInit()
 	threadInit()
-	pic.Init()
+	irq.Init()
+	gdbInit()
 	timerInit()
 	schedule()
 }
@@ -12,6 +12,14 @@ TEXT ·lidt(SB), NOSPLIT, $0-8
 	LIDT (AX)
 	RET
 
+// tripleFault resets the cpu by raising an exception without IDT.
+TEXT ·tripleFault(SB), NOSPLIT, $16-0
+	MOVQ $0, 0(SP)
+	MOVQ $0, 8(SP)
+	LIDT 0(SP)
+	INT  $3
+	JMP  0(PC)
+
 // ltr(sel uint64) - Load Task Register.
 TEXT ·ltr(SB), NOSPLIT, $0-8
 	MOVQ sel+0(FP), AX
@@ -16,17 +16,16 @@ const (
 	_KDATA_IDX = 2
 	_UCODE_IDX = 3
 	_UDATA_IDX = 4
-	_TSS_IDX   = 5
+	// every cpu has its own tss, which takes two descriptors
+	_TSS_IDX = 5
 )
 
 var (
-	gdt    [7]gdtSegDesc
+	gdt    [_TSS_IDX + 2*_MAXCPU]gdtSegDesc
 	gdtptr [10]byte
 
 	idt    [256]idtSetDesc
 	idtptr [10]byte
-
-	tss [26]uint32
 )
 
 type gdtSegDesc [8]byte
@@ -46,6 +45,9 @@ func lgdt(gdtptr uintptr)
 //go:nosplit
 func lidt(idtptr uintptr)
 
+//go:nosplit
+func tripleFault()
+
 //go:nosplit
 func ltr(sel uintptr)
 
@@ -91,16 +93,26 @@ func gdtInit() {
 	setGdtDataDesc(&gdt[_KDATA_IDX], segDplKernel)
 	setGdtCodeDesc(&gdt[_UCODE_IDX], segDplUser)
 	setGdtDataDesc(&gdt[_UDATA_IDX], segDplUser)
-	tssAddr := uintptr(unsafe.Pointer(&tss[0]))
-	tssLimit := uintptr(unsafe.Sizeof(tss)) - 1
-	setTssDesc(&gdt[_TSS_IDX], &gdt[_TSS_IDX+1], tssAddr, tssLimit)
+	for i := range cpus {
+		tss := &cpus[i].tss
+		tssAddr := uintptr(unsafe.Pointer(&tss[0]))
+		tssLimit := uintptr(unsafe.Sizeof(*tss)) - 1
+		idx := _TSS_IDX + 2*i
+		setTssDesc(&gdt[idx], &gdt[idx+1], tssAddr, tssLimit)
+	}
 
 	limit := (*uint16)(unsafe.Pointer(&gdtptr[0]))
 	base := (*uint64)(unsafe.Pointer(&gdtptr[2]))
 	*limit = uint16(unsafe.Sizeof(gdt) - 1)
 	*base = uint64(uintptr(unsafe.Pointer(&gdt[0])))
+	gdtLoad(0)
+}
+
+// gdtLoad loads gdt and the tss of cpu on current cpu
+//go:nosplit
+func gdtLoad(cpuid int) {
 	lgdt(uintptr(unsafe.Pointer(&gdtptr[0])))
-	ltr(_TSS_IDX << 3)
+	ltr(uintptr(_TSS_IDX+2*cpuid) << 3)
 	reloadCS()
 }
 
@@ -113,6 +125,20 @@ func setIdtDesc(desc *idtSetDesc, addr uintptr, dpl byte) {
 	desc.Addr3 = uint32(addr>>32) & 0xffffffff
 }
 
+// setIdtIST makes the gate switch to the stack of interrupt stack table entry ist
+//go:nosplit
+func setIdtIST(desc *idtSetDesc, ist int) {
+	desc.Attr = desc.Attr&^7 | uint16(ist)
+}
+
+// setTssIST sets the stack of interrupt stack table entry ist of c, which starts from 1
+//go:nosplit
+func setTssIST(c *cpu, ist int, addr uintptr) {
+	idx := 9 + 2*(ist-1)
+	c.tss[idx] = uint32(addr)
+	c.tss[idx+1] = uint32(addr >> 32)
+}
+
 //go:nosplit
 func idtInit() {
 	for i := 0; i < 256; i++ {
@@ -124,11 +150,17 @@ func idtInit() {
 	base := (*uint64)(unsafe.Pointer(&idtptr[2]))
 	*limit = uint16(unsafe.Sizeof(idt) - 1)
 	*base = uint64(uintptr(unsafe.Pointer(&idt[0])))
+	idtLoad()
+}
+
+//go:nosplit
+func idtLoad() {
 	lidt(uintptr(unsafe.Pointer(&idtptr)))
 }
 
 //go:nosplit
 func setTssSP0(addr uintptr) {
+	tss := &mycpu().tss
 	tss[1] = uint32(addr)
 	tss[2] = uint32(addr >> 32)
 }
@@ -0,0 +1,418 @@
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+	"gvisor.dev/gvisor/pkg/abi/linux/errno"
+)
+
+// Signals are delivered on return from trap like linux, a signal frame is pushed
+// on the user stack and the thread returns to the handler, which returns to sa_restorer
+// and calls rt_sigreturn to restore the interrupted context.
+// It's mainly used by the async preemption of go runtime, which sends SIGURG
+// to the thread running a goroutine for too long.
+// A sleeping thread is not interrupted by signals, it handles them after woken up.
+
+const (
+	_NSIG = 64
+
+	// all threads belong to the same process
+	kernelPid = 1
+
+	_SIG_DFL = 0
+	_SIG_IGN = 1
+
+	_SIG_BLOCK   = 0
+	_SIG_UNBLOCK = 1
+	_SIG_SETMASK = 2
+
+	_SA_ONSTACK   = 0x08000000
+	_SA_NODEFER   = 0x40000000
+	_SA_RESETHAND = 0x80000000
+
+	_SS_ONSTACK  = 1
+	_SS_DISABLE  = 2
+	_MINSIGSTKSZ = 2048
+
+	// siginfo.si_code of tkill and tgkill
+	_SI_TKILL = -6
+
+	// the red zone of amd64 abi below the stack pointer
+	_REDZONE_SIZE = 128
+	_FPSTATE_SIZE = 512
+
+	// signals can't be caught or blocked
+	sigUnblockable = 1<<(syscall.SIGKILL-1) | 1<<(syscall.SIGSTOP-1)
+	// signals ignored by default action
+	sigDefaultIgnore = 1<<(syscall.SIGCHLD-1) | 1<<(syscall.SIGCONT-1) |
+		1<<(syscall.SIGURG-1) | 1<<(syscall.SIGWINCH-1)
+)
+
+// sigaction is the struct sigaction of linux kernel
+type sigaction struct {
+	handler  uintptr
+	flags    uint64
+	restorer uintptr
+	mask     uint64
+}
+
+// sigstack is the stack_t used by sigaltstack, the zero value means disabled
+type sigstack struct {
+	sp    uintptr
+	flags int32
+	_     int32
+	size  uintptr
+}
+
+type sigcontext struct {
+	r8, r9, r10, r11   uint64
+	r12, r13, r14, r15 uint64
+	rdi, rsi, rbp, rbx uint64
+	rdx, rax, rcx, rsp uint64
+	rip, eflags        uint64
+	cs, gs, fs, ss     uint16
+	err, trapno        uint64
+	oldmask, cr2       uint64
+	fpstate            uintptr
+	_                  [8]uint64
+}
+
+type ucontext struct {
+	flags    uint64
+	link     uintptr
+	stack    sigstack
+	mcontext sigcontext
+	sigmask  uint64
+}
+
+type siginfo struct {
+	signo int32
+	errno int32
+	code  int32
+	_     int32
+	pid   int32
+	uid   uint32
+	_     [104]byte
+}
+
+// sigframe is the struct rt_sigframe of linux
+type sigframe struct {
+	// the return address of handler
+	pretcode uintptr
+	uc       ucontext
+	info     siginfo
+}
+
+var (
+	// signal handlers shared by all threads
+	sigactions [_NSIG + 1]sigaction
+)
+
+//go:nosplit
+func sigbit(sig int) uint64 {
+	return 1 << uint(sig-1)
+}
+
+//go:nosplit
+func validSignal(sig uintptr) bool {
+	return sig >= 1 && sig <= _NSIG
+}
+
+// onSigstack reports whether sp is in the alternate signal stack of t
+//go:nosplit
+func onSigstack(t *Thread, sp uintptr) bool {
+	ss := &t.sigstack
+	return ss.size != 0 && sp > ss.sp && sp <= ss.sp+ss.size
+}
+
+// signalSend makes sig pending on t with si_code, the cpu running t is kicked to deliver it soon
+//go:nosplit
+func signalSend(t *Thread, sig int, code int32) {
+	t.sigpending |= sigbit(sig)
+	t.sigcodes[(sig-1)&(_NSIG-1)] = code
+	if t.state != RUNNING || t == Mythread() {
+		return
+	}
+	c := (*cpu)(unsafe.Pointer(t.threadTLS[2]))
+	apic.SendIPI(c.apicid, apic.VECTOR_RESCHED)
+}
+
+// signalTarget selects the thread to handle the signal sent to process,
+// current thread is preferred if it doesn't block sig.
+//go:nosplit
+func signalTarget(sig int) *Thread {
+	bit := sigbit(sig)
+	my := Mythread()
+	if !my.idle && my.sigmask&bit == 0 {
+		return my
+	}
+	for i := 0; i < nthreads; i++ {
+		t := threadByID(i)
+		if t != nil && !t.idle && t.sigmask&bit == 0 {
+			return t
+		}
+	}
+	return nil
+}
+
+// signalDeliver delivers a pending signal to current thread, it's called before
+// returning to user mode with the kernel lock held.
+//go:nosplit
+func signalDeliver() {
+	t := Mythread()
+	pending := t.sigpending &^ t.sigmask
+	if pending == 0 {
+		return
+	}
+	tf := t.tf
+	// the kernel mode threads and the trampoline of forwarded syscall,
+	// which relies on systf, can't be interrupted.
+	if tf.CS&3 != _RPL_USER || tf.IP == sys.FuncPC(blocksyscall) {
+		return
+	}
+	sig := 1
+	for pending&1 == 0 {
+		pending >>= 1
+		sig++
+	}
+	t.sigpending &^= sigbit(sig)
+	if uint(sig) >= uint(len(sigactions)) {
+		return
+	}
+	act := &sigactions[sig]
+	switch act.handler {
+	case _SIG_IGN:
+		return
+	case _SIG_DFL:
+		if sigDefaultIgnore&sigbit(sig) != 0 {
+			return
+		}
+		// there is only one process
+		throwtf(tf, "killed by signal")
+	}
+	signalSetupFrame(t, sig, act)
+}
+
+// signalSetupFrame pushes the signal frame and redirects tf to the handler
+//go:nosplit
+func signalSetupFrame(t *Thread, sig int, act *sigaction) {
+	tf := t.tf
+	sp := tf.SP - _REDZONE_SIZE
+	if act.flags&_SA_ONSTACK != 0 && t.sigstack.size != 0 && !onSigstack(t, tf.SP) {
+		sp = t.sigstack.sp + t.sigstack.size
+	}
+	fpstate := (sp - _FPSTATE_SIZE) &^ 63
+	// the stack is aligned like a function has been called
+	fp := (fpstate-unsafe.Sizeof(sigframe{}))&^15 - 8
+	// no handler can run on a bad stack, die like the default action of SIGSEGV
+	if fp > sp || !mm.Writable(fp, sp-fp) {
+		throwtf(tf, "bad signal frame")
+	}
+	*(*[_FPSTATE_SIZE]byte)(unsafe.Pointer(fpstate)) = *(*[_FPSTATE_SIZE]byte)(unsafe.Pointer(t.fpstate))
+
+	sys.Memclr(fp, int(unsafe.Sizeof(sigframe{})))
+	frame := (*sigframe)(unsafe.Pointer(fp))
+	frame.pretcode = act.restorer
+
+	uc := &frame.uc
+	uc.stack = t.sigstack
+	if t.sigstack.size == 0 {
+		uc.stack.flags = _SS_DISABLE
+	}
+	uc.sigmask = t.sigmask
+	mc := &uc.mcontext
+	mc.r8, mc.r9, mc.r10, mc.r11 = uint64(tf.R8), uint64(tf.R9), uint64(tf.R10), uint64(tf.R11)
+	mc.r12, mc.r13, mc.r14, mc.r15 = uint64(tf.R12), uint64(tf.R13), uint64(tf.R14), uint64(tf.R15)
+	mc.rdi, mc.rsi, mc.rbp, mc.rbx = uint64(tf.DI), uint64(tf.SI), uint64(tf.BP), uint64(tf.BX)
+	mc.rdx, mc.rax, mc.rcx, mc.rsp = uint64(tf.DX), uint64(tf.AX), uint64(tf.CX), uint64(tf.SP)
+	mc.rip, mc.eflags = uint64(tf.IP), uint64(tf.FLAGS)
+	mc.cs, mc.ss = uint16(tf.CS), uint16(tf.SS)
+	mc.err, mc.trapno = uint64(tf.Err), uint64(tf.Trapno)
+	mc.oldmask = t.sigmask
+	mc.fpstate = fpstate
+
+	info := &frame.info
+	info.signo = int32(sig)
+	info.code = t.sigcodes[(sig-1)&(_NSIG-1)]
+	info.pid = kernelPid
+
+	t.sigmask |= act.mask
+	if act.flags&_SA_NODEFER == 0 {
+		t.sigmask |= sigbit(sig)
+	}
+	t.sigmask &^= sigUnblockable
+	if act.flags&_SA_RESETHAND != 0 {
+		act.handler = _SIG_DFL
+	}
+
+	tf.SP = fp
+	tf.IP = act.handler
+	tf.DI = uintptr(sig)
+	tf.SI = uintptr(unsafe.Pointer(info))
+	tf.DX = uintptr(unsafe.Pointer(uc))
+	tf.AX = 0
+	tf.FLAGS &^= _FLAGS_TF | _FLAGS_DF
+}
+
+// sysRtSigreturn restores the context saved in the signal frame,
+// the handler returns to the restorer, so the stack pointer points to uc.
+//go:nosplit
+func sysRtSigreturn(req *isyscall.Request) {
+	t := Mythread()
+	tf := t.tf
+	uc := (*ucontext)(unsafe.Pointer(tf.SP))
+	// the frame is checked like signalSetupFrame, a bad fpstate makes FXRSTOR fault in trapret
+	if !mm.Readable(tf.SP, unsafe.Sizeof(ucontext{})) {
+		throwtf(tf, "bad signal frame")
+	}
+	mc := &uc.mcontext
+	if mc.fpstate != 0 && !mm.Readable(mc.fpstate, _FPSTATE_SIZE) {
+		throwtf(tf, "bad signal frame")
+	}
+	tf.R8, tf.R9, tf.R10, tf.R11 = uintptr(mc.r8), uintptr(mc.r9), uintptr(mc.r10), uintptr(mc.r11)
+	tf.R12, tf.R13, tf.R14, tf.R15 = uintptr(mc.r12), uintptr(mc.r13), uintptr(mc.r14), uintptr(mc.r15)
+	tf.DI, tf.SI, tf.BP, tf.BX = uintptr(mc.rdi), uintptr(mc.rsi), uintptr(mc.rbp), uintptr(mc.rbx)
+	tf.DX, tf.AX, tf.CX, tf.SP = uintptr(mc.rdx), uintptr(mc.rax), uintptr(mc.rcx), uintptr(mc.rsp)
+	tf.IP = uintptr(mc.rip)
+	tf.FLAGS = tf.FLAGS&^_FLAGS_USER | uintptr(mc.eflags)&_FLAGS_USER
+	if mc.fpstate != 0 {
+		// the mask is written by FXSAVE on trap entry, FXRSTOR raises #GP on the unsupported bits
+		mask := *(*uint32)(unsafe.Pointer(t.fpstate + _FXSAVE_MXCSR_MASK))
+		if mask == 0 {
+			mask = _MXCSR_DEFAULT_MASK
+		}
+		*(*[_FPSTATE_SIZE]byte)(unsafe.Pointer(t.fpstate)) = *(*[_FPSTATE_SIZE]byte)(unsafe.Pointer(mc.fpstate))
+		*(*uint32)(unsafe.Pointer(t.fpstate + _FXSAVE_MXCSR)) &= mask
+	}
+	t.sigmask = uc.sigmask &^ sigUnblockable
+}
+
+//go:nosplit
+func sysRtSigaction(req *isyscall.Request) {
+	sig, act, oact := req.Arg(0), req.Arg(1), req.Arg(2)
+	if !validSignal(sig) || req.Arg(3) != 8 {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	if act != 0 && sigUnblockable&sigbit(int(sig)) != 0 {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	p := &sigactions[sig]
+	var newact sigaction
+	if act != 0 {
+		newact = *(*sigaction)(unsafe.Pointer(act))
+	}
+	if oact != 0 {
+		*(*sigaction)(unsafe.Pointer(oact)) = *p
+	}
+	if act != 0 {
+		*p = newact
+		p.mask &^= sigUnblockable
+	}
+}
+
+//go:nosplit
+func sysRtSigprocmask(req *isyscall.Request) {
+	how, set, oset := req.Arg(0), req.Arg(1), req.Arg(2)
+	if req.Arg(3) != 8 {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	t := Mythread()
+	old := t.sigmask
+	if set != 0 {
+		mask := *(*uint64)(unsafe.Pointer(set))
+		switch how {
+		case _SIG_BLOCK:
+			t.sigmask |= mask
+		case _SIG_UNBLOCK:
+			t.sigmask &^= mask
+		case _SIG_SETMASK:
+			t.sigmask = mask
+		default:
+			req.SetRet(isyscall.Errno(errno.EINVAL))
+			return
+		}
+		t.sigmask &^= sigUnblockable
+	}
+	if oset != 0 {
+		*(*uint64)(unsafe.Pointer(oset)) = old
+	}
+}
+
+//go:nosplit
+func sysSigaltstack(req *isyscall.Request) {
+	ss, oss := req.Arg(0), req.Arg(1)
+	t := Mythread()
+	onstack := onSigstack(t, t.tf.SP)
+	old := t.sigstack
+	if old.size == 0 {
+		old.flags = _SS_DISABLE
+	} else if onstack {
+		old.flags = _SS_ONSTACK
+	}
+	if ss != 0 {
+		n := (*sigstack)(unsafe.Pointer(ss))
+		switch {
+		case onstack:
+			req.SetRet(isyscall.Errno(errno.EPERM))
+			return
+		case n.flags&_SS_DISABLE != 0:
+			t.sigstack = sigstack{}
+		case n.flags != 0:
+			req.SetRet(isyscall.Errno(errno.EINVAL))
+			return
+		case n.size < _MINSIGSTKSZ:
+			req.SetRet(isyscall.Errno(errno.ENOMEM))
+			return
+		default:
+			t.sigstack = sigstack{sp: n.sp, size: n.size}
+		}
+	}
+	if oss != 0 {
+		*(*sigstack)(unsafe.Pointer(oss)) = old
+	}
+}
+
+//go:nosplit
+func sysTkill(req *isyscall.Request, tid, sig uintptr) {
+	t := threadByID(int(tid))
+	if t == nil {
+		req.SetRet(isyscall.Errno(errno.ESRCH))
+		return
+	}
+	if sig != 0 && !validSignal(sig) {
+		req.SetRet(isyscall.Errno(errno.EINVAL))
+		return
+	}
+	// zero signal only checks the existence of thread
+	if sig == 0 {
+		return
+	}
+	signalSend(t, int(sig), _SI_TKILL)
+}
+
+// sysKill sends the signal of process to current thread
+//go:nosplit
+func sysKill(req *isyscall.Request) {
+	if req.Arg(0) != kernelPid {
+		req.SetRet(isyscall.Errno(errno.ESRCH))
+		return
+	}
+	sysTkill(req, uintptr(Mythread().id), req.Arg(1))
+}
+
+//go:nosplit
+func sysTgkill(req *isyscall.Request) {
+	if req.Arg(0) != kernelPid {
+		req.SetRet(isyscall.Errno(errno.ESRCH))
+		return
+	}
+	sysTkill(req, req.Arg(1), req.Arg(2))
+}
@@ -4,9 +4,11 @@ const (
 	_CPUID_ECX_XSAVE = 1 << 26
 	_CPUID_ECX_AVX   = 1 << 28
 	_CPUID_EBX_AVX2  = 1 << 5
+	_CPUID_EDX_NX    = 1 << 20
 
-	_CPUID_FN_STD = 0x00000001
-	_CPUID_FN_EXT = 0x80000001
+	_CPUID_FN_STD     = 0x00000001
+	_CPUID_FN_EXT_MAX = 0x80000000
+	_CPUID_FN_EXT     = 0x80000001
 )
 
 //go:nosplit
@@ -0,0 +1,255 @@
+package kernel
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/acpi"
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+	"github.com/icexin/eggos/log"
+)
+
+const (
+	_MAXCPU = acpi.MaxCPU
+
+	// the physical address where application processors begin to execute
+	_AP_TRAMPOLINE_ADDR = 0x8000
+
+	// offset of the EFER bits set by trampoline
+	_AP_PARAM_EFER = 0x40
+	// offset of parameters in trampoline, sync with apTrampoline
+	_AP_PARAM_CR3   = 0xa0
+	_AP_PARAM_STACK = 0xa8
+	_AP_PARAM_ENTRY = 0xb0
+	_AP_PARAM_ARG   = 0xb8
+)
+
+var (
+	cpus [_MAXCPU]cpu
+	ncpu = 1
+)
+
+// apTrampoline is the startup code of application processors,
+// it switches the cpu from real mode to long mode and jumps to apEntry.
+// Parameters are filled at the end of the code.
+//
+//		.code16
+//		cli
+//		xorw  %ax, %ax
+//		movw  %ax, %ds
+//		lgdtl gdtdesc
+//		movl  %cr0, %eax
+//		orl   $1, %eax
+//		movl  %eax, %cr0
+//		ljmpl $0x08, $pm32
+//		.code32
+//	pm32:
+//		movw  $0x10, %ax
+//		movw  %ax, %ds
+//		movw  %ax, %es
+//		movw  %ax, %ss
+//		movl  %cr4, %eax
+//		orl   $0x20, %eax        // PAE
+//		movl  %eax, %cr4
+//		movl  cr3val, %eax
+//		movl  %eax, %cr3
+//		movl  $0xc0000080, %ecx  // EFER
+//		rdmsr
+//		orl   $0x100, %eax       // LME, NXE is added if enabled on bsp
+//		wrmsr
+//		movl  %cr0, %eax
+//		orl   $0x80000000, %eax  // PG
+//		movl  %eax, %cr0
+//		ljmp  $0x18, $lm64
+//		.code64
+//	lm64:
+//		movq  stackval, %rsp
+//		movq  argval, %rdi
+//		movq  entryval, %rax
+//		jmpq  *%rax
+//		.align 8
+//	gdt:
+//		.quad 0
+//		.quad 0x00cf9a000000ffff // 32 bit code
+//		.quad 0x00cf92000000ffff // data
+//		.quad 0x00af9a000000ffff // 64 bit code
+//	gdtdesc:
+//		.word 31
+//		.long gdt
+//		.align 8
+//	cr3val:   .quad 0
+//	stackval: .quad 0
+//	entryval: .quad 0
+//	argval:   .quad 0
+var apTrampoline = [...]byte{
+	0xfa, 0x31, 0xc0, 0x8e, 0xd8, 0x66, 0x0f, 0x01, 0x16, 0x98, 0x80, 0x0f,
+	0x20, 0xc0, 0x66, 0x83, 0xc8, 0x01, 0x0f, 0x22, 0xc0, 0x66, 0xea, 0x1d,
+	0x80, 0x00, 0x00, 0x08, 0x00, 0x66, 0xb8, 0x10, 0x00, 0x8e, 0xd8, 0x8e,
+	0xc0, 0x8e, 0xd0, 0x0f, 0x20, 0xe0, 0x83, 0xc8, 0x20, 0x0f, 0x22, 0xe0,
+	0xa1, 0xa0, 0x80, 0x00, 0x00, 0x0f, 0x22, 0xd8, 0xb9, 0x80, 0x00, 0x00,
+	0xc0, 0x0f, 0x32, 0x0d, 0x00, 0x01, 0x00, 0x00, 0x0f, 0x30, 0x0f, 0x20,
+	0xc0, 0x0d, 0x00, 0x00, 0x00, 0x80, 0x0f, 0x22, 0xc0, 0xea, 0x58, 0x80,
+	0x00, 0x00, 0x18, 0x00, 0x48, 0x8b, 0x24, 0x25, 0xa8, 0x80, 0x00, 0x00,
+	0x48, 0x8b, 0x3c, 0x25, 0xb8, 0x80, 0x00, 0x00, 0x48, 0x8b, 0x04, 0x25,
+	0xb0, 0x80, 0x00, 0x00, 0xff, 0xe0, 0x66, 0x0f, 0x1f, 0x44, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00,
+	0x00, 0x9a, 0xcf, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x92, 0xcf, 0x00,
+	0xff, 0xff, 0x00, 0x00, 0x00, 0x9a, 0xaf, 0x00, 0x1f, 0x00, 0x78, 0x80,
+	0x00, 0x00, 0x66, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// cpu holds the per cpu states, it's found by the tls_cpu slot of GS.
+//go:notinheap
+type cpu struct {
+	// the tls used before running any thread, same layout as Thread.threadTLS
+	tls [4]uintptr
+
+	id      int
+	apicid  uint8
+	started uint32
+
+	// the context of scheduler loop
+	scheduler *context
+	// the idle thread of this cpu
+	idle threadptr
+	// current running thread
+	curr threadptr
+	// number of thread switches, the progress checked by watchdog
+	nswitch uint64
+	// set by watchdog to ask the cpu to print its registers in NMI handler
+	nmiDump uint32
+	// the last tlb shootdown done by the cpu
+	tlbSeq uint64
+	// set by the cpu halted in NMI handler, see stopCPUs
+	stopped uint32
+
+	tss [26]uint32
+}
+
+//go:nosplit
+func mycpu() *cpu
+
+// percpuInit makes GS point to the tls of c before any thread running on it
+//go:nosplit
+func percpuInit(c *cpu) {
+	c.tls[0] = 0
+	c.tls[2] = uintptr(unsafe.Pointer(c))
+	setGS(uintptr(unsafe.Pointer(&c.tls)))
+}
+
+// cpuDetect enables the local apic of the bootstrap processor,
+// and finds all the processors from MADT.
+//go:nosplit
+func cpuDetect() {
+	for i := range cpus {
+		cpus[i].id = i
+	}
+	apic.Init(acpi.MADT.LocalAPICAddr, true)
+	bsp := apic.ID()
+	cpus[0].apicid = bsp
+	cpus[0].started = 1
+
+	for i := 0; i < acpi.MADT.NCPU && ncpu < _MAXCPU; i++ {
+		id := acpi.MADT.CPUs[i]
+		if id == bsp {
+			continue
+		}
+		cpus[ncpu].apicid = id
+		ncpu++
+	}
+	clocksourceInit()
+}
+
+//go:nosplit
+func apEntry()
+
+// apmain is the go entry of application processors
+//go:nosplit
+func apmain(idx uintptr) {
+	c := &cpus[idx]
+	percpuInit(c)
+	simdInit()
+	gdtLoad(c.id)
+	idtLoad()
+	syscallMSRInit()
+	apic.Init(acpi.MADT.LocalAPICAddr, false)
+	timerCPUInit()
+	atomic.StoreUint32(&c.started, 1)
+	schedule()
+}
+
+// smpStart boots all the application processors one by one, called after idle threads are created.
+func smpStart() {
+	if ncpu <= 1 {
+		return
+	}
+	param := func(off uintptr) *uintptr {
+		return (*uintptr)(unsafe.Pointer(uintptr(_AP_TRAMPOLINE_ADDR) + off))
+	}
+	copy(sys.UnsafeBuffer(_AP_TRAMPOLINE_ADDR, len(apTrampoline)), apTrampoline[:])
+	*param(_AP_PARAM_CR3) = mm.PageTable()
+	// the page tables may contain no-execute pages
+	efer := (*uint32)(unsafe.Pointer(uintptr(_AP_TRAMPOLINE_ADDR + _AP_PARAM_EFER)))
+	*efer = _EFER_LME | uint32(rdmsr(_MSR_IA32_EFER)&_EFER_NXE)
+	*param(_AP_PARAM_ENTRY) = sys.FuncPC(apEntry)
+
+	for i := 1; i < ncpu; i++ {
+		c := &cpus[i]
+		*param(_AP_PARAM_STACK) = mm.SysMmapGuard(_THREAD_STACK_SIZE) +
+			_THREAD_STACK_SIZE - _THREAD_STACK_GUARD_OFFSET
+		*param(_AP_PARAM_ARG) = uintptr(i)
+
+		flags := pushcli()
+		apic.SendInit(c.apicid)
+		popcli(flags)
+		time.Sleep(10 * time.Millisecond)
+
+		for j := 0; j < 2 && atomic.LoadUint32(&c.started) == 0; j++ {
+			flags = pushcli()
+			apic.SendStartup(c.apicid, _AP_TRAMPOLINE_ADDR)
+			popcli(flags)
+			time.Sleep(time.Millisecond)
+		}
+		for j := 0; j < 100 && atomic.LoadUint32(&c.started) == 0; j++ {
+			time.Sleep(time.Millisecond)
+		}
+		if atomic.LoadUint32(&c.started) == 0 {
+			// the trampoline parameters are shared,
+			// a late cpu may run with the parameters of the next one.
+			log.Errorf("[smp] cpu%d(apic:%d) not responding, stop booting others", i, c.apicid)
+			return
+		}
+		log.Infof("[smp] cpu%d(apic:%d) started", i, c.apicid)
+	}
+}
+
+// kickIdle interrupts the cpus running their idle thread,
+// so that they can pick up the new runnable threads.
+//go:nosplit
+func kickIdle() {
+	if ncpu == 1 {
+		return
+	}
+	my := mycpu()
+	for i := 0; i < ncpu; i++ {
+		c := &cpus[i]
+		if c == my || atomic.LoadUint32(&c.started) == 0 {
+			continue
+		}
+		if c.curr == 0 || c.curr != c.idle {
+			continue
+		}
+		apic.SendIPI(c.apicid, apic.VECTOR_RESCHED)
+	}
+}
+
+//go:nosplit
+func reschedIntr() {
+	apic.EOI()
+	Yield()
+}
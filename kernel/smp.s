@@ -0,0 +1,12 @@
+#include "textflag.h"
+
+// apEntry is jumped from the trampoline after application processor entering long mode,
+// SP is the stack of the cpu and DI is the index of the cpu.
+// The frame is set up by the assembler, BP is cleared after that to end the call chain.
+TEXT ·apEntry(SB), NOSPLIT, $8-0
+	XORQ BP, BP
+	MOVQ DI, 0(SP)
+	CALL ·apmain(SB)
+	INT  $3
+
+	// never return
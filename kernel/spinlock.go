@@ -0,0 +1,67 @@
+package kernel
+
+import (
+	"sync/atomic"
+
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+var (
+	// klock is the big kernel lock, which protects all the kernel states.
+	// It's acquired on entering dotrap and released in trapret,
+	// so it's held across the thread switch in scheduler.
+	klock spinlock
+)
+
+//go:notinheap
+type spinlock struct {
+	v     uint32
+	owner int32
+}
+
+//go:nosplit
+func (l *spinlock) lock() {
+	for !atomic.CompareAndSwapUint32(&l.v, 0, 1) {
+		// the owner may wait for the tlb shootdown,
+		// which can't be delivered if interrupt is disabled.
+		tlbPoll()
+		sys.Pause()
+	}
+	l.owner = int32(mycpu().id)
+}
+
+//go:nosplit
+func (l *spinlock) unlock() {
+	l.owner = -1
+	atomic.StoreUint32(&l.v, 0)
+}
+
+// holding reports whether the lock is held by current cpu
+//go:nosplit
+func (l *spinlock) holding() bool {
+	return atomic.LoadUint32(&l.v) != 0 && l.owner == int32(mycpu().id)
+}
+
+// pushcli disables interrupt and returns the old flags
+//go:nosplit
+func pushcli() uintptr {
+	flags := sys.Flags()
+	sys.Cli()
+	return flags
+}
+
+// popcli enables interrupt if it's enabled before pushcli
+//go:nosplit
+func popcli(flags uintptr) {
+	if flags&_FLAGS_IF != 0 {
+		sys.Sti()
+	}
+}
+
+// trapUnlock is called by trapret before returning to the thread,
+// the pending signal is delivered here.
+//go:nosplit
+func trapUnlock() {
+	signalDeliver()
+	klock.unlock()
+}
@@ -0,0 +1,37 @@
+package kernel
+
+import (
+	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/strace"
+)
+
+// traceSyscall handles the syscall in kernel or forwards it to the syscall thread,
+// and records it if it passes the filters of strace.
+//go:nosplit
+func traceSyscall(req *isyscall.Request, forward bool) {
+	var r strace.Record
+	// the syscall number and arguments may be overwritten by the return value
+	r.No = req.NO()
+	for i := 0; i < len(r.Args); i++ {
+		r.Args[i] = req.Arg(i)
+	}
+	if !strace.Match(r.No, r.Args[0]) {
+		if forward {
+			forwardCall(req)
+		} else {
+			doSyscall(req)
+		}
+		return
+	}
+	r.Tid = int32(Mythread().id)
+	r.Forwarded = forward
+	r.Start = nanosecond()
+	if forward {
+		forwardCall(req)
+	} else {
+		doSyscall(req)
+	}
+	r.Latency = nanosecond() - r.Start
+	r.Ret = req.Ret()
+	strace.Add(&r)
+}
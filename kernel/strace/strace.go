@@ -0,0 +1,214 @@
+// Package strace records the syscalls of all threads into a lock-free ring buffer.
+//
+// Both the syscalls handled in kernel and the ones forwarded to the syscall thread
+// are recorded by the kernel when they return, so Add is nosplit and never allocates.
+// Writers reserve a slot by increasing the head, readers detect the records
+// overwritten while reading by the sequence number of slot.
+package strace
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// number of records in ring, must be power of 2
+	ringSize = 4096
+
+	// max syscall number can be filtered
+	maxSyscall = 512
+)
+
+// Record is a traced syscall
+type Record struct {
+	// the sequence number of record
+	Seq uint64
+	// the thread id of caller
+	Tid int32
+	// handled by the syscall thread
+	Forwarded bool
+
+	No   uintptr
+	Args [6]uintptr
+	// the raw return value, errno is returned as negative number
+	Ret uintptr
+
+	// the nanoseconds since boot when the syscall entered
+	Start int64
+	// the nanoseconds spent in the syscall, including the time blocked
+	Latency int64
+}
+
+// Errno returns the errno of r, zero if no error
+func (r *Record) Errno() syscall.Errno {
+	if int64(r.Ret) < 0 && int64(r.Ret) > -4096 {
+		return syscall.Errno(-int64(r.Ret))
+	}
+	return 0
+}
+
+type slot struct {
+	// Seq+1 of the record in slot, zero while writing
+	seq uint64
+	rec Record
+}
+
+var (
+	enabled uint32
+	head    uint64
+	ring    [ringSize]slot
+
+	// syscall filter, all syscalls are traced if noFilterOn is zero
+	noFilterOn uint32
+	noFilter   [maxSyscall / 64]uint64
+	// fd filter, -1 means all fds
+	fdFilter int64 = -1
+)
+
+// the syscalls whose first argument is a fd
+var fdCalls = [...]bool{
+	syscall.SYS_READ:        true,
+	syscall.SYS_WRITE:       true,
+	syscall.SYS_CLOSE:       true,
+	syscall.SYS_FSTAT:       true,
+	syscall.SYS_LSEEK:       true,
+	syscall.SYS_IOCTL:       true,
+	syscall.SYS_PREAD64:     true,
+	syscall.SYS_PWRITE64:    true,
+	syscall.SYS_READV:       true,
+	syscall.SYS_WRITEV:      true,
+	syscall.SYS_SENDFILE:    true,
+	syscall.SYS_CONNECT:     true,
+	syscall.SYS_ACCEPT:      true,
+	syscall.SYS_SENDTO:      true,
+	syscall.SYS_RECVFROM:    true,
+	syscall.SYS_SENDMSG:     true,
+	syscall.SYS_RECVMSG:     true,
+	syscall.SYS_SHUTDOWN:    true,
+	syscall.SYS_BIND:        true,
+	syscall.SYS_LISTEN:      true,
+	syscall.SYS_GETSOCKNAME: true,
+	syscall.SYS_GETPEERNAME: true,
+	syscall.SYS_SETSOCKOPT:  true,
+	syscall.SYS_GETSOCKOPT:  true,
+	syscall.SYS_FCNTL:       true,
+	syscall.SYS_FSYNC:       true,
+	syscall.SYS_FTRUNCATE:   true,
+	syscall.SYS_GETDENTS:    true,
+	syscall.SYS_FCHDIR:      true,
+	syscall.SYS_GETDENTS64:  true,
+	syscall.SYS_EPOLL_WAIT:  true,
+	syscall.SYS_EPOLL_CTL:   true,
+	syscall.SYS_EPOLL_PWAIT: true,
+	syscall.SYS_ACCEPT4:     true,
+}
+
+// Enabled reports whether the tracer is enabled
+//go:nosplit
+func Enabled() bool {
+	return atomic.LoadUint32(&enabled) != 0
+}
+
+// Enable starts tracing
+func Enable() {
+	atomic.StoreUint32(&enabled, 1)
+}
+
+// Disable stops tracing, the records are kept
+func Disable() {
+	atomic.StoreUint32(&enabled, 0)
+}
+
+// SetSyscallFilter traces only the syscalls in nos, empty nos traces all syscalls.
+// The filter is not changed if any number in nos can't be filtered.
+func SetSyscallFilter(nos []uintptr) error {
+	for _, no := range nos {
+		if no >= maxSyscall {
+			return fmt.Errorf("strace: syscall %d out of filter range [0, %d)", no, maxSyscall)
+		}
+	}
+	atomic.StoreUint32(&noFilterOn, 0)
+	for i := range noFilter {
+		atomic.StoreUint64(&noFilter[i], 0)
+	}
+	if len(nos) == 0 {
+		return nil
+	}
+	for _, no := range nos {
+		p := &noFilter[no/64]
+		atomic.StoreUint64(p, atomic.LoadUint64(p)|1<<(no%64))
+	}
+	atomic.StoreUint32(&noFilterOn, 1)
+	return nil
+}
+
+// SetFdFilter traces only the syscalls operating on fd, negative fd traces all fds.
+func SetFdFilter(fd int) {
+	if fd < 0 {
+		fd = -1
+	}
+	atomic.StoreInt64(&fdFilter, int64(fd))
+}
+
+// Match reports whether the syscall no with the first argument arg0 passes the filters
+//go:nosplit
+func Match(no, arg0 uintptr) bool {
+	if atomic.LoadUint32(&noFilterOn) != 0 {
+		if no >= maxSyscall || atomic.LoadUint64(&noFilter[no/64])&(1<<(no%64)) == 0 {
+			return false
+		}
+	}
+	fd := atomic.LoadInt64(&fdFilter)
+	if fd < 0 {
+		return true
+	}
+	return no < uintptr(len(fdCalls)) && fdCalls[no] && int64(arg0) == fd
+}
+
+// Add appends r to the ring, the oldest record is overwritten if the ring is full
+//go:nosplit
+func Add(r *Record) {
+	seq := atomic.AddUint64(&head, 1) - 1
+	s := &ring[seq%ringSize]
+	atomic.StoreUint64(&s.seq, 0)
+	s.rec = *r
+	s.rec.Seq = seq
+	atomic.StoreUint64(&s.seq, seq+1)
+}
+
+// Head returns the sequence number of the next record
+func Head() uint64 {
+	return atomic.LoadUint64(&head)
+}
+
+// Read appends the records from sequence number seq to buf, it returns the records,
+// the sequence number to read next time and the number of records lost,
+// which are overwritten before read.
+func Read(seq uint64, buf []Record) ([]Record, uint64, uint64) {
+	var lost uint64
+	end := Head()
+	if end > ringSize && seq < end-ringSize {
+		lost += end - ringSize - seq
+		seq = end - ringSize
+	}
+	for ; seq < end && len(buf) < cap(buf); seq++ {
+		s := &ring[seq%ringSize]
+		v := atomic.LoadUint64(&s.seq)
+		if v == 0 || v < seq+1 {
+			// the writer of seq is not done, read it next time
+			break
+		}
+		if v > seq+1 {
+			lost++
+			continue
+		}
+		rec := s.rec
+		if atomic.LoadUint64(&s.seq) != v {
+			lost++
+			continue
+		}
+		buf = append(buf, rec)
+	}
+	return buf, seq, lost
+}
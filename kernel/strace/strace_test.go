@@ -0,0 +1,46 @@
+package strace
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestReadLost(t *testing.T) {
+	start := Head()
+	for i := 0; i < ringSize+10; i++ {
+		Add(&Record{No: uintptr(i)})
+	}
+	recs, next, lost := Read(start, make([]Record, 0, ringSize))
+	if lost != 10 {
+		t.Fatalf("expect 10 lost, got %d", lost)
+	}
+	if len(recs) != ringSize || next != Head() {
+		t.Fatalf("expect %d records to %d, got %d to %d", ringSize, Head(), len(recs), next)
+	}
+	if recs[0].No != 10 || recs[0].Seq != start+10 {
+		t.Fatalf("bad first record %+v", recs[0])
+	}
+}
+
+func TestMatch(t *testing.T) {
+	defer SetSyscallFilter(nil)
+	defer SetFdFilter(-1)
+
+	if !Match(syscall.SYS_FUTEX, 0) {
+		t.Fatal("all syscalls should match without filter")
+	}
+	SetSyscallFilter([]uintptr{syscall.SYS_READ, syscall.SYS_WRITE})
+	if Match(syscall.SYS_FUTEX, 0) || !Match(syscall.SYS_READ, 3) {
+		t.Fatal("syscall filter mismatch")
+	}
+	if SetSyscallFilter([]uintptr{syscall.SYS_FUTEX, maxSyscall}) == nil {
+		t.Fatal("expect error for syscall out of range")
+	}
+	if Match(syscall.SYS_FUTEX, 0) || !Match(syscall.SYS_READ, 3) {
+		t.Fatal("syscall filter changed by bad numbers")
+	}
+	SetFdFilter(3)
+	if !Match(syscall.SYS_WRITE, 3) || Match(syscall.SYS_WRITE, 4) {
+		t.Fatal("fd filter mismatch")
+	}
+}
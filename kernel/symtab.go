@@ -0,0 +1,176 @@
+package kernel
+
+import "unsafe"
+
+// A nosplit reader of the pclntab of go runtime, used to symbolize the
+// stack trace when panic, runtime.FuncForPC can't be called in trap context.
+// The layout of structures must be synced with runtime/symtab.go of go1.16.
+
+const _PCLNTAB_MAGIC = 0xfffffffa
+
+type pcHeader struct {
+	magic      uint32
+	pad1, pad2 uint8
+	minLC      uint8
+	ptrSize    uint8
+}
+
+type functab struct {
+	entry   uintptr
+	funcoff uintptr
+}
+
+// slice is the header of slice, the elements are read by raw pointers
+// to avoid bounds checks, which keeps the nosplit stack small.
+type slice struct {
+	base     uintptr
+	len, cap int
+}
+
+// moduledata only contains the leading fields of runtime.moduledata
+type moduledata struct {
+	pcHeader    *pcHeader
+	funcnametab slice // []byte
+	cutab       slice // []uint32
+	filetab     slice // []byte
+	pctab       slice // []byte
+	pclntable   slice // []byte
+	ftab        slice // []functab
+	findfunctab uintptr
+
+	minpc, maxpc uintptr
+}
+
+type _func struct {
+	entry   uintptr
+	nameoff int32
+
+	args        int32
+	deferreturn uint32
+
+	pcsp      uint32
+	pcfile    uint32
+	pcln      uint32
+	npcdata   uint32
+	cuOffset  uint32
+	funcID    uint8
+	_         [2]byte
+	nfuncdata uint8
+}
+
+//go:linkname firstmoduledata runtime.firstmoduledata
+var firstmoduledata moduledata
+
+//go:nosplit
+func byteAt(p uintptr) byte {
+	return *(*byte)(unsafe.Pointer(p))
+}
+
+// findFunc returns the function containing pc, nil if not found
+//go:nosplit
+func findFunc(pc uintptr) *_func {
+	md := &firstmoduledata
+	if md.pcHeader == nil || md.pcHeader.magic != _PCLNTAB_MAGIC {
+		return nil
+	}
+	if pc < md.minpc || pc >= md.maxpc || md.ftab.len < 2 {
+		return nil
+	}
+	// the last entry of ftab is the end of text
+	lo, hi := 0, md.ftab.len-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if ftabAt(mid).entry <= pc {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (*_func)(unsafe.Pointer(md.pclntable.base + ftabAt(lo).funcoff))
+}
+
+//go:nosplit
+func ftabAt(i int) *functab {
+	return (*functab)(unsafe.Pointer(firstmoduledata.ftab.base + uintptr(i)*unsafe.Sizeof(functab{})))
+}
+
+// gostring returns the NUL terminated string at p without allocation
+//go:nosplit
+func gostring(p uintptr) string {
+	n := 0
+	for byteAt(p+uintptr(n)) != 0 {
+		n++
+	}
+	var str string
+	h := (*slice)(unsafe.Pointer(&str))
+	h.base = p
+	h.len = n
+	return str
+}
+
+//go:nosplit
+func funcName(f *_func) string {
+	if f.nameoff <= 0 {
+		return "?"
+	}
+	return gostring(firstmoduledata.funcnametab.base + uintptr(f.nameoff))
+}
+
+//go:nosplit
+func readvarint(p uintptr) (uintptr, uint32) {
+	var v, shift uint32
+	for {
+		b := byteAt(p)
+		p++
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return p, v
+		}
+		shift += 7
+	}
+}
+
+// pcvalue decodes the pc-value table at off of f, and returns the value of targetpc
+//go:nosplit
+func pcvalue(f *_func, off uint32, targetpc uintptr) int32 {
+	if off == 0 {
+		return -1
+	}
+	md := &firstmoduledata
+	p := md.pctab.base + uintptr(off)
+	pc := f.entry
+	val := int32(-1)
+	var uvdelta, pcdelta uint32
+	for first := true; ; first = false {
+		p, uvdelta = readvarint(p)
+		if uvdelta == 0 && !first {
+			return -1
+		}
+		val += int32(-(uvdelta & 1) ^ (uvdelta >> 1))
+		p, pcdelta = readvarint(p)
+		pc += uintptr(pcdelta * uint32(md.pcHeader.minLC))
+		if targetpc < pc {
+			return val
+		}
+	}
+}
+
+// funcLine returns the file name and line number of pc in f
+//go:nosplit
+func funcLine(f *_func, pc uintptr) (string, int) {
+	md := &firstmoduledata
+	fileno := pcvalue(f, f.pcfile, pc)
+	line := pcvalue(f, f.pcln, pc)
+	if fileno < 0 || line < 0 {
+		return "?", 0
+	}
+	idx := uintptr(f.cuOffset) + uintptr(fileno)
+	if idx >= uintptr(md.cutab.len) {
+		return "?", 0
+	}
+	fileoff := *(*uint32)(unsafe.Pointer(md.cutab.base + idx*4))
+	if fileoff == ^uint32(0) {
+		return "?", 0
+	}
+	return gostring(md.filetab.base + uintptr(fileoff)), int(line)
+}
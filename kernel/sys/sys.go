@@ -12,6 +12,12 @@ func Outb(port uint16, data byte)
 //go:nosplit
 func Inb(port uint16) byte
 
+//go:nosplit
+func Outw(port uint16, data uint16)
+
+//go:nosplit
+func Inw(port uint16) uint16
+
 //go:nosplit
 func Outl(port uint16, data uint32)
 
@@ -27,6 +33,9 @@ func Sti()
 //go:nosplit
 func Hlt()
 
+//go:nosplit
+func Pause()
+
 //go:nosplit
 func Cr2() uintptr
 
@@ -67,3 +76,7 @@ func SetAX(val uintptr)
 
 //go:nosplit
 func CS() uintptr
+
+// Rdtsc returns the time stamp counter of current cpu
+//go:nosplit
+func Rdtsc() uint64
@@ -15,3 +15,8 @@ TEXT ·Hlt(SB), NOSPLIT, $0
 	HLT
 	RET
 
+
+// PAUSE - Spin Loop Hint
+TEXT ·Pause(SB), NOSPLIT, $0
+	PAUSE
+	RET
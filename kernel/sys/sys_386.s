@@ -15,6 +15,20 @@ TEXT ·Inb(SB), NOSPLIT, $0-5
 	MOVB AX, ret+4(FP)
 	RET
 
+// Outw(port uint16, data uint16)
+TEXT ·Outw(SB), NOSPLIT, $0-4
+	MOVW port+0(FP), DX
+	MOVW data+2(FP), AX
+	OUTW
+	RET
+
+// uint16 Inw(port uint16)
+TEXT ·Inw(SB), NOSPLIT, $0-6
+	MOVW port+0(FP), DX
+	INW
+	MOVW AX, ret+4(FP)
+	RET
+
 // Outl(port uint16, data uint32)
 TEXT ·Outl(SB), NOSPLIT, $0-8
 	MOVW port+0(FP), DX
@@ -52,3 +66,10 @@ TEXT ·Fxsave(SB), NOSPLIT, $0-4
 	MOVL   addr+0(FP), AX
 	FXSAVE (AX)
 	RET
+
+// uint64 Rdtsc()
+TEXT ·Rdtsc(SB), NOSPLIT, $0-8
+	RDTSC
+	MOVL AX, ret_lo+0(FP)
+	MOVL DX, ret_hi+4(FP)
+	RET
@@ -6,8 +6,10 @@ import (
 
 	"github.com/icexin/eggos/drivers/qemu"
 	"github.com/icexin/eggos/drivers/uart"
+	"github.com/icexin/eggos/kernel/entropy"
 	"github.com/icexin/eggos/kernel/isyscall"
 	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/strace"
 	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/kernel/trap"
 	"github.com/icexin/eggos/log"
@@ -25,7 +27,9 @@ const (
 	_MSR_FS_BASE   = 0xc0000100
 	_MSR_GS_BASE   = 0xc0000101
 
-	_EFER_SCE = 1 << 0 // Enable SYSCALL.
+	_EFER_SCE = 1 << 0  // Enable SYSCALL.
+	_EFER_LME = 1 << 8  // Long mode enable.
+	_EFER_NXE = 1 << 11 // No-execute enable.
 )
 
 const (
@@ -48,27 +52,40 @@ var (
 		syscall.SYS_ARCH_PRCTL,
 		syscall.SYS_MMAP,
 		syscall.SYS_MUNMAP,
+		syscall.SYS_MPROTECT,
 		syscall.SYS_CLOCK_GETTIME,
 		syscall.SYS_RT_SIGPROCMASK,
 		syscall.SYS_SIGALTSTACK,
 		syscall.SYS_RT_SIGACTION,
+		syscall.SYS_RT_SIGRETURN,
 		syscall.SYS_GETTID,
+		syscall.SYS_GETPID,
+		syscall.SYS_KILL,
+		syscall.SYS_TKILL,
+		syscall.SYS_TGKILL,
+		syscall.SYS_SCHED_GETAFFINITY,
 		syscall.SYS_CLONE,
 		syscall.SYS_FUTEX,
 		syscall.SYS_NANOSLEEP,
+		syscall.SYS_GETITIMER,
+		syscall.SYS_SETITIMER,
+		syscall.SYS_TIMER_CREATE,
+		syscall.SYS_TIMER_SETTIME,
+		syscall.SYS_TIMER_GETTIME,
+		syscall.SYS_TIMER_GETOVERRUN,
+		syscall.SYS_TIMER_DELETE,
 		syscall.SYS_SCHED_YIELD,
 		syscall.SYS_MADVISE,
+		syscall.SYS_EXIT,
 		syscall.SYS_EXIT_GROUP,
+		syscall.SYS_REBOOT,
 
-		// TODO: real random
 		unix.SYS_GETRANDOM,
 
 		// may removed in the future
-		syscall.SYS_EPOLL_CREATE1,
 		syscall.SYS_EPOLL_CTL,
 		syscall.SYS_EPOLL_WAIT,
 		syscall.SYS_EPOLL_PWAIT,
-		syscall.SYS_PIPE2,
 
 		SYS_WAIT_IRQ,
 		SYS_WAIT_SYSCALL,
@@ -95,14 +112,22 @@ func syscallIntr() {
 	req := tf.SyscallRequest()
 	doInKernel := !(bootstrapDone && canForward(&req))
 	if doInKernel {
-		doSyscall(&req)
+		if strace.Enabled() {
+			traceSyscall(&req, false)
+		} else {
+			doSyscall(&req)
+		}
 		return
 	}
 
 	// use tricks to get whether the current g has p
 	status := readgstatus(getg())
 	if status != _Grunning {
-		forwardCall(&req)
+		if strace.Enabled() {
+			traceSyscall(&req, true)
+		} else {
+			forwardCall(&req)
+		}
 	} else {
 		// tf.AX = doForwardSyscall(tf.AX, tf.BX, tf.CX, tf.DX, tf.SI, tf.DI, tf.BP)
 		// making all forwarded syscall as blocked syscall, so the syscall task can acquire a P
@@ -129,12 +154,12 @@ func canForward(req *isyscall.Request) bool {
 			return false
 		}
 		// handle pipe write
-		if req.Arg(0) == pipeWriteFd {
+		if pipeOf(req.Arg(0)) != nil {
 			return false
 		}
-	case syscall.SYS_READ:
+	case syscall.SYS_READ, syscall.SYS_FCNTL:
 		// handle pipe read
-		if req.Arg(0) == pipeReadFd {
+		if pipeOf(req.Arg(0)) != nil {
 			return false
 		}
 	}
@@ -187,39 +212,77 @@ func doSyscall(req *isyscall.Request) {
 	case syscall.SYS_ARCH_PRCTL:
 		sysArchPrctl(req)
 	case syscall.SYS_SCHED_GETAFFINITY:
-		req.SetRet(0)
+		sysSchedGetaffinity(req)
 	case syscall.SYS_OPENAT:
 		req.SetRet(isyscall.Errno(errno.ENOSYS))
 	case syscall.SYS_MMAP:
 		sysMmap(req)
 	case syscall.SYS_MUNMAP:
 		sysMunmap(req)
+	case syscall.SYS_MPROTECT:
+		sysMprotect(req)
 	case syscall.SYS_MADVISE:
+		sysMadvise(req)
 	case syscall.SYS_READ:
 		sysRead(req)
 	case syscall.SYS_WRITE:
 		sysWrite(req)
 	case syscall.SYS_CLOSE:
+		fdClose(req.Arg(0))
+	case syscall.SYS_FCNTL:
+		sysFcntl(req)
 	case syscall.SYS_CLOCK_GETTIME:
 		sysClockGetTime(req)
 	case syscall.SYS_RT_SIGPROCMASK:
+		sysRtSigprocmask(req)
 	case syscall.SYS_SIGALTSTACK:
+		sysSigaltstack(req)
 	case syscall.SYS_RT_SIGACTION:
+		sysRtSigaction(req)
+	case syscall.SYS_RT_SIGRETURN:
+		sysRtSigreturn(req)
 	case syscall.SYS_GETTID:
 		req.SetRet(uintptr(Mythread().id))
+	case syscall.SYS_GETPID:
+		req.SetRet(kernelPid)
+	case syscall.SYS_KILL:
+		sysKill(req)
+	case syscall.SYS_TKILL:
+		sysTkill(req, req.Arg(0), req.Arg(1))
+	case syscall.SYS_TGKILL:
+		sysTgkill(req)
 	case syscall.SYS_CLONE:
 		sysClone(req)
 	case syscall.SYS_FUTEX:
 		sysFutex(req)
 	case syscall.SYS_NANOSLEEP:
 		sysNanosleep(req)
+	case syscall.SYS_GETITIMER:
+		sysGetitimer(req)
+	case syscall.SYS_SETITIMER:
+		sysSetitimer(req)
+	case syscall.SYS_TIMER_CREATE:
+		sysTimerCreate(req)
+	case syscall.SYS_TIMER_SETTIME:
+		sysTimerSettime(req)
+	case syscall.SYS_TIMER_GETTIME:
+		sysTimerGettime(req)
+	case syscall.SYS_TIMER_GETOVERRUN:
+		sysTimerGetoverrun(req)
+	case syscall.SYS_TIMER_DELETE:
+		sysTimerDelete(req)
 	case syscall.SYS_SCHED_YIELD:
 		Yield()
+	case syscall.SYS_EXIT:
+		exit()
 	case syscall.SYS_EXIT_GROUP:
 		sysExitGroup(req)
+	case syscall.SYS_REBOOT:
+		sysReboot(req)
 
 	case unix.SYS_GETRANDOM:
-		req.SetRet(req.Arg(1))
+		buf := sys.UnsafeBuffer(req.Arg(0), int(req.Arg(1)))
+		req.SetRet(uintptr(entropy.Read(buf)))
 
 	case syscall.SYS_EPOLL_CREATE1:
 		sysEpollCreate(req)
@@ -259,13 +322,37 @@ func sysArchPrctl(req *isyscall.Request) {
 	}
 }
 
+//go:nosplit
+func sysSchedGetaffinity(req *isyscall.Request) {
+	size := req.Arg(1)
+	if size < 8 {
+		req.SetErrorNO(syscall.EINVAL)
+		return
+	}
+	if req.Arg(2) == 0 {
+		req.SetErrorNO(syscall.EFAULT)
+		return
+	}
+	mask := (*uint64)(unsafe.Pointer(req.Arg(2)))
+	*mask = 1<<uint(ncpu) - 1
+	// the size of cpu mask copied
+	req.SetRet(8)
+}
+
 //go:nosplit
 func sysMmap(req *isyscall.Request) {
 	addr := req.Arg(0)
 	n := req.Arg(1)
 	prot := req.Arg(2)
-	// called on sysReserve
+	flags := req.Arg(3)
 	if prot == syscall.PROT_NONE {
+		// called on sysFault and by SysMmapGuard, the range is inaccessible since then
+		if flags&syscall.MAP_FIXED != 0 {
+			mm.Guard(addr, n)
+			req.SetRet(addr)
+			return
+		}
+		// called on sysReserve
 		if addr == 0 {
 			req.SetRet(mm.Sbrk(n))
 		}
@@ -273,7 +360,7 @@ func sysMmap(req *isyscall.Request) {
 	}
 
 	// called on sysMap and sysAlloc
-	req.SetRet(mm.Mmap(addr, n))
+	req.SetRet(mm.MmapProt(addr, n, prot))
 	return
 }
 
@@ -282,13 +369,47 @@ func sysMunmap(req *isyscall.Request) {
 	addr := req.Arg(0)
 	n := req.Arg(1)
 	mm.Munmap(addr, n)
+	req.SetRet(0)
+}
+
+//go:nosplit
+func sysMadvise(req *isyscall.Request) {
+	addr := req.Arg(0)
+	n := req.Arg(1)
+	advice := req.Arg(2)
+	if addr%mm.PGSIZE != 0 {
+		req.SetErrorNO(syscall.EINVAL)
+		return
+	}
+	mm.Madvise(addr, n, advice)
+	req.SetRet(0)
+}
+
+//go:nosplit
+func sysMprotect(req *isyscall.Request) {
+	addr := req.Arg(0)
+	n := req.Arg(1)
+	prot := req.Arg(2)
+	if addr%mm.PGSIZE != 0 {
+		req.SetErrorNO(syscall.EINVAL)
+		return
+	}
+	if !mm.Mprotect(addr, n, prot) {
+		req.SetErrorNO(syscall.ENOMEM)
+		return
+	}
+	req.SetRet(0)
 }
 
 //go:nosplit
 func sysRead(req *isyscall.Request) {
-	fd := req.Arg(0)
-	if fd == pipeReadFd {
-		sysPipeRead(req)
+	if e := pipeOf(req.Arg(0)); e != nil {
+		// the write end is not open for reading
+		if e.write {
+			req.SetRet(isyscall.Errno(errno.EBADF))
+			return
+		}
+		sysPipeRead(req, e)
 		return
 	}
 	req.SetRet(isyscall.Errno(errno.EINVAL))
@@ -306,18 +427,35 @@ func sysWrite(req *isyscall.Request) {
 		uart.Write(buffer)
 		req.SetRet(len)
 		return
-	case pipeWriteFd:
-		sysPipeWrite(req)
-		return
 	default:
+		if e := pipeOf(fd); e != nil {
+			if !e.write {
+				req.SetErrorNO(syscall.EBADF)
+				return
+			}
+			sysPipeWrite(req, e)
+			return
+		}
 		req.SetErrorNO(syscall.EINVAL)
 	}
 }
 
+//go:nosplit
+func sysFcntl(req *isyscall.Request) {
+	if e := pipeOf(req.Arg(0)); e != nil {
+		req.SetRet(pipeFcntl(e, req.Arg(1), req.Arg(2)))
+	}
+}
+
 //go:nosplit
 func sysClockGetTime(req *isyscall.Request) {
 	ts := (*linux.Timespec)(unsafe.Pointer(req.Arg(1)))
-	*ts = clocktime()
+	n := nanosecond()
+	if req.Arg(0) == _CLOCK_REALTIME {
+		n += wallBase
+	}
+	ts.Sec = n / second
+	ts.Nsec = n % second
 }
 
 //go:nosplit
@@ -332,11 +470,16 @@ func sysClone(req *isyscall.Request) {
 
 //go:nosplit
 func sysFutex(req *isyscall.Request) {
-	addr := (*uintptr)(unsafe.Pointer(req.Arg(0)))
+	addr := (*uint32)(unsafe.Pointer(req.Arg(0)))
 	op := req.Arg(1)
-	val := req.Arg(2)
-	ts := (*linux.Timespec)(unsafe.Pointer(req.Arg(3)))
-	futex(addr, op, val, ts)
+	val := uint32(req.Arg(2))
+	addr2 := (*uint32)(unsafe.Pointer(req.Arg(4)))
+	ret, errno := futex(addr, op, val, req.Arg(3), addr2, uint32(req.Arg(5)))
+	if errno != 0 {
+		req.SetErrorNO(errno)
+		return
+	}
+	req.SetRet(ret)
 }
 
 //go:nosplit
@@ -347,6 +490,12 @@ func sysNanosleep(req *isyscall.Request) {
 
 //go:nosplit
 func sysEpollCreate(req *isyscall.Request) {
+	// called before fs is ready, or by the syscall thread
+	errno := epollCreate(epollFd)
+	if errno != 0 {
+		req.SetErrorNO(syscall.EMFILE)
+		return
+	}
 	req.SetRet(epollFd)
 }
 
@@ -363,9 +512,9 @@ func sysEpollCtl(req *isyscall.Request) {
 func sysEpollWait(req *isyscall.Request) {
 	efd := req.Arg(0)
 	evs := req.Arg(1)
-	len := req.Arg(2)
-	_ms := req.Arg(3)
-	req.SetRet(epollWait(efd, evs, len, _ms))
+	n := int(int32(req.Arg(2)))
+	timeout := int(int32(req.Arg(3)))
+	req.SetRet(epollWait(efd, evs, n, timeout))
 }
 
 //go:nosplit
@@ -388,9 +537,10 @@ func sysFixedMmap(req *isyscall.Request) {
 
 //go:nosplit
 func sysExitGroup(req *isyscall.Request) {
+	// the exit code is passed to qemu by isa-debug-exit device,
+	// turn off the machine if it's not running in qemu.
 	qemu.Exit(int(req.Arg(0)))
-	for {
-	}
+	poweroff()
 }
 
 //go:nosplit
@@ -408,10 +558,22 @@ func vdsoInit() {
 	dst := sys.UnsafeBuffer(mm.Mmap(vdsoGettimeofdaySym, 0x100), 0x100)
 	src := sys.UnsafeBuffer(sys.FuncPC(vdsoGettimeofday), 0x100)
 	copy(dst, src)
+	vdsoClockInit()
 }
 
 //go:nosplit
 func syscallInit() {
+	syscallMSRInit()
+	forwardInit()
+	trap.Register(0x80, syscallIntr)
+	epollInit()
+	pipeInit()
+	vdsoInit()
+}
+
+// syscallMSRInit setups SYSCALL instruction on current cpu
+//go:nosplit
+func syscallMSRInit() {
 	// write syscall selector
 	wrmsr(_MSR_STAR, 8<<32)
 	// clear IF when enter syscall
@@ -422,8 +584,21 @@ func syscallInit() {
 	// Enable SYSCALL instruction.
 	efer := rdmsr(_MSR_IA32_EFER)
 	wrmsr(_MSR_IA32_EFER, efer|_EFER_SCE)
+}
 
-	trap.Register(0x80, syscallIntr)
-	epollInit()
-	vdsoInit()
+// nxInit enables no-execute page on bootstrap cpu if supported,
+// application processors inherit it from apTrampoline.
+//go:nosplit
+func nxInit() {
+	maxfn, _, _, _ := cpuid(_CPUID_FN_EXT_MAX, 0)
+	if maxfn < _CPUID_FN_EXT {
+		return
+	}
+	_, _, _, edx := cpuid(_CPUID_FN_EXT, 0)
+	if edx&_CPUID_EDX_NX == 0 {
+		return
+	}
+	efer := rdmsr(_MSR_IA32_EFER)
+	wrmsr(_MSR_IA32_EFER, efer|_EFER_NXE)
+	mm.EnableNX()
 }
@@ -9,6 +9,14 @@
 
 #define SYS_clockgettime 228
 
+// sync with vdsoData and vdso page layout
+#define vdso_clock_gettime 0xffffffffff600100
+#define vdso_data 0xffffffffff600800
+#define vdso_seq  0
+#define vdso_base 8
+#define vdso_mult 16
+#define vdso_wall 24
+
 TEXT ·syscallEntry(SB), NOSPLIT, $0
 	// save AX
 	MOVQ AX, tls_ax(GS)
@@ -46,12 +54,62 @@ TEXT ·syscallEntry(SB), NOSPLIT, $0
 	// jmp INT 0x80
 	JMP ·trap128(SB)
 
+// vdsoGettimeofday and vdsoClockgettime are copied to the vdso page,
+// only relative jumps are allowed.
 TEXT ·vdsoGettimeofday(SB), NOSPLIT, $0
-	MOVQ $SYS_clockgettime, AX
-
-	// DI store *TimeSpec, but clockgettime need SI
+	// DI store *Timeval, but clockgettime need SI
 	MOVQ DI, SI
 	MOVQ $0, DI
+	MOVQ $vdso_clock_gettime, AX
+	CALL AX
+
+	// convert nanosecond to microsecond
+	MOVQ 8(SI), AX
+	XORQ DX, DX
+	MOVQ $1000, CX
+	DIVQ CX
+	MOVQ AX, 8(SI)
+	XORQ AX, AX
+	RET
+
+// vdsoClockgettime(clockid DI, ts SI) computes the time from tsc
+// and vdsoData, or traps into kernel if the clocksource is not tsc.
+TEXT ·vdsoClockgettime(SB), NOSPLIT, $0
+	MOVQ $vdso_data, R8
+	MOVQ vdso_mult(R8), R9
+	CMPQ R9, $0
+	JEQ  slowpath
+
+retry:
+	MOVL  vdso_seq(R8), R10
+	TESTL $1, R10
+	JNZ   retry
+	RDTSC
+	SHLQ  $32, DX
+	ORQ   DX, AX
+	SUBQ  vdso_base(R8), AX
+	MULQ  vdso_mult(R8)
+	// AX = DX:AX >> 32
+	SHRQ  $32, DX, AX
+	CMPQ  DI, $0
+	JNE   monotonic
+	ADDQ  vdso_wall(R8), AX
+
+monotonic:
+	MOVL vdso_seq(R8), R11
+	CMPL R10, R11
+	JNE  retry
+
+	XORQ DX, DX
+	MOVQ $1000000000, CX
+	DIVQ CX
+	MOVQ AX, 0(SI)
+	MOVQ DX, 8(SI)
+	XORQ AX, AX
+	RET
+
+slowpath:
+	MOVQ $SYS_clockgettime, AX
 	INT  $0x80
 	RET
 
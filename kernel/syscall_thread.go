@@ -2,52 +2,199 @@ package kernel
 
 import (
 	"runtime"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
 	"github.com/icexin/eggos/kernel/isyscall"
-	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/log"
 )
 
+const (
+	// capacity of the forwarded syscall queue, must be power of 2
+	_FORWARD_QUEUE_SIZE = 256
+)
+
 var (
 	syscalltask threadptr
 
-	// pendingCall is the address of pending forward syscall
-	pendingCall uintptr
+	// fwdq holds the forwarded syscalls waiting for the syscall thread
+	fwdq fwdQueue
+	// protected by klock
+	fwdStat ForwardStat
 )
 
+// ForwardStat is the statistics of forwarded syscalls
+type ForwardStat struct {
+	// number of completed requests
+	Calls uint64
+	// number of calls blocked on full queue
+	QueueFull uint64
+	// requests in queue now and at most
+	Depth    int
+	MaxDepth int
+	// nanoseconds from enqueue to completion
+	TotalLatency int64
+	MaxLatency   int64
+}
+
+type fwdSlot struct {
+	// the position the slot is ready for, see push and pop
+	seq uint64
+	req uintptr
+}
+
+// fwdQueue is a bounded multi-producer ring based on Dmitry Vyukov's queue.
+// The callers push requests in trap context, the syscall thread pops
+// them in user space without trapping into kernel.
+type fwdQueue struct {
+	slots [_FORWARD_QUEUE_SIZE]fwdSlot
+	head  uint64
+	tail  uint64
+
+	// sleep keys of the syscall thread and the callers blocked on full queue
+	notEmpty uintptr
+	notFull  uintptr
+	// number of callers sleeping on notFull
+	fullWaiters uint32
+}
+
+//go:nosplit
+func (q *fwdQueue) init() {
+	for i := range q.slots {
+		q.slots[i].seq = uint64(i)
+	}
+}
+
+// push appends req to q, it returns false if q is full
+//go:nosplit
+func (q *fwdQueue) push(req uintptr) bool {
+	for {
+		pos := atomic.LoadUint64(&q.tail)
+		s := &q.slots[pos&(_FORWARD_QUEUE_SIZE-1)]
+		seq := atomic.LoadUint64(&s.seq)
+		switch {
+		case seq == pos:
+			if atomic.CompareAndSwapUint64(&q.tail, pos, pos+1) {
+				s.req = req
+				atomic.StoreUint64(&s.seq, pos+1)
+				return true
+			}
+		case seq < pos:
+			// the slot is not consumed since last round
+			return false
+		}
+	}
+}
+
+// pop removes the first request of q, it returns 0 if q is empty.
+// The slot is released when pop returns, so the callers wake the pushers
+// blocked on full queue after pop.
+//go:nosplit
+func (q *fwdQueue) pop() uintptr {
+	for {
+		pos := atomic.LoadUint64(&q.head)
+		s := &q.slots[pos&(_FORWARD_QUEUE_SIZE-1)]
+		seq := atomic.LoadUint64(&s.seq)
+		switch {
+		case seq == pos+1:
+			if atomic.CompareAndSwapUint64(&q.head, pos, pos+1) {
+				req := s.req
+				atomic.StoreUint64(&s.seq, pos+_FORWARD_QUEUE_SIZE)
+				return req
+			}
+		case seq < pos+1:
+			return 0
+		}
+	}
+}
+
+//go:nosplit
+func (q *fwdQueue) depth() int {
+	head := atomic.LoadUint64(&q.head)
+	tail := atomic.LoadUint64(&q.tail)
+	if tail < head {
+		return 0
+	}
+	return int(tail - head)
+}
+
+//go:nosplit
+func forwardInit() {
+	fwdq.init()
+}
+
 //go:nosplit
 func forwardCall(call *isyscall.Request) {
-	// wait syscall task fetch pendingCall
-	for pendingCall != 0 {
-		sleepon(&pendingCall)
+	start := nanosecond()
+	req := uintptr(unsafe.Pointer(call))
+	if !fwdq.push(req) {
+		fwdStat.QueueFull++
+		// the syscall thread pops without klock and may be preempted before
+		// releasing the slot, so never spin here. Push again after announcing
+		// the waiter, the popper sees it after releasing the slot and wakes us up.
+		atomic.AddUint32(&fwdq.fullWaiters, 1)
+		for !fwdq.push(req) {
+			sleepon(&fwdq.notFull)
+		}
+		atomic.AddUint32(&fwdq.fullWaiters, ^uint32(0))
+	}
+	if depth := fwdq.depth(); depth > fwdStat.MaxDepth {
+		fwdStat.MaxDepth = depth
 	}
-	pendingCall = uintptr(unsafe.Pointer(call))
-	// tell syscall task pendingCall is avaiable
-	// we can't only wakeup only one thread here
-	wakeup(&pendingCall, -1)
+	// only the syscall thread sleeps on notEmpty
+	wakeup(&fwdq.notEmpty, 1)
 
 	// wait on syscall task handle request
 	sleepon(&call.Lock)
 
+	latency := nanosecond() - start
+	fwdStat.Calls++
+	fwdStat.TotalLatency += latency
+	if latency > fwdStat.MaxLatency {
+		fwdStat.MaxLatency = latency
+	}
+
 	// for debug purpose
 	if -call.Ret() == uintptr(isyscall.EPANIC) {
 		preparePanic(Mythread().tf)
 	}
 }
 
+// fetchPendingCall pops a forwarded syscall, sleeps if the queue is empty
 //go:nosplit
 func fetchPendingCall() uintptr {
-	// waiting someone call forward syscall
-	for pendingCall == 0 {
-		sleepon(&pendingCall)
+	for {
+		req := fwdq.pop()
+		if req != 0 {
+			if atomic.LoadUint32(&fwdq.fullWaiters) != 0 {
+				wakeup(&fwdq.notFull, 1)
+			}
+			return req
+		}
+		sleepon(&fwdq.notEmpty)
 	}
-	ret := pendingCall
-	pendingCall = 0
-	// wakeup one thread, pendingCall is avaiable
-	wakeup(&pendingCall, 1)
-	return ret
+}
+
+// popPendingCall pops a forwarded syscall without trapping into kernel,
+// it returns 0 if the queue is empty.
+func popPendingCall() uintptr {
+	req := fwdq.pop()
+	if req != 0 && atomic.LoadUint32(&fwdq.fullWaiters) != 0 {
+		lockedWakeup(&fwdq.notFull, 1)
+	}
+	return req
+}
+
+// ForwardStats returns the statistics of forwarded syscalls
+func ForwardStats() ForwardStat {
+	flags := pushcli()
+	klock.lock()
+	st := fwdStat
+	st.Depth = fwdq.depth()
+	klock.unlock()
+	popcli(flags)
+	return st
 }
 
 // runSyscallThread run in normal go code space
@@ -57,9 +204,14 @@ func runSyscallThread() {
 	syscalltask = (threadptr)(unsafe.Pointer(my))
 	log.Infof("[syscall] tid:%d", my.id)
 	for {
-		callptr, _, err := syscall.Syscall(SYS_WAIT_SYSCALL, 0, 0, 0)
-		if err != 0 {
-			throw("bad SYS_WAIT_SYSCALL return")
+		// drain the queue before sleeping in kernel
+		callptr := popPendingCall()
+		if callptr == 0 {
+			var err syscall.Errno
+			callptr, _, err = syscall.Syscall(SYS_WAIT_SYSCALL, 0, 0, 0)
+			if err != 0 {
+				throw("bad SYS_WAIT_SYSCALL return")
+			}
 		}
 		call := (*isyscall.Request)(unsafe.Pointer(callptr))
 
@@ -74,25 +226,10 @@ func runSyscallThread() {
 			call.Done()
 			continue
 		}
+		// the forwarded syscalls are traced by kernel, see traceSyscall
 		go func() {
 			handler(call)
-			var iret interface{}
-			ret := call.Ret()
-			if hasErrno(ret) {
-				iret = syscall.Errno(-ret)
-			} else {
-				iret = ret
-			}
-			log.Debugf("[syscall] %s(%d)(0x%x, 0x%x, 0x%x, 0x%x, 0x%x, 0x%x) = %v",
-				syscallName(int(no)), no,
-				call.Arg(0), call.Arg(1), call.Arg(2), call.Arg(3),
-				call.Arg(4), call.Arg(5), iret,
-			)
 			call.Done()
 		}()
 	}
 }
-
-func hasErrno(n uintptr) bool {
-	return 1<<(sys.PtrSize*8-1)&n != 0
-}
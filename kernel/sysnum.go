@@ -318,9 +318,24 @@ var sysnum = [...]string{
 	313: "finit_module",
 }
 
+// SyscallName returns the name of syscall n
+func SyscallName(n int) string {
+	return syscallName(n)
+}
+
+// SyscallNumber returns the number of syscall name, -1 if not found
+func SyscallNumber(name string) int {
+	for i, s := range sysnum {
+		if s == name {
+			return i
+		}
+	}
+	return -1
+}
+
 //go:nosplit
 func syscallName(n int) string {
-	if n >= len(sysnum) {
+	if n < 0 || n >= len(sysnum) {
 		return "unknown"
 	}
 	return sysnum[n]
@@ -1,6 +1,7 @@
 package kernel
 
 import (
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/icexin/eggos/kernel/mm"
@@ -8,10 +9,17 @@ import (
 )
 
 const (
-	_NTHREDS = 20
+	// threads are allocated by chunk when the table is full
+	_THREAD_CHUNK_SIZE = 16
+	_MAX_THREAD_CHUNKS = 256
+	_MAX_THREADS       = _THREAD_CHUNK_SIZE * _MAX_THREAD_CHUNKS
 
+	_FLAGS_TF        = 0x100
 	_FLAGS_IF        = 0x200
+	_FLAGS_DF        = 0x400
 	_FLAGS_IOPL_USER = 0x3000
+	// the flags can be changed by user, eg. by sigreturn
+	_FLAGS_USER = 0xcd5 | _FLAGS_TF
 
 	_RPL_USER = 3
 
@@ -19,6 +27,8 @@ const (
 	_THREAD_STACK_GUARD_OFFSET = 1 << 10
 
 	_CLONE_IDLE = 0x8000000000000000
+	// the cpu index of idle thread is stored in low bits of clone flags
+	_CLONE_IDLE_CPU_MASK = 0xff
 )
 
 const (
@@ -35,10 +45,18 @@ const (
 	_TSS_SS0  = 2
 )
 
+type threadChunk [_THREAD_CHUNK_SIZE]Thread
+
 var (
-	threads    [_NTHREDS]Thread
-	scheduler  *context
-	idleThread threadptr
+	// the address of thread chunks, chunks are never freed
+	threadChunks [_MAX_THREAD_CHUNKS]uintptr
+	// number of thread slots
+	nthreads int
+
+	// kernel stacks of exited threads, they are kept mapped and reused
+	// by new threads, since other cpus may still cache the mapping.
+	freeStacks  [_MAX_THREADS]uintptr
+	nfreeStacks int
 )
 
 //go:notinheap
@@ -55,7 +73,8 @@ type context struct {
 
 // position of threadTLS and fpstate must be synced with trap.s and syscall.s
 type Thread struct {
-	// store thread tls, the pointer to Thread
+	// store thread tls, the pointer to Thread, a scratch register
+	// and the pointer to the cpu which the thread is running on
 	threadTLS [4]uintptr
 
 	// the state of fpu
@@ -73,21 +92,92 @@ type Thread struct {
 	// sysmon 会调用usleep，进而调用sleepon，如果sleepKey是个指针会触发gcWriteBarrier
 	// 而sysmon没有P，会导致空指针
 	sleepKey uintptr
-	// for sleep timeout
-	timerKey uintptr
+	// the wait queue of sleepKey, see waitq
+	waiting  bool
+	waitBits uint32
+	waitNext threadptr
+	waitPrev threadptr
+	// for sleep timeout, timerIdx is the index+1 in timerq, zero if not in
+	deadline int64
+	timerIdx int
 
 	// store goroutine tls
 	fsBase uintptr
 
 	// 用于保存需要转发的系统调用栈帧
 	systf trapFrame
+
+	// idle thread only runs on its own cpu
+	idle bool
+
+	// signal state, see signal.go
+	sigmask    uint64
+	sigpending uint64
+	sigstack   sigstack
+	// si_code of pending signals
+	sigcodes [_NSIG]int32
+
+	// the time when the thread was scheduled or charged by itimer
+	runStart int64
+	// the cpu time charged to the thread, the value of CLOCK_THREAD_CPUTIME_ID
+	cputime int64
+}
+
+// threadAt returns the thread of slot i, i must be less than nthreads
+//go:nosplit
+func threadAt(i int) *Thread {
+	chunk := (*threadChunk)(unsafe.Pointer(threadChunks[i/_THREAD_CHUNK_SIZE]))
+	return &chunk[i%_THREAD_CHUNK_SIZE]
+}
+
+// threadByID returns the live thread of id, nil if not found
+//go:nosplit
+func threadByID(id int) *Thread {
+	if id < 0 || id >= nthreads {
+		return nil
+	}
+	t := threadAt(id)
+	if t.state == UNUSED || t.state == EXIT {
+		return nil
+	}
+	return t
+}
+
+//go:nosplit
+func (t *Thread) stateName() string {
+	switch t.state {
+	case INITING:
+		return "initing"
+	case SLEEPING:
+		return "sleeping"
+	case RUNNABLE:
+		return "runnable"
+	case RUNNING:
+		if t.idle {
+			return "running idle"
+		}
+		return "running"
+	}
+	return "unknown"
+}
+
+// growThreads adds a chunk of thread slots
+//go:nosplit
+func growThreads() {
+	idx := nthreads / _THREAD_CHUNK_SIZE
+	if idx >= _MAX_THREAD_CHUNKS {
+		throw("no thread slot available")
+	}
+	// mmap clears the memory
+	threadChunks[idx] = mm.Mmap(0, unsafe.Sizeof(threadChunk{}))
+	nthreads += _THREAD_CHUNK_SIZE
 }
 
 //go:nosplit
 func allocThread() *Thread {
 	var t *Thread
-	for i := 0; i < _NTHREDS; i++ {
-		tt := &threads[i]
+	for i := 0; i < nthreads; i++ {
+		tt := threadAt(i)
 		if tt.state == UNUSED {
 			t = tt
 			t.id = i
@@ -95,7 +185,10 @@ func allocThread() *Thread {
 		}
 	}
 	if t == nil {
-		throw("no thread slot available")
+		id := nthreads
+		growThreads()
+		t = threadAt(id)
+		t.id = id
 	}
 
 	t.state = INITING
@@ -107,11 +200,34 @@ func allocThread() *Thread {
 
 //go:nosplit
 func allocThreadStack() uintptr {
-	stack := mm.Mmap(0, _THREAD_STACK_SIZE)
+	if nfreeStacks > 0 {
+		nfreeStacks--
+		return freeStacks[nfreeStacks]
+	}
+	// overflowing the stack faults on the guard page below it
+	stack := mm.MmapGuard(_THREAD_STACK_SIZE)
 	stack += _THREAD_STACK_SIZE - _THREAD_STACK_GUARD_OFFSET
 	return stack
 }
 
+//go:nosplit
+func freeThreadStack(stack uintptr) {
+	// every stack belongs to a thread slot, the pool never overflows
+	freeStacks[nfreeStacks] = stack
+	nfreeStacks++
+}
+
+// freeThread reclaims the kernel stack and fpu state of the exited thread,
+// it's called by scheduler after switching out of t.
+//go:nosplit
+func freeThread(t *Thread) {
+	itimerThreadExit(t)
+	freeThreadStack(t.kstack)
+	mm.Free(t.fpstate)
+	sys.Memclr(uintptr(unsafe.Pointer(t)), int(unsafe.Sizeof(*t)))
+	t.state = UNUSED
+}
+
 type threadptr uintptr
 
 //go:nosplit
@@ -143,6 +259,8 @@ func switchThreadContext(t *Thread) {
 	if t.fsBase != 0 {
 		setFS(t.fsBase)
 	}
+	// the thread runs on current cpu
+	t.threadTLS[2] = uintptr(unsafe.Pointer(mycpu()))
 	// set current thread base address
 	setGS(uintptr(unsafe.Pointer(&t.threadTLS)))
 
@@ -199,12 +317,12 @@ func thread0() {
 
 // run when after main init
 func idleInit() {
-	// thread0 clone idle thread
-	stack := mm.SysMmap(0, _THREAD_STACK_SIZE) +
-		_THREAD_STACK_SIZE - _THREAD_STACK_GUARD_OFFSET
-
-	tid := ksysClone(sys.FuncPC(idle), stack, _CLONE_IDLE)
-	idleThread = (threadptr)(unsafe.Pointer(&threads[tid]))
+	// thread0 clone idle thread for every cpu
+	for i := 0; i < ncpu; i++ {
+		stack := mm.SysMmapGuard(_THREAD_STACK_SIZE) +
+			_THREAD_STACK_SIZE - _THREAD_STACK_GUARD_OFFSET
+		ksysClone(sys.FuncPC(idle), stack, _CLONE_IDLE|uintptr(i))
+	}
 }
 
 //go:nosplit
@@ -241,6 +359,8 @@ func clone(pc, usp, flags, tls uintptr) int {
 	if flags&_CLONE_IDLE != 0 {
 		tf.CS = _KCODE_IDX << 3
 		tf.SS = _KDATA_IDX << 3
+		chld.idle = true
+		cpus[flags&_CLONE_IDLE_CPU_MASK].idle = (threadptr)(unsafe.Pointer(chld))
 	}
 
 	// for context
@@ -253,16 +373,19 @@ func clone(pc, usp, flags, tls uintptr) int {
 	chld.tf = tf
 	chld.stack = usp
 	chld.fsBase = tls
+	// the signal mask is inherited, the alternate signal stack is not
+	chld.sigmask = my.sigmask
 	chld.state = RUNNABLE
 	return chld.id
 }
 
+// exit terminates current thread, the resources are reclaimed by scheduler
 //go:nosplit
 func exit() {
 	t := Mythread()
 	t.state = EXIT
-	Yield()
-	// TODO: handle thread exit in scheduler
+	Sched()
+	throw("exited thread running")
 }
 
 //go:nosplit
@@ -273,13 +396,19 @@ func threadInit() {
 //go:nosplit
 func swtch(old **context, _new *context)
 
+// schedule is the scheduler loop of every cpu, the kernel lock
+// is held except when running a thread.
 //go:nosplit
 func schedule() {
 	var t *Thread
 	var idx int
+	klock.lock()
 	for {
 		t = pickup(&idx)
 		switchto(t)
+		if t.state == EXIT {
+			freeThread(t)
+		}
 	}
 }
 
@@ -295,17 +424,18 @@ func pickup(pidx *int) *Thread {
 	}
 
 	var t *Thread
-	for i := 0; i < _NTHREDS; i++ {
-		idx := (curr + i + 1) % _NTHREDS
+	n := nthreads
+	for i := 0; i < n; i++ {
+		idx := (curr + i + 1) % n
 		*pidx = idx
-		tt := &threads[idx]
-		if tt.state == RUNNABLE && tt != idleThread.ptr() {
+		tt := threadAt(idx)
+		if tt.state == RUNNABLE && !tt.idle {
 			t = tt
 			break
 		}
 	}
 	if t == nil {
-		t = idleThread.ptr()
+		t = mycpu().idle.ptr()
 	}
 	if t == nil {
 		throw("no runnable thread")
@@ -325,30 +455,48 @@ func switchto(t *Thread) {
 	setMythread(t)
 	t.state = RUNNING
 
-	if t == idleThread.ptr() && t.tf.CS != 8 {
+	if t.idle && t.tf.CS != 8 {
 		throw("bad idle cs")
 
 	}
-	swtch(&scheduler, t.context)
-	used := nanosecond() - begin
+	c := mycpu()
+	c.curr = (threadptr)(unsafe.Pointer(t))
+	atomic.AddUint64(&c.nswitch, 1)
+	t.runStart = begin
+	timerArm(t)
+	swtch(&c.scheduler, t.context)
+	c.curr = 0
+	now := nanosecond()
+	itimerCharge(t, now)
+	used := now - begin
 	t.counter += used
 }
 
-func ThreadStat(stat *[_NTHREDS]int64) {
-	for i := 0; i < _NTHREDS; i++ {
-		stat[i] = threads[i].counter
+// ThreadStat appends the cpu time in nanoseconds of every thread slot to stat,
+// indexed by thread id, unused slots are zero.
+func ThreadStat(stat []int64) []int64 {
+	stat = stat[:0]
+	n := nthreads
+	for i := 0; i < n; i++ {
+		t := threadAt(i)
+		if t.state == UNUSED {
+			stat = append(stat, 0)
+			continue
+		}
+		stat = append(stat, t.counter)
 	}
+	return stat
 }
 
 //go:nosplit
 func Sched() {
 	my := Mythread()
-	swtch(&my.context, scheduler)
+	swtch(&my.context, mycpu().scheduler)
 }
 
 //go:nosplit
 func Yield() {
 	my := Mythread()
 	my.state = RUNNABLE
-	swtch(&my.context, scheduler)
+	swtch(&my.context, mycpu().scheduler)
 }
@@ -4,6 +4,7 @@
 #define SYS_sched_yield	 24
 
 #define tls_my 0
+#define tls_cpu 16
 
 // func swtch(old **context, _new *context)
 TEXT ·swtch(SB), NOSPLIT, $0-16
@@ -38,6 +39,12 @@ TEXT ·Mythread(SB), NOSPLIT, $0-8
 	MOVQ AX, ret+0(FP)
 	RET
 
+// mycpu() *cpu
+TEXT ·mycpu(SB), NOSPLIT, $0-8
+	MOVQ tls_cpu(GS), AX
+	MOVQ AX, ret+0(FP)
+	RET
+
 // ksysClone(pc, stack, flags uint64) (ax uint64) invokes SYS_clone.
 TEXT ·ksysClone(SB), NOSPLIT, $0-32
 	MOVQ $SYS_clone, AX
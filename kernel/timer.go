@@ -1,7 +1,10 @@
 package kernel
 
 import (
-	"github.com/icexin/eggos/drivers/pic"
+	"math"
+	"math/bits"
+
+	"github.com/icexin/eggos/drivers/apic"
 	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/kernel/trap"
 	"gvisor.dev/gvisor/pkg/abi/linux"
@@ -9,9 +12,11 @@ import (
 
 const (
 	_PIT_HZ = 1193180
-	_HZ     = 100
+	// calibrate timers in 1/_CALIBRATE_HZ second, must fit in 16 bits PIT counter
+	_CALIBRATE_HZ = 20
 
-	_IRQ_TIMER = pic.IRQ_BASE + pic.LINE_TIMER
+	// max time a thread can run before being preempted
+	_TIMESLICE = 10 * ms
 )
 
 const (
@@ -20,72 +25,130 @@ const (
 	second = 1000 * ms
 )
 
-var (
-	// the counter of sched clock
-	counter int64 = 1
-
-	// the unix time of cmos read time
-	baseUnixTime int64
-	// the counter of cmos read time
-	clockBaseCounter int64
-
-	sleeplock uintptr
-)
+// timespecNano returns the nanoseconds of sec and nsec, saturated at math.MaxInt64
+//go:nosplit
+func timespecNano(sec, nsec int64) int64 {
+	if sec >= math.MaxInt64/second {
+		return math.MaxInt64
+	}
+	return sec*second + nsec
+}
 
-// pitCounter return the current counter of 8259a
+// deadlineAfter returns the monotonic time d after now, saturated at math.MaxInt64
 //go:nosplit
-func pitCounter() int32 {
-	const div = (_PIT_HZ / _HZ)
-	// Send the latch command to channel 0
-	sys.Outb(0x43, 0)
-	lo := sys.Inb(0x40)
-	hi := sys.Inb(0x40)
-	ax := (int32(hi)<<8 | int32(lo))
-	return div - ax
+func deadlineAfter(d int64) int64 {
+	now := nanosecond()
+	if d > math.MaxInt64-now {
+		return math.MaxInt64
+	}
+	return now + d
 }
 
 //go:nosplit
-func nanosecond() int64 {
-	var t int64 = counter * (second / _HZ)
-	elapse := int64(pitCounter()) * (second / _PIT_HZ)
-	t += elapse
-	return t
+func nanosleep(tc *linux.Timespec) {
+	deadline := deadlineAfter(timespecNano(tc.Sec, tc.Nsec))
+	t := Mythread()
+	for nanosecond() < deadline {
+		timerAdd(t, deadline)
+		t.state = SLEEPING
+		Sched()
+		timerDel(t)
+	}
 }
 
+// timerIntr is the local apic timer handler of all cpus,
+// it wakes the expired threads and preempts the running thread.
 //go:nosplit
-func clocktime() linux.Timespec {
-	var ts linux.Timespec
-	n := counter - clockBaseCounter
-	ts.Sec = n/_HZ + baseUnixTime
-	ts.Nsec = n % _HZ * (second / _HZ)
-	ts.Nsec += int64(pitCounter()) * (second / _PIT_HZ)
-	return ts
+func timerIntr() {
+	apic.EOI()
+	now := nanosecond()
+	timerExpire(now)
+	itimerCharge(Mythread(), now)
+	itimerExpire(now)
+	gdbPoll()
+	watchdogTimer()
+	Yield()
 }
 
+// timerArm programs the local apic timer of current cpu before running t,
+// the timer fires at the earliest deadline of sleeping threads and interval timers,
+// or the end of time slice if t is not the idle thread.
+// An idle cpu with no sleeping threads takes no timer interrupt.
 //go:nosplit
-func nanosleep(tc *linux.Timespec) {
-	deadline := nanosecond() + int64(tc.Nsec+tc.Sec*second)
+func timerArm(t *Thread) {
 	now := nanosecond()
-	for now < deadline {
-		sleepon(&sleeplock)
-		now = nanosecond()
+	deadline := timerNext()
+	if next := itimerNext(t, now); next != 0 && (deadline == 0 || next < deadline) {
+		deadline = next
+	}
+	if !t.idle && (deadline == 0 || deadline > now+_TIMESLICE) {
+		deadline = now + _TIMESLICE
 	}
+	if tscDeadline {
+		var tsc uint64
+		if deadline != 0 {
+			tsc = nanoToTSC(deadline)
+		}
+		// zero disarms the timer
+		wrmsr(_MSR_TSC_DEADLINE, uintptr(tsc))
+		return
+	}
+	if deadline == 0 {
+		apic.TimerStop()
+		return
+	}
+	delta := deadline - now
+	if delta <= 0 {
+		delta = 1
+	}
+	hi, lo := bits.Mul64(uint64(delta), lapicFreq)
+	count, _ := bits.Div64(hi%second, lo, second)
+	if hi >= second || count > 0xffffffff {
+		// fires early and arms again
+		count = 0xffffffff
+	}
+	if count == 0 {
+		count = 1
+	}
+	apic.TimerStart(apic.VECTOR_TIMER, uint32(count), false)
 }
 
+// pitWait busy waits n ticks of PIT using channel 2
 //go:nosplit
-func timerIntr() {
-	counter++
-	wakeup(&sleeplock, -1)
-	pic.EOI(_IRQ_TIMER)
-	Yield()
+func pitWait(n uint16) {
+	// gate high, speaker off
+	sys.Outb(0x61, sys.Inb(0x61)&^0x02|0x01)
+	// channel 2, lobyte/hibyte, mode 0
+	sys.Outb(0x43, 0xb0)
+	sys.Outb(0x42, byte(n))
+	sys.Outb(0x42, byte(n>>8))
+	// wait OUT2 going high
+	for sys.Inb(0x61)&0x20 == 0 {
+	}
+}
+
+// pitStart makes channel 0 of PIT fire hz times per second,
+// hz must be greater than 18.
+//go:nosplit
+func pitStart(hz int) {
+	div := _PIT_HZ / hz
+	// channel 0, lobyte/hibyte, mode 2 rate generator
+	sys.Outb(0x43, 0x34)
+	sys.Outb(0x40, byte(div))
+	sys.Outb(0x40, byte(div>>8))
+}
+
+// timerCPUInit sets up the local apic timer of current cpu,
+// the timer is armed on every thread switch.
+//go:nosplit
+func timerCPUInit() {
+	if tscDeadline {
+		apic.TimerDeadlineMode(apic.VECTOR_TIMER)
+	}
 }
 
 //go:nosplit
 func timerInit() {
-	div := int(_PIT_HZ / _HZ)
-	sys.Outb(0x43, 0x36)
-	sys.Outb(0x40, byte(div&0xff))
-	sys.Outb(0x40, byte((div>>8)&0xff))
-	trap.Register(_IRQ_TIMER, timerIntr)
-	pic.EnableIRQ(pic.LINE_TIMER)
+	trap.Register(apic.VECTOR_TIMER, timerIntr)
+	timerCPUInit()
 }
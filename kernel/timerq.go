@@ -0,0 +1,116 @@
+package kernel
+
+import "unsafe"
+
+// timerq is a min heap of sleeping threads keyed by deadline,
+// it's protected by klock.
+var (
+	timerq  [_MAX_THREADS]threadptr
+	ntimerq int
+)
+
+//go:nosplit
+func timerLess(i, j int) bool {
+	return timerq[i].ptr().deadline < timerq[j].ptr().deadline
+}
+
+//go:nosplit
+func timerSwap(i, j int) {
+	timerq[i], timerq[j] = timerq[j], timerq[i]
+	timerq[i].ptr().timerIdx = i + 1
+	timerq[j].ptr().timerIdx = j + 1
+}
+
+//go:nosplit
+func timerUp(i int) {
+	for i > 0 {
+		p := (i - 1) / 2
+		if !timerLess(i, p) {
+			break
+		}
+		timerSwap(i, p)
+		i = p
+	}
+}
+
+//go:nosplit
+func timerDown(i int) {
+	for {
+		l := 2*i + 1
+		if l >= ntimerq {
+			break
+		}
+		m := l
+		if r := l + 1; r < ntimerq && timerLess(r, l) {
+			m = r
+		}
+		if !timerLess(m, i) {
+			break
+		}
+		timerSwap(i, m)
+		i = m
+	}
+}
+
+// timerAdd puts t into the timer queue, t will be waked up at deadline
+//go:nosplit
+func timerAdd(t *Thread, deadline int64) {
+	if t.timerIdx != 0 {
+		timerDel(t)
+	}
+	t.deadline = deadline
+	i := ntimerq
+	ntimerq++
+	timerq[i] = (threadptr)(unsafe.Pointer(t))
+	t.timerIdx = i + 1
+	timerUp(i)
+}
+
+// timerDel removes t from the timer queue if present
+//go:nosplit
+func timerDel(t *Thread) {
+	if t.timerIdx == 0 {
+		return
+	}
+	i := t.timerIdx - 1
+	last := ntimerq - 1
+	if i != last {
+		timerSwap(i, last)
+	}
+	timerq[last] = 0
+	ntimerq--
+	t.timerIdx = 0
+	if i != last {
+		timerDown(i)
+		timerUp(i)
+	}
+}
+
+// timerNext returns the earliest deadline, zero if the queue is empty
+//go:nosplit
+func timerNext() int64 {
+	if ntimerq == 0 {
+		return 0
+	}
+	return timerq[0].ptr().deadline
+}
+
+// timerExpire wakes up all the threads whose deadline is before now
+//go:nosplit
+func timerExpire(now int64) {
+	cnt := 0
+	for ntimerq > 0 {
+		t := timerq[0].ptr()
+		if t.deadline > now {
+			break
+		}
+		timerDel(t)
+		if t.state == SLEEPING {
+			t.state = RUNNABLE
+			cnt++
+		}
+	}
+	if cnt > 0 {
+		kickIdle()
+	}
+}
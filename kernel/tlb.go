@@ -0,0 +1,81 @@
+package kernel
+
+import (
+	"sync/atomic"
+
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+)
+
+// The page tables are shared by all cpus, mm asks the other cpus to flush their tlb
+// after unmapping pages or changing protection. The shootdown is sent with kernel lock held,
+// so the IPI never goes through dotrap, and the cpus spinning on the lock with interrupt
+// disabled do the flush in the spinning loop.
+
+var tlbReq struct {
+	// increased by every shootdown, the cpus done are recorded in cpu.tlbSeq
+	seq      uint64
+	va, size uintptr
+}
+
+//go:nosplit
+func tlbtrap()
+
+//go:nosplit
+func tlbInit() {
+	setIdtDesc(&idt[apic.VECTOR_TLB], sys.FuncPC(tlbtrap), segDplKernel)
+}
+
+// tlbShootdown flushes the tlb entries of [va, va+size) on all cpus and waits for them done,
+// it's called by mm with kernel lock held.
+//go:nosplit
+func tlbShootdown(va, size uintptr) {
+	mm.FlushTLB(va, size)
+	if ncpu == 1 {
+		return
+	}
+	my := mycpu()
+	seq := tlbReq.seq + 1
+	tlbReq.va, tlbReq.size = va, size
+	atomic.StoreUint64(&tlbReq.seq, seq)
+
+	var targets uint32
+	flags := pushcli()
+	for i := 0; i < ncpu; i++ {
+		c := &cpus[i]
+		if c == my || atomic.LoadUint32(&c.started) == 0 {
+			continue
+		}
+		targets |= 1 << i
+		apic.SendIPI(c.apicid, apic.VECTOR_TLB)
+	}
+	popcli(flags)
+	for i := 0; i < ncpu; i++ {
+		if targets&(1<<i) == 0 {
+			continue
+		}
+		for atomic.LoadUint64(&cpus[i].tlbSeq) != seq {
+			sys.Pause()
+		}
+	}
+}
+
+// tlbPoll does the shootdown not done by current cpu
+//go:nosplit
+func tlbPoll() {
+	c := mycpu()
+	seq := atomic.LoadUint64(&tlbReq.seq)
+	if atomic.LoadUint64(&c.tlbSeq) == seq {
+		return
+	}
+	mm.FlushTLB(tlbReq.va, tlbReq.size)
+	atomic.StoreUint64(&c.tlbSeq, seq)
+}
+
+// tlbIntr is the handler of shootdown IPI, called by rawTrap without kernel lock
+//go:nosplit
+func tlbIntr() {
+	tlbPoll()
+	apic.EOI()
+}
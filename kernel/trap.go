@@ -3,8 +3,11 @@ package kernel
 import (
 	"unsafe"
 
-	"github.com/icexin/eggos/drivers/pic"
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/drivers/irq"
+	"github.com/icexin/eggos/kernel/entropy"
 	"github.com/icexin/eggos/kernel/isyscall"
+	"github.com/icexin/eggos/kernel/mm"
 	"github.com/icexin/eggos/kernel/sys"
 	"github.com/icexin/eggos/kernel/trap"
 	"github.com/icexin/eggos/log"
@@ -27,16 +30,37 @@ var (
 		"#SS(12) Stack exception",
 		"#GP(13) General protection exception",
 		"#PF(14) Page fault exception",
-		"#MF(15) x87 floating point exception",
-		"#AC(16) Alignment check exception",
-		"#MC(17) Machine check exception",
-		"#XF(18) SIMD floating point exception",
-		"#HV(19) Hypervisor injection exception",
-		"#VC(20) VMM communication exception",
-		"#SX(21) Security Exception",
+		"(15) Reserved",
+		"#MF(16) x87 floating point exception",
+		"#AC(17) Alignment check exception",
+		"#MC(18) Machine check exception",
+		"#XF(19) SIMD floating point exception",
+		"#VE(20) Virtualization exception",
+		"#CP(21) Control protection exception",
 	}
 )
 
+// the interrupt stack table entries of #DF and #PF, see faultStackInit
+const (
+	_DF_IST           = 2
+	_PF_IST           = 3
+	_FAULT_STACK_SIZE = 16 << 10
+)
+
+// the offsets and exception bits of the fxsave area
+const (
+	_FXSAVE_FSW        = 2
+	_FXSAVE_MXCSR      = 24
+	_FXSAVE_MXCSR_MASK = 28
+
+	// the exception flags, stack fault, error summary and busy bits
+	_FSW_EXCEPTIONS = 0x80ff
+	// the exception flags
+	_MXCSR_EXCEPTIONS = 0x3f
+	// the supported bits if MXCSR_MASK is zero
+	_MXCSR_DEFAULT_MASK = 0xffbf
+)
+
 //go:notinheap
 type trapFrame struct {
 	AX, BX, CX, DX    uintptr
@@ -60,17 +84,42 @@ func trapret()
 //go:nosplit
 func trapPanic() {
 	tf := Mythread().tf
-	log.PrintStr("trap panic: ")
-	if tf.Trapno < uintptr(len(trapnum)) {
-		log.PrintStr(trapnum[tf.Trapno])
-	}
-	log.PrintStr("\n")
-	throwtf(tf, "stack trace:")
+	throwtf(tf, "trap panic")
+}
+
+// the panics of go runtime raised by cpu exceptions
+//go:linkname panicdivide runtime.panicdivide
+func panicdivide()
+
+//go:linkname panicfloat runtime.panicfloat
+func panicfloat()
+
+//go:linkname panicmem runtime.panicmem
+func panicmem()
+
+// trapError is the runtime.Error of the cpu exceptions
+// which have no counterpart in go runtime
+type trapError string
+
+func (e trapError) RuntimeError() {}
+
+func (e trapError) Error() string {
+	return "runtime error: " + string(e)
 }
 
 //go:nosplit
 func pageFaultPanic() {
-	panic("nil pointer or invalid memory access")
+	panicmem()
+}
+
+//go:nosplit
+func illegalInstructionPanic() {
+	panic(trapError("illegal instruction"))
+}
+
+//go:nosplit
+func alignmentPanic() {
+	panic(trapError("unaligned memory access"))
 }
 
 //go:nosplit
@@ -80,10 +129,70 @@ func ignoreHandler() {
 //go:nosplit
 func pageFaultHandler() {
 	t := Mythread()
+	// the stack is overflowed, there is no room to run pageFaultPanic
+	if mm.IsGuard(sys.Cr2()) {
+		throwtf(t.tf, "stack overflow, guard page accessed")
+	}
+	// the page is changed by another cpu meanwhile, eg. promoted to 2M page
+	if mm.Spurious(sys.Cr2(), t.tf.Err) {
+		return
+	}
+	// the page released by MADV_DONTNEED is accessed
+	if mm.Fault(sys.Cr2(), t.tf.Err) {
+		return
+	}
 	checkKernelPanic(t)
 	changeReturnPC(t.tf, sys.FuncPC(pageFaultPanic))
 }
 
+// faultPanic makes the faulting goroutine call fn, which panics like
+// the go runtime does on SIGFPE, SIGILL and SIGSEGV of linux
+//go:nosplit
+func faultPanic(fn func()) {
+	t := Mythread()
+	checkKernelPanic(t)
+	changeReturnPC(t.tf, sys.FuncPC(fn))
+}
+
+//go:nosplit
+func divideErrorHandler() {
+	faultPanic(panicdivide)
+}
+
+//go:nosplit
+func invalidOpcodeHandler() {
+	faultPanic(illegalInstructionPanic)
+}
+
+// protectionFaultHandler handles #NP, #SS and #GP, which are mostly
+// caused by accessing a non-canonical address
+//go:nosplit
+func protectionFaultHandler() {
+	faultPanic(panicmem)
+}
+
+//go:nosplit
+func alignmentCheckHandler() {
+	faultPanic(alignmentPanic)
+}
+
+// x87FaultHandler clears the pending x87 exception before panic,
+// otherwise the next x87 instruction traps again
+//go:nosplit
+func x87FaultHandler() {
+	fsw := (*uint16)(unsafe.Pointer(Mythread().fpstate + _FXSAVE_FSW))
+	*fsw &^= _FSW_EXCEPTIONS
+	faultPanic(panicfloat)
+}
+
+// simdFaultHandler clears the exception flags of MXCSR before panic
+//go:nosplit
+func simdFaultHandler() {
+	mxcsr := (*uint32)(unsafe.Pointer(Mythread().fpstate + _FXSAVE_MXCSR))
+	*mxcsr &^= _MXCSR_EXCEPTIONS
+	faultPanic(panicfloat)
+}
+
 //go:nosplit
 func faultHandler() {
 	trapPanic()
@@ -92,7 +201,7 @@ func faultHandler() {
 //go:nosplit
 func printReg(name string, reg uintptr) {
 	log.PrintStr(name)
-	log.PrintStr("=")
+	log.PrintStr("=0x")
 	log.PrintHex(reg)
 	log.PrintStr("\n")
 }
@@ -103,18 +212,7 @@ func checkKernelPanic(t *Thread) {
 	if tf.CS != _KCODE_IDX<<3 {
 		return
 	}
-	printReg("tid", uintptr(t.id))
-	printReg("no", tf.Trapno)
-	printReg("err", tf.Err)
-	printReg("cr2", sys.Cr2())
-	printReg("ip", tf.IP)
-	printReg("sp", tf.SP)
-	printReg("ax", tf.AX)
-	printReg("bx", tf.BX)
-	printReg("cx", tf.CX)
-	printReg("dx", tf.CX)
-	printReg("cs", tf.CS)
-	throw("trap fault in kernel\n")
+	throwtf(tf, "trap fault in kernel")
 }
 
 //go:nosplit
@@ -134,11 +232,58 @@ func changeReturnPC(tf *trapFrame, pc uintptr) {
 	tf.IP = pc
 }
 
+//go:nosplit
+func pftrap()
+
+// kernelPageFault is called by pftrap before dotrap, it populates the page
+// released by MADV_DONTNEED which is accessed by kernel with kernel lock held,
+// eg. the buffer of read syscall. It returns false if the fault goes to dotrap.
+//go:nosplit
+func kernelPageFault(tf *trapFrame) bool {
+	return tf.CS == _KCODE_IDX<<3 && klock.holding() && mm.Fault(sys.Cr2(), tf.Err)
+}
+
+// faultStackInit makes #DF and #PF run on their own stacks on every cpu,
+// so the overflow of kernel stack is reported instead of triple fault.
+//go:nosplit
+func faultStackInit() {
+	for i := 0; i < ncpu; i++ {
+		stack := mm.MmapGuard(_FAULT_STACK_SIZE)
+		setTssIST(&cpus[i], _DF_IST, stack+_FAULT_STACK_SIZE)
+		stack = mm.MmapGuard(_FAULT_STACK_SIZE)
+		setTssIST(&cpus[i], _PF_IST, stack+_FAULT_STACK_SIZE)
+	}
+	setIdtIST(&idt[8], _DF_IST)
+	setIdtDesc(&idt[14], sys.FuncPC(pftrap), segDplKernel)
+	setIdtIST(&idt[14], _PF_IST)
+}
+
+// doubleFault reports the #DF, which is mostly caused by
+// the page fault of pushing trap frame on the overflowed stack.
+//go:nosplit
+func doubleFault(tf *trapFrame) {
+	if mm.IsGuard(sys.Cr2()) {
+		throwtf(tf, "kernel stack overflow, guard page accessed")
+	}
+	throwtf(tf, "double fault")
+}
+
 //go:nosplit
 func dotrap(tf *trapFrame) {
 	if sys.Flags()&_FLAGS_IF != 0 {
 		throw("IF should clear")
 	}
+	if tf.Trapno == 8 {
+		doubleFault(tf)
+	}
+	// trap in kernel code, the lock is never released
+	if klock.holding() {
+		if tf.Trapno == 14 && mm.IsGuard(sys.Cr2()) {
+			throwtf(tf, "kernel stack overflow, guard page accessed")
+		}
+		throwtf(tf, "trap with kernel lock held")
+	}
+	klock.lock()
 	my := Mythread()
 	// ugly as it is, avoid writeBarrier
 	// my.tf = tf
@@ -149,22 +294,48 @@ func dotrap(tf *trapFrame) {
 		faultHandler()
 		return
 	}
-	// timer and syscall interrupts are processed synchronously
-	if tf.Trapno > 32 && tf.Trapno != 0x80 {
-		// pci using level trigger irq, cause dead lock on trap handler
-		// FIXME: hard code network irq line
-		if tf.Trapno == 43 {
-			pic.DisableIRQ(43 - pic.IRQ_BASE)
-		}
+	// timer, syscall and local apic interrupts are processed synchronously
+	if isDeviceIRQ(tf.Trapno) {
+		// the arrival time of device interrupts is unpredictable
+		entropy.AddSample(sys.Rdtsc() ^ uint64(tf.Trapno))
+		irq.Ack(tf.Trapno)
 		wakeIRQ(tf.Trapno)
 		return
 	}
 	handler()
 }
 
+// rawTrap is called by rawtraps without kernel lock
+//go:nosplit
+func rawTrap(tf *trapFrame) {
+	switch tf.Trapno {
+	case 2:
+		nmiTrap(tf)
+	case apic.VECTOR_TLB:
+		tlbIntr()
+	}
+}
+
+// isDeviceIRQ reports whether the trap is an external interrupt
+// which will be handled by the trap thread
+//go:nosplit
+func isDeviceIRQ(no uintptr) bool {
+	return irq.IsDevice(no)
+}
+
 //go:nosplit
 func trapInit() {
+	trap.Register(0, divideErrorHandler)
+	trap.Register(6, invalidOpcodeHandler)
+	trap.Register(11, protectionFaultHandler)
+	trap.Register(12, protectionFaultHandler)
+	trap.Register(13, protectionFaultHandler)
 	trap.Register(14, pageFaultHandler)
+	trap.Register(16, x87FaultHandler)
+	trap.Register(17, alignmentCheckHandler)
+	trap.Register(19, simdFaultHandler)
 	trap.Register(39, ignoreHandler)
 	trap.Register(47, ignoreHandler)
+	trap.Register(apic.VECTOR_RESCHED, reschedIntr)
+	trap.Register(apic.VECTOR_SPURIOUS, ignoreHandler)
 }
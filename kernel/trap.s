@@ -2,6 +2,9 @@
 
 #define m_fpstate 32
 
+// sync with apic.VECTOR_TLB
+#define VECTOR_TLB 0xf2
+
 TEXT alltraps(SB), NOSPLIT, $0
 	PUSHQ R15
 	PUSHQ R14
@@ -32,6 +35,9 @@ TEXT alltraps(SB), NOSPLIT, $0
 	JMP   ·trapret(SB)
 
 TEXT ·trapret(SB), NOSPLIT, $0
+	// release the kernel lock acquired by dotrap or scheduler
+	CALL ·trapUnlock(SB)
+
 	// CX store mythread
 	MOVQ 0(GS), CX
 
@@ -59,3 +65,131 @@ TEXT ·trapret(SB), NOSPLIT, $0
 
 	IRETQ
 
+
+// nmitrap is the entry of NMI running on its own stack, the NMI may arrive
+// with kernel lock held or in the middle of a trap entry.
+TEXT ·nmitrap(SB), NOSPLIT, $0
+	PUSHQ $0
+	PUSHQ $2
+	JMP   rawtraps(SB)
+
+// tlbtrap is the entry of tlb shootdown IPI, which is sent with kernel lock held.
+TEXT ·tlbtrap(SB), NOSPLIT, $0
+	PUSHQ $0
+	PUSHQ $VECTOR_TLB
+	JMP   rawtraps(SB)
+
+// pftrap is the entry of #PF, the faults handled by kernelPageFault return
+// directly, since the kernel lock may be held. Others go to alltraps.
+TEXT ·pftrap(SB), NOSPLIT, $0
+	PUSHQ $14
+	PUSHQ R15
+	PUSHQ R14
+	PUSHQ R13
+	PUSHQ R12
+	PUSHQ R11
+	PUSHQ R10
+	PUSHQ R9
+	PUSHQ R8
+	PUSHQ DI
+	PUSHQ SI
+	PUSHQ BP
+	PUSHQ DX
+	PUSHQ CX
+	PUSHQ BX
+	PUSHQ AX
+
+	// BX store trap frame, the fpu state is saved at 32(SP) aligned by 16
+	MOVQ   SP, BX
+	SUBQ   $544, SP
+	ANDQ   $~15, SP
+	FXSAVE 32(SP)
+	MOVQ   BX, 16(SP)
+
+	XORQ BP, BP
+	MOVQ BX, 0(SP)
+	CALL ·kernelPageFault(SB)
+
+	// the flags of result are kept, POPQ changes no flags
+	MOVQ    16(SP), BX
+	FXRSTOR 32(SP)
+	CMPB    8(SP), $0
+	MOVQ    BX, SP
+
+	POPQ AX
+	POPQ BX
+	POPQ CX
+	POPQ DX
+	POPQ BP
+	POPQ SI
+	POPQ DI
+	POPQ R8
+	POPQ R9
+	POPQ R10
+	POPQ R11
+	POPQ R12
+	POPQ R13
+	POPQ R14
+	POPQ R15
+
+	JNE handled
+	// the trapno and errcode are left for alltraps
+	JMP alltraps(SB)
+
+handled:
+	ADDQ $16, SP // skip trapno and errcode
+	IRETQ
+
+// rawtraps calls rawTrap for the traps which can't wait for the kernel lock,
+// it saves the fpu state on stack and never goes through dotrap and trapret.
+TEXT rawtraps(SB), NOSPLIT, $0
+	PUSHQ R15
+	PUSHQ R14
+	PUSHQ R13
+	PUSHQ R12
+	PUSHQ R11
+	PUSHQ R10
+	PUSHQ R9
+	PUSHQ R8
+	PUSHQ DI
+	PUSHQ SI
+	PUSHQ BP
+	PUSHQ DX
+	PUSHQ CX
+	PUSHQ BX
+	PUSHQ AX
+
+	// BX store trap frame, the fpu state is saved at 16(SP) aligned by 16
+	MOVQ   SP, BX
+	SUBQ   $528, SP
+	ANDQ   $~15, SP
+	FXSAVE 16(SP)
+	MOVQ   BX, 8(SP)
+
+	XORQ BP, BP
+	MOVQ BX, 0(SP)
+	CALL ·rawTrap(SB)
+
+	MOVQ    8(SP), BX
+	FXRSTOR 16(SP)
+	MOVQ    BX, SP
+
+	POPQ AX
+	POPQ BX
+	POPQ CX
+	POPQ DX
+	POPQ BP
+	POPQ SI
+	POPQ DI
+	POPQ R8
+	POPQ R9
+	POPQ R10
+	POPQ R11
+	POPQ R12
+	POPQ R13
+	POPQ R14
+	POPQ R15
+
+	ADDQ $16, SP // skip trapno and errcode
+
+	IRETQ
@@ -3,10 +3,11 @@ package kernel
 import (
 	"fmt"
 	"runtime"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 
-	"github.com/icexin/eggos/drivers/pic"
+	"github.com/icexin/eggos/drivers/irq"
 	"github.com/icexin/eggos/kernel/trap"
 	"github.com/icexin/eggos/log"
 )
@@ -15,6 +16,8 @@ var (
 	// 因为中断处理是异步的，在获取一次中断期间可能发生了多次中断，
 	// irqset按位保存发生的中断，对应的中断号为IRQ_BASE+1<<bit
 	irqset uintptr
+	// number of times the trap thread takes irqset, checked by watchdog
+	irqWaits uint64
 
 	traptask threadptr
 )
@@ -38,12 +41,12 @@ func runTrapThread() {
 			if trapset&(1<<i) == 0 {
 				continue
 			}
-			trapno := uintptr(pic.IRQ_BASE + i)
+			trapno := uintptr(irq.IRQ_BASE + i)
 
 			handler := trap.Handler(int(trapno))
 			if handler == nil {
 				fmt.Printf("trap handler for %d not found\n", trapno)
-				pic.EOI(trapno)
+				irq.EOI(trapno)
 				continue
 			}
 			handler()
@@ -53,20 +56,18 @@ func runTrapThread() {
 
 //go:nosplit
 func wakeIRQ(no uintptr) {
-	irqset |= 1 << (no - pic.IRQ_BASE)
+	irqset |= 1 << (no - irq.IRQ_BASE)
 	wakeup(&irqset, 1)
 	Yield()
 }
 
 //go:nosplit
 func waitIRQ() uintptr {
-	if irqset != 0 {
-		ret := irqset
-		irqset = 0
-		return ret
+	if irqset == 0 {
+		sleepon(&irqset)
 	}
-	sleepon(&irqset)
 	ret := irqset
 	irqset = 0
+	atomic.AddUint64(&irqWaits, 1)
 	return ret
 }
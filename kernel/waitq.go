@@ -0,0 +1,115 @@
+package kernel
+
+import "unsafe"
+
+const (
+	_WAITQ_BUCKETS = 256
+	_WAITQ_SHIFT   = 8
+
+	_WAIT_BITS_ANY = ^uint32(0)
+)
+
+// waitq is a FIFO list of threads sleeping on the keys hashed to the same bucket,
+// the list is linked by Thread.waitNext and Thread.waitPrev.
+// All the wait queues are protected by klock.
+type waitq struct {
+	head threadptr
+	tail threadptr
+}
+
+var waitqs [_WAITQ_BUCKETS]waitq
+
+//go:nosplit
+func waitqOf(key uintptr) *waitq {
+	// fibonacci hashing
+	h := (uint64(key) >> 2) * 0x9e3779b97f4a7c15
+	return &waitqs[h>>(64-_WAITQ_SHIFT)]
+}
+
+// waitqAdd puts t on the wait queue of key, bits is used
+// to filter wakeups, see FUTEX_WAIT_BITSET.
+//go:nosplit
+func waitqAdd(t *Thread, key uintptr, bits uint32) {
+	if t.waiting {
+		waitqDel(t)
+	}
+	t.sleepKey = key
+	t.waitBits = bits
+	t.waiting = true
+	q := waitqOf(key)
+	tp := (threadptr)(unsafe.Pointer(t))
+	t.waitNext = 0
+	t.waitPrev = q.tail
+	if q.tail != 0 {
+		q.tail.ptr().waitNext = tp
+	} else {
+		q.head = tp
+	}
+	q.tail = tp
+}
+
+// waitqDel removes t from its wait queue if present
+//go:nosplit
+func waitqDel(t *Thread) {
+	if !t.waiting {
+		return
+	}
+	q := waitqOf(t.sleepKey)
+	if t.waitPrev != 0 {
+		t.waitPrev.ptr().waitNext = t.waitNext
+	} else {
+		q.head = t.waitNext
+	}
+	if t.waitNext != 0 {
+		t.waitNext.ptr().waitPrev = t.waitPrev
+	} else {
+		q.tail = t.waitPrev
+	}
+	t.waitNext = 0
+	t.waitPrev = 0
+	t.waiting = false
+	t.sleepKey = 0
+	t.waitBits = 0
+}
+
+// waitqWake wakes at most n threads sleeping on key whose bits intersect with bits,
+// n < 0 means all threads. It returns the number of threads waked up.
+//go:nosplit
+func waitqWake(key uintptr, n int, bits uint32) int {
+	q := waitqOf(key)
+	cnt := 0
+	for tp := q.head; tp != 0 && (n < 0 || cnt < n); {
+		t := tp.ptr()
+		tp = t.waitNext
+		if t.sleepKey != key || t.waitBits&bits == 0 {
+			continue
+		}
+		waitqDel(t)
+		if t.state == SLEEPING {
+			t.state = RUNNABLE
+		}
+		cnt++
+	}
+	if cnt > 0 {
+		kickIdle()
+	}
+	return cnt
+}
+
+// waitqRequeue moves at most n threads sleeping on key to key2,
+// n < 0 means all threads. It returns the number of threads moved.
+//go:nosplit
+func waitqRequeue(key, key2 uintptr, n int) int {
+	q := waitqOf(key)
+	cnt := 0
+	for tp := q.head; tp != 0 && (n < 0 || cnt < n); {
+		t := tp.ptr()
+		tp = t.waitNext
+		if t.sleepKey != key {
+			continue
+		}
+		waitqAdd(t, key2, t.waitBits)
+		cnt++
+	}
+	return cnt
+}
@@ -0,0 +1,308 @@
+package kernel
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/icexin/eggos/drivers/apic"
+	"github.com/icexin/eggos/drivers/irq"
+	"github.com/icexin/eggos/kernel/gdbstub"
+	"github.com/icexin/eggos/kernel/mm"
+	"github.com/icexin/eggos/kernel/sys"
+	"github.com/icexin/eggos/log"
+)
+
+// The watchdog finds the cpus which switch no thread for a long time, eg. spinning
+// with interrupt disabled, and the trap or syscall thread leaving their work pending.
+// It's driven by the NMI of PIT routed by I/O APIC, so it works even if all the cpus
+// are stuck with kernel lock held, otherwise by the timer interrupts of running cpus.
+
+const (
+	_WATCHDOG_TIMEOUT = 10 * time.Second
+	// the interval of progress checks
+	_WATCHDOG_PERIOD = 500 * ms
+	// the rate of PIT sending NMI
+	_WATCHDOG_PIT_HZ = 20
+	// max time to wait for a stuck cpu printing its registers
+	_WATCHDOG_DUMP_WAIT = second
+
+	_NMI_IST        = 1
+	_NMI_STACK_SIZE = 16 << 10
+)
+
+// progress tracks a counter which should move while there is pending work
+type progress struct {
+	count    uint64
+	since    int64
+	reported bool
+}
+
+// stalled reports whether the counter stays still for timeout with work pending,
+// a stall is reported once until the counter moves again.
+//go:nosplit
+func (p *progress) stalled(pending bool, count uint64, now, timeout int64) bool {
+	if !pending || count != p.count || p.since == 0 {
+		p.count, p.since, p.reported = count, now, false
+		return false
+	}
+	if p.reported || now-p.since < timeout {
+		return false
+	}
+	p.reported = true
+	return true
+}
+
+type watchdogState struct {
+	enabled bool
+	// panic after reporting, otherwise warn only
+	panic bool
+	// driven by NMI, otherwise by timer interrupts
+	nmi     bool
+	timeout int64
+
+	lastCheck int64
+	cpus      [_MAXCPU]progress
+	trap      progress
+	syscall   progress
+
+	// the stack trace buffer of every cpu
+	pcs [_MAXCPU][32]uintptr
+}
+
+var watchdog watchdogState
+
+//go:nosplit
+func nmitrap()
+
+// nmiInit makes NMI run on its own stack on every cpu,
+// since it may arrive before the kernel stack is switched, see syscallEntry.
+//go:nosplit
+func nmiInit() {
+	for i := 0; i < ncpu; i++ {
+		stack := mm.MmapGuard(_NMI_STACK_SIZE)
+		setTssIST(&cpus[i], _NMI_IST, stack+_NMI_STACK_SIZE)
+	}
+	setIdtDesc(&idt[2], sys.FuncPC(nmitrap), segDplKernel)
+	setIdtIST(&idt[2], _NMI_IST)
+}
+
+// nmiTrap is called by rawTrap without kernel lock
+//go:nosplit
+func nmiTrap(tf *trapFrame) {
+	c := mycpu()
+	if stopTrap(c) {
+		return
+	}
+	if atomic.LoadUint32(&c.nmiDump) != 0 {
+		watchdogPrintCPU(c, tf)
+		atomic.StoreUint32(&c.nmiDump, 0)
+		return
+	}
+	if !watchdog.enabled {
+		throwtf(tf, "unexpected NMI")
+	}
+	watchdogCheck(tf)
+}
+
+// watchdogTimer checks the progress in timer interrupt if NMI is not available,
+// which can't find the lockup of all cpus.
+//go:nosplit
+func watchdogTimer() {
+	if watchdog.enabled && !watchdog.nmi {
+		watchdogCheck(Mythread().tf)
+	}
+}
+
+// watchdogCheck is called periodically on any cpu, tf is the frame interrupted
+//go:nosplit
+func watchdogCheck(tf *trapFrame) {
+	w := &watchdog
+	now := nanosecond()
+	last := atomic.LoadInt64(&w.lastCheck)
+	if now-last < _WATCHDOG_PERIOD || !atomic.CompareAndSwapInt64(&w.lastCheck, last, now) {
+		return
+	}
+	if atomic.LoadUint32(&panicking) != 0 {
+		return
+	}
+	for i := 0; i < ncpu; i++ {
+		c := &cpus[i]
+		if atomic.LoadUint32(&c.started) == 0 {
+			continue
+		}
+		// the idle thread halts until next interrupt
+		busy := c.curr == 0 || c.curr != c.idle
+		if w.cpus[i].stalled(busy, atomic.LoadUint64(&c.nswitch), now, w.timeout) {
+			watchdogReport(tf, "watchdog: soft lockup", c)
+		}
+	}
+	if traptask != 0 && w.trap.stalled(irqset != 0, atomic.LoadUint64(&irqWaits), now, w.timeout) {
+		watchdogReport(tf, "watchdog: trap thread stalled", nil)
+	}
+	if syscalltask != 0 && w.syscall.stalled(fwdq.depth() != 0, atomic.LoadUint64(&fwdq.head), now, w.timeout) {
+		watchdogReport(tf, "watchdog: syscall thread stalled", nil)
+	}
+}
+
+// watchdogReport prints all the threads and the stuck cpu, then panics if required
+//go:nosplit
+func watchdogReport(tf *trapFrame, msg string, stuck *cpu) {
+	log.PrintStr(msg)
+	if stuck != nil {
+		log.PrintStr(" on cpu")
+		log.PrintInt(stuck.id)
+	}
+	log.PrintStr("\n")
+	watchdogPrintThreads()
+	if stuck != nil {
+		watchdogDumpCPU(stuck, tf)
+	}
+	if watchdog.panic {
+		throwtf(tf, msg)
+	}
+}
+
+// watchdogDumpCPU prints the registers and stack of c,
+// other cpus are asked to print them in NMI handler.
+//go:nosplit
+func watchdogDumpCPU(c *cpu, tf *trapFrame) {
+	if c == mycpu() {
+		watchdogPrintCPU(c, tf)
+		return
+	}
+	atomic.StoreUint32(&c.nmiDump, 1)
+	apic.SendNMI(c.apicid)
+	deadline := nanosecond() + _WATCHDOG_DUMP_WAIT
+	for atomic.LoadUint32(&c.nmiDump) != 0 && nanosecond() < deadline {
+		sys.Pause()
+	}
+}
+
+//go:nosplit
+func watchdogPrintCPU(c *cpu, tf *trapFrame) {
+	log.PrintStr("cpu")
+	log.PrintInt(c.id)
+	// no thread is running when the cpu is in scheduler
+	if t := Mythread(); t != nil {
+		log.PrintStr(" thread ")
+		log.PrintInt(t.id)
+	}
+	log.PrintStr(":\n")
+	watchdogPrintFrame(tf)
+}
+
+// watchdogPrintThreads prints the last trap frame and the go stack of every live thread
+//go:nosplit
+func watchdogPrintThreads() {
+	n := nthreads
+	for i := 0; i < n; i++ {
+		t := threadAt(i)
+		if t.state == UNUSED || t.state == EXIT || t.tf == nil || t.idle {
+			continue
+		}
+		log.PrintStr("thread ")
+		log.PrintInt(t.id)
+		log.PrintStr(" ")
+		log.PrintStr(t.stateName())
+		if t.state == RUNNING {
+			log.PrintStr(" on cpu")
+			log.PrintInt((*cpu)(unsafe.Pointer(t.threadTLS[2])).id)
+		}
+		if goid, ok := threadgoid(t); ok {
+			log.PrintStr(" goroutine ")
+			log.PrintInt(int(goid))
+		}
+		log.PrintStr(":\n")
+		watchdogPrintFrame(t.tf)
+	}
+}
+
+//go:nosplit
+func watchdogPrintFrame(tf *trapFrame) {
+	pcs := watchdog.pcs[mycpu().id][:]
+	printTfRegs(tf, "", " ")
+	log.PrintStr("\n")
+	n := mappedCallers(tf, pcs)
+	for i := 0; i < n; i++ {
+		printSymbol(pcs[i], i == 0, "()\n\t")
+		log.PrintStr(" pc=0x")
+		log.PrintHex(pcs[i])
+		log.PrintStr("\n")
+	}
+}
+
+// mappedCallers is like callers, but stops at the frame pointer not mapped,
+// since the stacks of other threads may be changing.
+//go:nosplit
+func mappedCallers(tf *trapFrame, pcs []uintptr) int {
+	pcs[0] = tf.IP
+	fp := tf.BP
+	var i int
+	for i = 1; i < len(pcs); i++ {
+		if fp == 0 || fp&(sys.PtrSize-1) != 0 || !mm.Present(fp) || !mm.Present(fp+8) {
+			break
+		}
+		pcs[i] = deref(fp + 8)
+		fp = deref(fp)
+	}
+	return i
+}
+
+// threadgoid returns the id of goroutine running on t, which is read from the go tls of t
+//go:nosplit
+func threadgoid(t *Thread) (int64, bool) {
+	if t.fsBase == 0 || !mm.Present(t.fsBase-sys.PtrSize) {
+		return 0, false
+	}
+	g := deref(t.fsBase - sys.PtrSize)
+	if g == 0 || !mm.Present(g+_G_GOID_OFFSET) {
+		return 0, false
+	}
+	return *(*int64)(unsafe.Pointer(g + _G_GOID_OFFSET)), true
+}
+
+// watchdogStart enables the watchdog by the kernel command line.
+// EGGOS_WATCHDOG is one of warn, panic and off, defaults to warn,
+// EGGOS_WATCHDOG_TIMEOUT is the duration of no progress being reported, defaults to 10s.
+func watchdogStart() {
+	mode := os.Getenv("EGGOS_WATCHDOG")
+	switch mode {
+	case "":
+		mode = "warn"
+	case "warn", "panic":
+	case "off":
+		return
+	default:
+		log.Errorf("[watchdog] unknown mode %q, use warn", mode)
+		mode = "warn"
+	}
+	// the threads stopped by gdb make no progress
+	if gdbstub.Enabled() {
+		log.Infof("[watchdog] disabled by gdb stub")
+		return
+	}
+	timeout := _WATCHDOG_TIMEOUT
+	if s := os.Getenv("EGGOS_WATCHDOG_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < time.Second {
+			log.Errorf("[watchdog] bad timeout %q, use %s", s, timeout)
+		} else {
+			timeout = d
+		}
+	}
+
+	flags := pushcli()
+	klock.lock()
+	watchdog.timeout = int64(timeout)
+	watchdog.panic = mode == "panic"
+	watchdog.enabled = true
+	if irq.EnableNMI(irq.LINE_TIMER) {
+		pitStart(_WATCHDOG_PIT_HZ)
+		watchdog.nmi = true
+	}
+	klock.unlock()
+	popcli(flags)
+	log.Infof("[watchdog] %s after %s, nmi:%v", mode, timeout, watchdog.nmi)
+}
@@ -107,3 +107,18 @@ func PrintHex(n uintptr) {
 	}
 	uart.WriteByte(hextab[n&0x0F])
 }
+
+//go:nosplit
+func PrintInt(n int) {
+	if n < 0 {
+		uart.WriteByte('-')
+		n = -n
+	}
+	d := 1
+	for n/d >= 10 {
+		d *= 10
+	}
+	for ; d > 0; d /= 10 {
+		uart.WriteByte(byte('0' + n/d%10))
+	}
+}
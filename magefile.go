@@ -278,6 +278,9 @@ func initQemuOpt() []string {
 	if os.Getenv("QEMU_GRAPHIC") == "" {
 		opts = append(opts, "-nographic")
 	}
+	if smp := os.Getenv("QEMU_SMP"); smp != "" {
+		opts = append(opts, "-smp", smp)
+	}
 	return opts
 }
 